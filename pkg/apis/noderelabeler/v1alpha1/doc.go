@@ -0,0 +1,7 @@
+// Package v1alpha1 contains the v1alpha1 version of the node-relabeler API:
+// the relabel rule types shared by the config file and the NodeRelabelRule
+// custom resource.
+//
+// +k8s:deepcopy-gen=package
+// +groupName=node-relabeler.vladlosev.github.io
+package v1alpha1
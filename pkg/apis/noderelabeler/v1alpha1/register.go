@@ -0,0 +1,33 @@
+package v1alpha1
+
+import (
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the API group of the node-relabeler resources.
+const GroupName = "node-relabeler.vladlosev.github.io"
+
+// SchemeGroupVersion is the group version of the types in this package.
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+// NodeRelabelRuleResource is the group version resource of NodeRelabelRule.
+var NodeRelabelRuleResource = SchemeGroupVersion.WithResource("noderelabelrules")
+
+var (
+	// SchemeBuilder registers the types in this package with a scheme.
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
+	// AddToScheme adds the types in this package to a scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(
+		SchemeGroupVersion,
+		&NodeRelabelRule{},
+		&NodeRelabelRuleList{},
+	)
+	meta_v1.AddToGroupVersion(scheme, SchemeGroupVersion)
+	return nil
+}
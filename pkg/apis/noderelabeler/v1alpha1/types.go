@@ -0,0 +1,200 @@
+package v1alpha1
+
+import (
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Rule is a single named relabeling rule in a config file.
+type Rule struct {
+	Name     string `json:"name" yaml:"name"`
+	RuleSpec `json:",inline" yaml:",inline"`
+}
+
+// Rule actions.
+const (
+	// ActionSet sets the label in Set on nodes with a label matching Match.
+	ActionSet = "set"
+	// ActionMove sets the label in Set and removes the label matching Match.
+	ActionMove = "move"
+	// ActionDelete removes the labels matching Match.
+	ActionDelete = "delete"
+)
+
+// RuleSpec describes which nodes a rule matches and what it does to them.
+type RuleSpec struct {
+	// Action is one of set, move, or delete. Defaults to set.
+	Action string `json:"action,omitempty" yaml:"action"`
+	// Regex makes the key and value in Match regular expressions. The key
+	// and value in Set can then refer to their capture groups as $1 or
+	// ${name}.
+	Regex bool `json:"regex,omitempty" yaml:"regex"`
+	// Selector is a label selector nodes have to match for the rule to
+	// apply to them. A set rule with a selector may omit Match, in which
+	// case the label in Set is set on all selected nodes.
+	Selector string `json:"selector,omitempty" yaml:"selector"`
+	// Condition is a CEL expression over the node variable that has to be
+	// true for the rule to apply to the node. A set rule with a condition
+	// may omit Match, like a rule with a selector.
+	Condition string `json:"condition,omitempty" yaml:"condition"`
+	Match     Label  `json:"match,omitempty" yaml:"match"`
+	// Resource matches nodes by the quantity of a resource instead of a
+	// label. Such rules set the label in Set, with the value of the matching
+	// bucket if it has one.
+	Resource *ResourceMatch `json:"resource,omitempty" yaml:"resource"`
+	// CIDR matches nodes by their IP addresses instead of a label. Such
+	// rules set the label in Set, with the value of the matching range if it
+	// has one.
+	CIDR *CIDRMatch `json:"cidr,omitempty" yaml:"cidr"`
+	// Lookup sets the labels found in a lookup table by the value of a
+	// node label or field. Such rules have no Set.
+	Lookup *LookupMatch `json:"lookup,omitempty" yaml:"lookup"`
+	// Plugin sets and removes the labels returned by an external plugin
+	// for the node. Such rules have no Set.
+	Plugin *PluginMatch `json:"plugin,omitempty" yaml:"plugin"`
+	Set    Label        `json:"set,omitempty" yaml:"set"`
+}
+
+// Resource sources.
+const (
+	// ResourceSourceCapacity matches the node's total resources.
+	ResourceSourceCapacity = "capacity"
+	// ResourceSourceAllocatable matches the node's resources available to
+	// pods.
+	ResourceSourceAllocatable = "allocatable"
+)
+
+// ResourceMatch sorts nodes into buckets by the quantity of a resource.
+type ResourceMatch struct {
+	// Name is the name of the resource, e.g. cpu, memory, or nvidia.com/gpu.
+	Name string `json:"name" yaml:"name"`
+	// Source is capacity or allocatable. Defaults to capacity.
+	Source string `json:"source,omitempty" yaml:"source"`
+	// Buckets are checked in order, and the first one containing the
+	// quantity matches. Nodes without the resource have a zero quantity.
+	Buckets []ResourceBucket `json:"buckets" yaml:"buckets"`
+}
+
+// ResourceBucket is a range of resource quantities.
+type ResourceBucket struct {
+	// Min is the smallest quantity in the bucket. Unbounded if empty.
+	Min string `json:"min,omitempty" yaml:"min"`
+	// Max is the quantity just above the bucket. Unbounded if empty.
+	Max string `json:"max,omitempty" yaml:"max"`
+	// Value is the label value to set for the bucket. Defaults to the value
+	// in the rule's Set.
+	Value string `json:"value,omitempty" yaml:"value"`
+}
+
+// CIDRMatch sorts nodes into network ranges by their IP addresses.
+type CIDRMatch struct {
+	// AddressType is the type of the node addresses to match, InternalIP or
+	// ExternalIP. Defaults to InternalIP.
+	AddressType string `json:"addressType,omitempty" yaml:"addressType"`
+	// Ranges are the network ranges to match. The range with the longest
+	// prefix containing one of the node's addresses matches.
+	Ranges []CIDRRange `json:"ranges" yaml:"ranges"`
+}
+
+// CIDRRange is a network range.
+type CIDRRange struct {
+	// CIDR is the range in CIDR notation, e.g. 10.1.0.0/16 or fd00::/64.
+	CIDR string `json:"cidr" yaml:"cidr"`
+	// Value is the label value to set for the range. Defaults to the value
+	// in the rule's Set.
+	Value string `json:"value,omitempty" yaml:"value"`
+}
+
+// LookupMatch looks up the value of a node label or field in a lookup table.
+type LookupMatch struct {
+	// Table is the name of the lookup table, as given on the command line.
+	Table string `json:"table" yaml:"table"`
+	// Key is the key of the label or, if it starts with a dot, the path of
+	// the node field to look up, e.g. .metadata.name.
+	Key string `json:"key" yaml:"key"`
+	// Default are the labels to set on nodes whose value is not in the
+	// table.
+	Default map[string]string `json:"default,omitempty" yaml:"default"`
+}
+
+// Plugin failure policies.
+const (
+	// FailurePolicySkip keeps the labels the plugin set earlier and skips
+	// the rule until the node changes.
+	FailurePolicySkip = "skip"
+	// FailurePolicyRetry keeps the labels the plugin set earlier and
+	// retries processing the node with backoff.
+	FailurePolicyRetry = "retry"
+)
+
+// PluginMatch calls an external plugin for the labels of a node.
+type PluginMatch struct {
+	// Name is the name of the plugin, as given on the command line.
+	Name string `json:"name" yaml:"name"`
+	// FailurePolicy is what to do when the plugin fails or times out, skip
+	// or retry. Defaults to skip.
+	FailurePolicy string `json:"failurePolicy,omitempty" yaml:"failurePolicy"`
+}
+
+// Label types.
+const (
+	// LabelTypeLabel refers to a node label.
+	LabelTypeLabel = "label"
+	// LabelTypeTaint refers to a node taint.
+	LabelTypeTaint = "taint"
+	// LabelTypeAnnotation refers to a node annotation.
+	LabelTypeAnnotation = "annotation"
+)
+
+// Label is a label key and value pattern. Either can contain a wildcard
+// character *, with the same meaning as in the --relabel specs, or be a
+// regular expression if the rule has Regex set.
+type Label struct {
+	// Type is what the key and value refer to: label, taint, or
+	// annotation. Defaults to label.
+	Type  string `json:"type,omitempty" yaml:"type"`
+	Key   string `json:"key" yaml:"key"`
+	Value string `json:"value,omitempty" yaml:"value"`
+	// Effect is the effect of a taint. In Match, an empty effect matches
+	// taints with any effect.
+	Effect string `json:"effect,omitempty" yaml:"effect"`
+	// ValueExpression is a CEL expression over the node variable computing
+	// the value, instead of Value. Only allowed in Set.
+	ValueExpression string `json:"valueExpression,omitempty" yaml:"valueExpression"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NodeRelabelRule is a cluster-scoped relabeling rule. The rule's name is the
+// name of the object.
+type NodeRelabelRule struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RuleSpec              `json:"spec"`
+	Status NodeRelabelRuleStatus `json:"status,omitempty"`
+}
+
+// NodeRelabelRuleStatus reports the state of a NodeRelabelRule as seen by
+// the controller.
+type NodeRelabelRuleStatus struct {
+	// ObservedGeneration is the generation of the rule the status refers to.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Error is the parse error of the rule. The rule is not applied while it
+	// is set.
+	Error string `json:"error,omitempty"`
+	// MatchedNodes is the number of nodes the rule matched when they were
+	// last processed.
+	MatchedNodes int32 `json:"matchedNodes"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NodeRelabelRuleList is a list of NodeRelabelRule objects.
+type NodeRelabelRuleList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata,omitempty"`
+
+	Items []NodeRelabelRule `json:"items"`
+}
@@ -1,19 +1,53 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/vladlosev/node-relabeler/pkg/kube"
+	"github.com/vladlosev/node-relabeler/pkg/metrics"
 	"github.com/vladlosev/node-relabeler/pkg/specs"
 )
 
+// httpShutdownTimeout is how long the HTTP servers have to finish the
+// requests in progress when the relabeler exits.
+const httpShutdownTimeout = 5 * time.Second
+
 var relabelOptions []string = nil
+var relabelRegexOptions []string = nil
+var providerIDPatterns []string = nil
+var configPath string
+var lookupTables []string = nil
+var lookupTableConfigMaps []string = nil
+var pluginOptions []string = nil
+var pluginTimeout time.Duration
+var metricsAddress string
+var healthAddress string
+var livenessTimeout time.Duration
+var configReloadInterval time.Duration
+var configMap string
+var configMapKey string
+var watchRules bool
+var updateStrategy string
+var forceConflicts bool
+var dryRun string
+var workers int
+var maxRetries int
+var leaderElect bool
+var leaderElection kube.LeaderElectionOptions
 var logLevel string
 
 // NewWorkerCommand returns a new command that will keep relabeling nodes
@@ -29,7 +63,169 @@ func NewWorkerCommand() *cobra.Command {
 		&relabelOptions,
 		"relabel",
 		[]string{},
-		"Re-labeling specs in the form old/label=value:new/label=newvalue",
+		"Re-labeling specs in the form old/label=value:new/label=newvalue. "+
+			"Prefix with - to remove the old label, or use -old/label=value to delete it",
+	)
+	cmd.PersistentFlags().StringArrayVar(
+		&relabelRegexOptions,
+		"relabel-regex",
+		[]string{},
+		"Re-labeling specs like in --relabel, but with the old label key and value "+
+			"given by regular expressions. The new label can refer to their capture "+
+			"groups as $1 or ${name}",
+	)
+	cmd.PersistentFlags().StringArrayVar(
+		&providerIDPatterns,
+		"provider-id-pattern",
+		[]string{},
+		"Regular expression parsing provider IDs not recognized by the built-in "+
+			"parsers. Its named capture groups become .spec.providerID.<name> node fields",
+	)
+	cmd.PersistentFlags().StringVar(
+		&configPath,
+		"config",
+		"",
+		"Path to a YAML or JSON file with re-labeling rules",
+	)
+	cmd.PersistentFlags().DurationVar(
+		&configReloadInterval,
+		"config-reload-interval",
+		30*time.Second,
+		"How often to check the --config file for changes. 0 disables reloading",
+	)
+	cmd.PersistentFlags().StringArrayVar(
+		&lookupTables,
+		"lookup-table",
+		[]string{},
+		"Lookup table for lookup rules in the form name=path. The file is a .csv, .yaml, "+
+			".yml, or .json file and is reloaded every --config-reload-interval",
+	)
+	cmd.PersistentFlags().StringArrayVar(
+		&lookupTableConfigMaps,
+		"lookup-table-config-map",
+		[]string{},
+		"Lookup table for lookup rules in the form name=namespace/name/key, read from "+
+			"the key of a ConfigMap and watched for changes",
+	)
+	cmd.PersistentFlags().StringArrayVar(
+		&pluginOptions,
+		"plugin",
+		[]string{},
+		"Plugin for plugin rules in the form name=command or name=URL. The command "+
+			"receives the node as JSON on its standard input, the URL in a POST request",
+	)
+	cmd.PersistentFlags().DurationVar(
+		&pluginTimeout,
+		"plugin-timeout",
+		specs.DefaultPluginTimeout,
+		"How long to wait for a --plugin to respond",
+	)
+	cmd.PersistentFlags().StringVar(
+		&configMap,
+		"config-map",
+		"",
+		"ConfigMap with re-labeling rules to watch, in the form namespace/name",
+	)
+	cmd.PersistentFlags().StringVar(
+		&configMapKey,
+		"config-map-key",
+		"config.yaml",
+		"Key in the --config-map ConfigMap containing the rules",
+	)
+	cmd.PersistentFlags().BoolVar(
+		&watchRules,
+		"watch-rules",
+		false,
+		"Watch NodeRelabelRule custom resources for re-labeling rules",
+	)
+	cmd.PersistentFlags().StringVar(
+		&updateStrategy,
+		"update-strategy",
+		string(kube.UpdateStrategyApply),
+		"How to write node labels. One of: apply (server-side apply), patch (JSON merge patch)",
+	)
+	cmd.PersistentFlags().BoolVar(
+		&forceConflicts,
+		"force-conflicts",
+		false,
+		"Take ownership of labels owned by other field managers with server-side apply",
+	)
+	cmd.PersistentFlags().StringVar(
+		&dryRun,
+		"dry-run",
+		string(kube.DryRunNone),
+		"Log the changes to nodes instead of writing them. One of: none, client (only log), "+
+			"server (also validate the changes with a dry run request to the API server). "+
+			"--dry-run alone means client",
+	)
+	cmd.PersistentFlags().Lookup("dry-run").NoOptDefVal = string(kube.DryRunClient)
+	cmd.PersistentFlags().IntVar(
+		&workers,
+		"workers",
+		1,
+		"Number of nodes to process concurrently",
+	)
+	cmd.PersistentFlags().IntVar(
+		&maxRetries,
+		"max-retries",
+		kube.DefaultMaxRetries,
+		"Number of times to retry processing a node with exponential backoff before giving up",
+	)
+	cmd.PersistentFlags().BoolVar(
+		&leaderElect,
+		"leader-elect",
+		false,
+		"Elect a leader among the replicas, so that only one of them updates nodes",
+	)
+	cmd.PersistentFlags().StringVar(
+		&leaderElection.LeaseName,
+		"leader-elect-lease-name",
+		"node-relabeler",
+		"Name of the Lease object used for leader election",
+	)
+	cmd.PersistentFlags().StringVar(
+		&leaderElection.LeaseNamespace,
+		"leader-elect-namespace",
+		"",
+		"Namespace of the Lease object used for leader election. Defaults to the pod's namespace",
+	)
+	cmd.PersistentFlags().DurationVar(
+		&leaderElection.LeaseDuration,
+		"leader-elect-lease-duration",
+		15*time.Second,
+		"How long standbys wait before taking over a lease that has not been renewed",
+	)
+	cmd.PersistentFlags().DurationVar(
+		&leaderElection.RenewDeadline,
+		"leader-elect-renew-deadline",
+		10*time.Second,
+		"How long the leader retries renewing the lease before giving up leadership",
+	)
+	cmd.PersistentFlags().DurationVar(
+		&leaderElection.RetryPeriod,
+		"leader-elect-retry-period",
+		2*time.Second,
+		"How often to try acquiring or renewing the lease",
+	)
+	cmd.PersistentFlags().StringVar(
+		&metricsAddress,
+		"metrics-address",
+		"",
+		"Address to serve Prometheus metrics on at /metrics, e.g. :8080. Disabled if empty",
+	)
+	cmd.PersistentFlags().StringVar(
+		&healthAddress,
+		"health-address",
+		"",
+		"Address to serve the /healthz and /readyz probes on, e.g. :8081. May be the same "+
+			"as --metrics-address. Disabled if empty",
+	)
+	cmd.PersistentFlags().DurationVar(
+		&livenessTimeout,
+		"liveness-timeout",
+		kube.DefaultLivenessTimeout,
+		"How long nodes may wait to be processed without any of them succeeding before "+
+			"/healthz fails",
 	)
 	cmd.PersistentFlags().StringVar(
 		&logLevel,
@@ -37,26 +233,18 @@ func NewWorkerCommand() *cobra.Command {
 		"info",
 		"Log level. One of: error, warn, info, debug",
 	)
+	cmd.AddCommand(NewSimulateCommand())
 	return cmd
 }
 
 func startRelabeler(cmd *cobra.Command, args []string) error {
-	var logrusLevel logrus.Level
-	switch logLevel {
-	case "error":
-		logrusLevel = logrus.ErrorLevel
-	case "warn":
-		logrusLevel = logrus.WarnLevel
-	case "info":
-		logrusLevel = logrus.InfoLevel
-	case "debug":
-		logrusLevel = logrus.DebugLevel
-	default:
-		return fmt.Errorf("Invalid log level: %s", logLevel)
+	if err := setUp(); err != nil {
+		return err
 	}
-	logrus.SetLevel(logrusLevel)
-
-	parsedSpecs, err := specs.Parse(relabelOptions)
+	if configPath != "" && configMap != "" {
+		return fmt.Errorf("Only one of --config and --config-map may be specified")
+	}
+	parsedSpecs, err := loadSpecs()
 	if err != nil {
 		return err
 	}
@@ -65,7 +253,7 @@ func startRelabeler(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	stop := make(chan struct{})
 
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
@@ -75,9 +263,227 @@ func startRelabeler(cmd *cobra.Command, args []string) error {
 		close(stop)
 	}()
 
-	controller, err := kube.NewController(client, parsedSpecs)
+	controller, err := kube.NewController(client, parsedSpecs, kube.Options{
+		UpdateStrategy:  kube.UpdateStrategy(updateStrategy),
+		ForceConflicts:  forceConflicts,
+		DryRun:          kube.DryRunMode(dryRun),
+		Workers:         workers,
+		MaxRetries:      maxRetries,
+		LivenessTimeout: livenessTimeout,
+	})
 	if err != nil {
 		return err
 	}
+	// Lookup tables have to be registered before parsing the rules using
+	// them.
+	if err := startLookupTableWatchers(client, controller, stop); err != nil {
+		return err
+	}
+	shutdownHTTP, err := serveHTTP(controller)
+	if err != nil {
+		return err
+	}
+	// The probes and metrics are served until the controller has stopped.
+	defer shutdownHTTP()
+	if configPath != "" {
+		watcher, err := kube.NewConfigFileWatcher(controller, configPath, configReloadInterval)
+		if err != nil {
+			return err
+		}
+		if configReloadInterval > 0 {
+			go watcher.Run(stop)
+		}
+	}
+	if configMap != "" {
+		namespaceName := strings.Split(configMap, "/")
+		if len(namespaceName) != 2 {
+			return fmt.Errorf("Invalid --config-map %s. Must be in the form namespace/name", configMap)
+		}
+		watcher, err := kube.NewConfigMapWatcher(
+			client,
+			controller,
+			namespaceName[0],
+			namespaceName[1],
+			configMapKey,
+		)
+		if err != nil {
+			return err
+		}
+		go watcher.Run(stop)
+	}
+	if watchRules {
+		dynamicClient, err := kube.GetDynamicClient()
+		if err != nil {
+			return err
+		}
+		watcher := kube.NewRuleWatcher(dynamicClient, controller)
+		go func() {
+			if err := watcher.Run(stop); err != nil {
+				logrus.WithError(err).Error("Failed to watch NodeRelabelRule objects")
+			}
+		}()
+	}
+	if leaderElect {
+		return controller.RunWithLeaderElection(stop, leaderElection)
+	}
 	return controller.Run(stop, stop)
 }
+
+// setUp applies the flags configuring the logging, and the provider ID
+// patterns and the plugins the rules use.
+func setUp() error {
+	var logrusLevel logrus.Level
+	switch logLevel {
+	case "error":
+		logrusLevel = logrus.ErrorLevel
+	case "warn":
+		logrusLevel = logrus.WarnLevel
+	case "info":
+		logrusLevel = logrus.InfoLevel
+	case "debug":
+		logrusLevel = logrus.DebugLevel
+	default:
+		return fmt.Errorf("Invalid log level: %s", logLevel)
+	}
+	logrus.SetLevel(logrusLevel)
+
+	for _, pattern := range providerIDPatterns {
+		if err := specs.AddProviderIDPattern(pattern); err != nil {
+			return err
+		}
+	}
+	for _, option := range pluginOptions {
+		name, endpoint, ok := strings.Cut(option, "=")
+		if !ok || name == "" || endpoint == "" {
+			return fmt.Errorf("Invalid --plugin %s. Must be in the form name=command or name=URL", option)
+		}
+		if _, err := specs.RegisterPlugin(name, endpoint, pluginTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSpecs parses the specs from the --relabel and --relabel-regex flags.
+// The flags may be omitted when the rules come from a config file, a
+// ConfigMap, or NodeRelabelRule objects.
+func loadSpecs() (specs.Specs, error) {
+	regexSpecs, err := specs.ParseRegex(relabelRegexOptions)
+	if err != nil {
+		return nil, err
+	}
+	if len(relabelOptions) == 0 &&
+		(len(regexSpecs) > 0 || configPath != "" || configMap != "" || watchRules) {
+		return regexSpecs, nil
+	}
+	parsedSpecs, err := specs.Parse(relabelOptions)
+	if err != nil {
+		return nil, err
+	}
+	return append(parsedSpecs, regexSpecs...), nil
+}
+
+// startLookupTableWatchers loads the lookup tables given by the
+// --lookup-table and --lookup-table-config-map flags and keeps them up to
+// date until the stop channel is signalled.
+func startLookupTableWatchers(
+	client kubernetes.Interface,
+	controller *kube.Controller,
+	stop <-chan struct{},
+) error {
+	for _, option := range lookupTables {
+		name, path, ok := strings.Cut(option, "=")
+		if !ok || name == "" || path == "" {
+			return fmt.Errorf("Invalid --lookup-table %s. Must be in the form name=path", option)
+		}
+		watcher, err := kube.NewLookupTableFileWatcher(
+			controller,
+			specs.RegisterLookupTable(name),
+			path,
+			configReloadInterval,
+		)
+		if err != nil {
+			return err
+		}
+		if configReloadInterval > 0 {
+			go watcher.Run(stop)
+		}
+	}
+	for _, option := range lookupTableConfigMaps {
+		name, source, ok := strings.Cut(option, "=")
+		parts := strings.Split(source, "/")
+		if !ok || name == "" || len(parts) != 3 {
+			return fmt.Errorf(
+				"Invalid --lookup-table-config-map %s. Must be in the form name=namespace/name/key",
+				option)
+		}
+		watcher, err := kube.NewLookupTableConfigMapWatcher(
+			client,
+			controller,
+			specs.RegisterLookupTable(name),
+			parts[0],
+			parts[1],
+			parts[2],
+		)
+		if err != nil {
+			return err
+		}
+		go watcher.Run(stop)
+	}
+	return nil
+}
+
+// serveHTTP serves the metrics and the health probes on the addresses given
+// in the flags. The endpoints sharing an address are served by the same
+// server. Returns a function shutting the servers down and waiting for them
+// to finish the requests in progress, or an error if an address cannot be
+// listened on.
+func serveHTTP(controller *kube.Controller) (func(), error) {
+	muxes := map[string]*http.ServeMux{}
+	muxFor := func(address string) *http.ServeMux {
+		if _, ok := muxes[address]; !ok {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+	if metricsAddress != "" {
+		muxFor(metricsAddress).Handle("/metrics", metrics.Handler())
+	}
+	if healthAddress != "" {
+		mux := muxFor(healthAddress)
+		mux.Handle("/healthz", kube.HealthHandler(controller.Healthy))
+		mux.Handle("/readyz", kube.HealthHandler(controller.Ready))
+	}
+	var servers []*http.Server
+	var wg sync.WaitGroup
+	shutdown := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				logrus.WithError(err).Error("Failed to shut down HTTP server")
+			}
+		}
+		wg.Wait()
+	}
+	for address, mux := range muxes {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			shutdown()
+			return nil, fmt.Errorf("Failed to listen on %s: %w", address, err)
+		}
+		server := &http.Server{Handler: mux}
+		servers = append(servers, server)
+		logger := logrus.WithField("address", address)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Info("Serving HTTP endpoints")
+			err := server.Serve(listener)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.WithError(err).Fatal("Failed to serve HTTP endpoints")
+			}
+		}()
+	}
+	return shutdown, nil
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	core_v1 "k8s.io/api/core/v1"
+
+	"github.com/vladlosev/node-relabeler/pkg/kube"
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+var simulateNodesPath string
+var simulateOutput string
+var failOnChange bool
+
+// NewSimulateCommand returns a new command that prints the changes the
+// rules would make to nodes read from a file, without a cluster.
+func NewSimulateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Show the changes the rules would make to nodes dumped with kubectl",
+		Long: "Reads the output of kubectl get nodes -o yaml or -o json (a List or a " +
+			"NodeList, or a stream of Nodes) and prints the changes the rules given with " +
+			"the same flags as for the worker would make to each node.",
+		Args: cobra.NoArgs,
+		RunE: simulate,
+	}
+	cmd.Flags().StringVarP(
+		&simulateNodesPath,
+		"nodes",
+		"f",
+		"-",
+		"File with the nodes, or - for the standard input",
+	)
+	cmd.Flags().StringVarP(
+		&simulateOutput,
+		"output",
+		"o",
+		"text",
+		"Output format. One of: text, json, yaml",
+	)
+	cmd.Flags().BoolVar(
+		&failOnChange,
+		"fail-on-change",
+		false,
+		"Exit with a non-zero status if the rules would change any of the nodes",
+	)
+	return cmd
+}
+
+func simulate(cmd *cobra.Command, args []string) error {
+	if err := setUp(); err != nil {
+		return err
+	}
+	switch simulateOutput {
+	case "text", "json", "yaml":
+	default:
+		return fmt.Errorf("Invalid output format: %s", simulateOutput)
+	}
+	if configMap != "" || watchRules || len(lookupTableConfigMaps) > 0 {
+		return fmt.Errorf(
+			"--config-map, --watch-rules, and --lookup-table-config-map need a cluster, " +
+				"use --config and --lookup-table to simulate")
+	}
+	simulatedSpecs, err := loadSimulatedSpecs()
+	if err != nil {
+		return err
+	}
+	nodes, err := readSimulatedNodes(cmd.InOrStdin())
+	if err != nil {
+		return err
+	}
+	// The errors past this point are not caused by the command line.
+	cmd.SilenceUsage = true
+
+	diffs := make([]kube.NodeDiff, 0, len(nodes))
+	changed := 0
+	for _, node := range nodes {
+		diff := kube.DiffNode(simulatedSpecs, node)
+		if len(diff.Changes) > 0 {
+			changed++
+		}
+		diffs = append(diffs, diff)
+	}
+	if err := writeDiffs(cmd.OutOrStdout(), diffs, changed); err != nil {
+		return err
+	}
+	if failOnChange && changed > 0 {
+		return fmt.Errorf("Rules would change %d of %d nodes", changed, len(nodes))
+	}
+	return nil
+}
+
+// loadSimulatedSpecs loads the lookup tables and the specs given in the
+// flags, combined in the same order as by the worker.
+func loadSimulatedSpecs() (specs.Specs, error) {
+	for _, option := range lookupTables {
+		name, path, ok := strings.Cut(option, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("Invalid --lookup-table %s. Must be in the form name=path", option)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read lookup table file %s: %w", path, err)
+		}
+		if err := specs.RegisterLookupTable(name).Load(path, data); err != nil {
+			return nil, err
+		}
+	}
+	parsedSpecs, err := loadSpecs()
+	if err != nil {
+		return nil, err
+	}
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read config file %s: %w", configPath, err)
+		}
+		configSpecs, err := specs.ParseConfig(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config file %s: %w", configPath, err)
+		}
+		parsedSpecs = append(parsedSpecs, configSpecs...)
+	}
+	return parsedSpecs, nil
+}
+
+// readSimulatedNodes reads the nodes from the --nodes file or the standard
+// input.
+func readSimulatedNodes(stdin io.Reader) ([]*core_v1.Node, error) {
+	if simulateNodesPath == "-" {
+		return kube.ReadNodes(stdin)
+	}
+	file, err := os.Open(simulateNodesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read nodes: %w", err)
+	}
+	defer file.Close()
+	return kube.ReadNodes(file)
+}
+
+// writeDiffs writes the diffs in the --output format.
+func writeDiffs(w io.Writer, diffs []kube.NodeDiff, changed int) error {
+	switch simulateOutput {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(diffs)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(diffs); err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+	var text strings.Builder
+	for _, diff := range diffs {
+		if len(diff.Changes) == 0 && len(diff.Errors) == 0 {
+			continue
+		}
+		fmt.Fprintf(&text, "%s:\n", diff.Name)
+		for _, change := range diff.Changes {
+			fmt.Fprintf(&text, "  %s\n", formatChange(change))
+		}
+		rules := make([]string, 0, len(diff.Errors))
+		for rule := range diff.Errors {
+			rules = append(rules, rule)
+		}
+		sort.Strings(rules)
+		for _, rule := range rules {
+			fmt.Fprintf(&text, "  ! rule %s failed: %s\n", rule, diff.Errors[rule])
+		}
+	}
+	fmt.Fprintf(&text, "%d of %d nodes would change\n", changed, len(diffs))
+	_, err := io.WriteString(w, text.String())
+	return err
+}
+
+// formatChange formats a change as a line of the text output.
+func formatChange(change kube.NodeChange) string {
+	var line string
+	switch change.Operation {
+	case kube.OperationAdd:
+		line = fmt.Sprintf("+ %s %s=%s", change.Type, change.Key, change.NewValue)
+	case kube.OperationChange:
+		line = fmt.Sprintf(
+			"~ %s %s=%s -> %s", change.Type, change.Key, change.OldValue, change.NewValue)
+	default:
+		line = fmt.Sprintf("- %s %s=%s", change.Type, change.Key, change.OldValue)
+	}
+	if change.Rule != "" {
+		line += fmt.Sprintf(" (rule %s)", change.Rule)
+	}
+	return line
+}
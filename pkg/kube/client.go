@@ -5,6 +5,7 @@ import (
 	"path"
 
 	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -19,6 +20,16 @@ func GetKubernetesClient() (*kubernetes.Clientset, error) {
 	return kubernetes.NewForConfig(config)
 }
 
+// GetDynamicClient returns Kubernetes dynamic client to use for the worker's
+// custom resources.
+func GetDynamicClient() (dynamic.Interface, error) {
+	config, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
 func getConfig() (*rest.Config, error) {
 	configPath := os.Getenv("KUBECONFIG")
 	if configPath == "" {
@@ -0,0 +1,117 @@
+package kube
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+// ConfigSpecsSource is the name of the specs source for the rules loaded
+// from a config file or a ConfigMap.
+const ConfigSpecsSource = "config"
+
+// ConfigFileWatcher reloads relabel rules into a controller whenever the
+// contents of a config file change.
+type ConfigFileWatcher struct {
+	controller *Controller
+	logger     *logrus.Entry
+	source     *fileSource
+}
+
+// NewConfigFileWatcher loads the rules from the config file into the
+// controller and returns a watcher that keeps them up to date. Returns an
+// error if the initial load fails.
+func NewConfigFileWatcher(
+	controller *Controller,
+	path string,
+	interval time.Duration,
+) (*ConfigFileWatcher, error) {
+	watcher := &ConfigFileWatcher{
+		controller: controller,
+		logger:     logrus.WithField("path", path),
+	}
+	source, data, err := newFileSource(path, interval, watcher.logger, watcher.reload)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config file %s: %w", path, err)
+	}
+	parsedSpecs, err := specs.ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %w", path, err)
+	}
+	controller.setSpecs(ConfigSpecsSource, parsedSpecs)
+	watcher.source = source
+	return watcher, nil
+}
+
+// Run polls the config file until the stop channel is signalled.
+func (w *ConfigFileWatcher) Run(stopCh <-chan struct{}) {
+	w.source.Run(stopCh)
+}
+
+func (w *ConfigFileWatcher) reload(data []byte) {
+	parsedSpecs, err := specs.ParseConfig(data)
+	if err != nil {
+		w.logger.WithError(err).Error("Invalid config file, keeping previous rules")
+		return
+	}
+	w.logger.Info("Config file changed, reloading rules")
+	w.controller.SetSpecs(ConfigSpecsSource, parsedSpecs)
+}
+
+// ConfigMapWatcher reloads relabel rules into a controller whenever a key in
+// a ConfigMap changes.
+type ConfigMapWatcher struct {
+	controller *Controller
+	logger     *logrus.Entry
+	source     *configMapSource
+}
+
+// NewConfigMapWatcher loads the rules from the ConfigMap key into the
+// controller and returns a watcher that keeps them up to date. Returns an
+// error if the initial load fails.
+func NewConfigMapWatcher(
+	client kubernetes.Interface,
+	controller *Controller,
+	namespace string,
+	name string,
+	key string,
+) (*ConfigMapWatcher, error) {
+	watcher := &ConfigMapWatcher{
+		controller: controller,
+		logger: logrus.WithFields(logrus.Fields{
+			"namespace": namespace,
+			"name":      name,
+		}),
+	}
+	source, data, err := newConfigMapSource(
+		client, namespace, name, key, watcher.logger, watcher.reload)
+	if err != nil {
+		return nil, err
+	}
+	parsedSpecs, err := specs.ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config in ConfigMap %s/%s: %w", namespace, name, err)
+	}
+	controller.setSpecs(ConfigSpecsSource, parsedSpecs)
+	watcher.source = source
+	return watcher, nil
+}
+
+// Run watches the ConfigMap until the stop channel is signalled.
+func (w *ConfigMapWatcher) Run(stopCh <-chan struct{}) {
+	w.source.Run(stopCh)
+}
+
+func (w *ConfigMapWatcher) reload(data []byte) {
+	parsedSpecs, err := specs.ParseConfig(data)
+	if err != nil {
+		w.logger.WithError(err).Error("Invalid config in ConfigMap, keeping previous rules")
+		return
+	}
+	w.logger.Info("ConfigMap changed, reloading rules")
+	w.controller.SetSpecs(ConfigSpecsSource, parsedSpecs)
+}
@@ -0,0 +1,190 @@
+package kube
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// makeRuleConfig returns a config with a single rule with the name and the
+// fields given as YAML, one per line.
+func makeRuleConfig(name string, fields ...string) string {
+	return `
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: ` + name + `
+  ` + strings.Join(fields, "\n  ") + `
+`
+}
+
+func TestConfigFileWatcherReloads(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(fileName, []byte(makeRuleConfig(
+		"test",
+		`match: {key: abc, value: "*"}`,
+		`set: {key: def, value: "*"}`,
+	)), 0666)
+	require.NoError(t, err)
+
+	controller, err := NewController(fake.NewSimpleClientset(), nil, Options{})
+	require.NoError(t, err)
+	watcher, err := NewConfigFileWatcher(controller, fileName, time.Second)
+	require.NoError(t, err)
+	labels := map[string]string{"abc": "123"}
+	assert.Equal(t, map[string]string{"def": "123"}, controller.currentSpecs().ApplyTo(labels))
+
+	err = os.WriteFile(fileName, []byte("rules: ["), 0666)
+	require.NoError(t, err)
+	watcher.source.check()
+	assert.Equal(
+		t,
+		map[string]string{"def": "123"},
+		controller.currentSpecs().ApplyTo(labels),
+		"Invalid config must not replace previous rules",
+	)
+
+	err = os.WriteFile(fileName, []byte(makeRuleConfig(
+		"test",
+		"regex: true",
+		`match: {key: "abc[", value: "(.*)"}`,
+		"set: {key: ghi, value: $1}",
+	)), 0666)
+	require.NoError(t, err)
+	watcher.source.check()
+	assert.Equal(
+		t,
+		map[string]string{"def": "123"},
+		controller.currentSpecs().ApplyTo(labels),
+		"Malformed regular expression must not replace previous rules",
+	)
+
+	err = os.WriteFile(fileName, []byte(makeRuleConfig(
+		"test",
+		`match: {key: abc, value: "*"}`,
+		`set: {key: ghi, value: "*"}`,
+	)), 0666)
+	require.NoError(t, err)
+	watcher.source.check()
+	assert.Equal(t, map[string]string{"ghi": "123"}, controller.currentSpecs().ApplyTo(labels))
+}
+
+func TestConfigFileWatcherInitialLoadFailure(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(fileName, []byte("kind: Unknown"), 0666)
+	require.NoError(t, err)
+
+	controller, err := NewController(fake.NewSimpleClientset(), nil, Options{})
+	require.NoError(t, err)
+	_, err = NewConfigFileWatcher(controller, fileName, time.Second)
+	require.Error(t, err)
+	assert.Regexp(t, "Invalid config file", err.Error())
+}
+
+func TestConfigMapWatcherReloads(t *testing.T) {
+	configMap := &core_v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: "system", Name: "rules"},
+		Data: map[string]string{"config.yaml": makeRuleConfig(
+			"test",
+			`match: {key: abc, value: "*"}`,
+			`set: {key: def, value: "*"}`,
+		)},
+	}
+	fakeClient := fake.NewSimpleClientset(configMap)
+	controller, err := NewController(fakeClient, nil, Options{})
+	require.NoError(t, err)
+	watcher, err := NewConfigMapWatcher(fakeClient, controller, "system", "rules", "config.yaml")
+	require.NoError(t, err)
+	labels := map[string]string{"abc": "123"}
+	assert.Equal(t, map[string]string{"def": "123"}, controller.currentSpecs().ApplyTo(labels))
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go watcher.Run(stopChan)
+
+	configMap = configMap.DeepCopy()
+	configMap.Data["config.yaml"] = makeRuleConfig(
+		"test",
+		`match: {key: abc, value: "*"}`,
+		`set: {key: ghi, value: "*"}`,
+	)
+	_, err = fakeClient.CoreV1().ConfigMaps("system").Update(
+		context.TODO(),
+		configMap,
+		meta_v1.UpdateOptions{},
+	)
+	require.NoError(t, err)
+	assert.Eventually(
+		t,
+		func() bool {
+			replacements := controller.currentSpecs().ApplyTo(labels)
+			return replacements["ghi"] == "123"
+		},
+		time.Second,
+		10*time.Millisecond,
+	)
+}
+
+func TestConfigMapWatcherKeepsRulesOnInvalidConfig(t *testing.T) {
+	configMap := &core_v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: "system", Name: "rules"},
+		Data: map[string]string{"config.yaml": makeRuleConfig(
+			"test",
+			`match: {key: abc, value: "*"}`,
+			`set: {key: def, value: "*"}`,
+		)},
+	}
+	fakeClient := fake.NewSimpleClientset(configMap)
+	controller, err := NewController(fakeClient, nil, Options{})
+	require.NoError(t, err)
+	watcher, err := NewConfigMapWatcher(fakeClient, controller, "system", "rules", "config.yaml")
+	require.NoError(t, err)
+	labels := map[string]string{"abc": "123"}
+
+	configMap = configMap.DeepCopy()
+	configMap.Data["config.yaml"] = makeRuleConfig(
+		"test",
+		"regex: true",
+		`match: {key: "abc[", value: "(.*)"}`,
+		"set: {key: ghi, value: $1}",
+	)
+	watcher.source.addConfigMap(configMap)
+	assert.Equal(
+		t,
+		map[string]string{"def": "123"},
+		controller.currentSpecs().ApplyTo(labels),
+		"Malformed regular expression must not replace previous rules",
+	)
+
+	configMap = configMap.DeepCopy()
+	configMap.Data["config.yaml"] = makeRuleConfig(
+		"test",
+		`match: {key: abc, value: "*"}`,
+		`set: {key: ghi, value: "*"}`,
+	)
+	watcher.source.addConfigMap(configMap)
+	assert.Equal(t, map[string]string{"ghi": "123"}, controller.currentSpecs().ApplyTo(labels))
+}
+
+func TestConfigMapWatcherMissingKey(t *testing.T) {
+	configMap := &core_v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: "system", Name: "rules"},
+	}
+	fakeClient := fake.NewSimpleClientset(configMap)
+	controller, err := NewController(fakeClient, nil, Options{})
+	require.NoError(t, err)
+	_, err = NewConfigMapWatcher(fakeClient, controller, "system", "rules", "config.yaml")
+	require.Error(t, err)
+	assert.Regexp(t, "has no key config.yaml", err.Error())
+}
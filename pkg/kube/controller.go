@@ -1,42 +1,211 @@
 package kube
 
 import (
-	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	core_v1 "k8s.io/api/core/v1"
-	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	informers_core_v1 "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
 	"github.com/vladlosev/node-relabeler/pkg/specs"
 )
 
+// FieldManager is the field manager name the controller uses when writing
+// nodes, so that the labels it owns are visible in managedFields.
+const FieldManager = "node-relabeler"
+
+// UpdateStrategy selects how the controller writes label changes to nodes.
+type UpdateStrategy string
+
+const (
+	// UpdateStrategyApply writes labels with server-side apply. Conflicts
+	// with labels owned by other field managers are reported as errors
+	// unless Options.ForceConflicts is set.
+	UpdateStrategyApply UpdateStrategy = "apply"
+	// UpdateStrategyPatch writes labels with a JSON merge patch, guarded by
+	// the node's resource version.
+	UpdateStrategyPatch UpdateStrategy = "patch"
+)
+
+// DryRunMode selects whether the controller writes its changes to nodes.
+type DryRunMode string
+
+const (
+	// DryRunNone writes the changes to nodes.
+	DryRunNone DryRunMode = "none"
+	// DryRunClient only logs the changes and counts them in the metrics.
+	DryRunClient DryRunMode = "client"
+	// DryRunServer logs and counts the changes like DryRunClient, and also
+	// sends them to the API server with the dry run option, so that they
+	// are validated but not persisted.
+	DryRunServer DryRunMode = "server"
+)
+
+// Options configures the Controller.
+type Options struct {
+	// UpdateStrategy selects how labels are written. Defaults to
+	// UpdateStrategyApply.
+	UpdateStrategy UpdateStrategy
+	// ForceConflicts makes server-side apply take ownership of labels
+	// owned by other field managers instead of failing.
+	ForceConflicts bool
+	// Workers is the number of nodes processed concurrently. Defaults to 1.
+	Workers int
+	// MaxRetries is the number of times processing a node is retried, with
+	// exponential backoff, before giving up until the node changes again.
+	// Defaults to DefaultMaxRetries.
+	MaxRetries int
+	// LivenessTimeout is how long the controller may have nodes to process
+	// without processing any of them successfully before it is reported as
+	// unhealthy. Defaults to DefaultLivenessTimeout.
+	LivenessTimeout time.Duration
+	// DryRun selects whether the changes are written to nodes. Defaults to
+	// DryRunNone.
+	DryRun DryRunMode
+	// EventRecorder records the events on the nodes and the rules. Defaults
+	// to a recorder writing the events to the API server.
+	EventRecorder record.EventRecorder
+}
+
+// DefaultMaxRetries is the default value of Options.MaxRetries.
+const DefaultMaxRetries = 10
+
+// DefaultLivenessTimeout is the default value of Options.LivenessTimeout.
+const DefaultLivenessTimeout = 5 * time.Minute
+
+// CommandLineSpecsSource is the name of the specs source for the specs
+// passed to NewController.
+const CommandLineSpecsSource = "command-line"
+
 // Controller is the class with the relabeling logic.
 type Controller struct {
 	client          kubernetes.Interface
 	informerFactory informers.SharedInformerFactory
 	nodeInformer    informers_core_v1.NodeInformer
-	specs           specs.Specs
+	options         Options
+	recorder        record.EventRecorder
+	// broadcaster sends the events of the default recorder to the API
+	// server. Not set if Options.EventRecorder is.
+	broadcaster record.EventBroadcaster
+	// queue keeps the names of nodes waiting to be processed.
+	queue workqueue.TypedRateLimitingInterface[string]
+	// leading is set while the workers are running.
+	leading atomic.Bool
+	// synced is set once the node informer cache is synced.
+	synced atomic.Bool
+	// processing is the number of nodes being processed by the workers.
+	processing atomic.Int32
+	// lastProgress is the time, in Unix nanoseconds, the controller last
+	// processed a node successfully, started the workers, or got a node to
+	// process after having none.
+	lastProgress atomic.Int64
+	// leadingCallbacks are called when the workers start.
+	leadingCallbacks []func()
+	// sourcesLoaded are closed once the spec sources loading their specs
+	// asynchronously have loaded them. The workers wait for all of them.
+	sourcesLoaded []<-chan struct{}
+
+	// specsLock guards the fields below it.
+	specsLock sync.RWMutex
+	// specSources keeps specs from each source by name, so that a single
+	// source can be replaced without affecting the others.
+	specSources map[string]specs.Specs
+	// sourceOrder keeps the names of the spec sources in the order they were
+	// added.
+	sourceOrder []string
+	// specs is the combination of specs from all sources.
+	specs specs.Specs
+
+	// unmatchedLock guards unmatched.
+	unmatchedLock sync.Mutex
+	// unmatched maps node names to the names of the lookup rules whose
+	// tables have no row for the node.
+	unmatched map[string][]string
+
+	// matchedLock guards matched.
+	matchedLock sync.Mutex
+	// matched maps node names to the names of the rules that matched the
+	// node when it was last processed.
+	matched map[string][]string
+
+	// complianceLock guards outOfCompliance.
+	complianceLock sync.Mutex
+	// outOfCompliance keeps the names of the nodes whose changes have
+	// failed to be written.
+	outOfCompliance map[string]bool
+
+	// dryRunLock guards dryRunChanges.
+	dryRunLock sync.Mutex
+	// dryRunChanges maps node names to the label changes pending on them in
+	// dry run mode.
+	dryRunChanges map[string][]dryRunChange
 }
 
 // NewController constructs new instance of Controller.
-func NewController(client kubernetes.Interface, specs specs.Specs) (*Controller, error) {
+func NewController(
+	client kubernetes.Interface,
+	specs specs.Specs,
+	options Options,
+) (*Controller, error) {
+	switch options.UpdateStrategy {
+	case "":
+		options.UpdateStrategy = UpdateStrategyApply
+	case UpdateStrategyApply, UpdateStrategyPatch:
+	default:
+		return nil, fmt.Errorf("Invalid update strategy: %s", options.UpdateStrategy)
+	}
+	switch options.DryRun {
+	case "":
+		options.DryRun = DryRunNone
+	case DryRunNone, DryRunClient, DryRunServer:
+	default:
+		return nil, fmt.Errorf("Invalid dry run mode: %s", options.DryRun)
+	}
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	if options.MaxRetries <= 0 {
+		options.MaxRetries = DefaultMaxRetries
+	}
+	if options.LivenessTimeout <= 0 {
+		options.LivenessTimeout = DefaultLivenessTimeout
+	}
 	informerFactory := informers.NewSharedInformerFactory(client, time.Hour*24)
 	controller := &Controller{
 		client:          client,
 		informerFactory: informerFactory,
 		nodeInformer:    informerFactory.Core().V1().Nodes(),
-		specs:           specs,
+		options:         options,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "nodes"},
+		),
+	}
+	controller.recorder = options.EventRecorder
+	if controller.recorder == nil {
+		controller.broadcaster = newEventBroadcaster(client)
+		controller.recorder = controller.broadcaster.NewRecorder(
+			newEventScheme(),
+			core_v1.EventSource{Component: FieldManager},
+		)
 	}
+	controller.setSpecs(CommandLineSpecsSource, specs)
 	controller.nodeInformer.Informer().AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc:    controller.addNode,
 			UpdateFunc: controller.updateNode,
+			DeleteFunc: controller.deleteNode,
 		},
 	)
 	return controller, nil
@@ -48,51 +217,325 @@ func (c *Controller) Run(stopCh <-chan struct{}, stopSyncCh <-chan struct{}) err
 }
 
 func (c *Controller) runInternal(stopCh <-chan struct{}, stopSyncCh <-chan struct{}) error {
+	defer c.shutDown()
+	if err := c.startInformers(stopCh, stopSyncCh); err != nil {
+		return err
+	}
+	c.runWorkers(stopCh)
+	return nil
+}
+
+// shutDown stops the queue and flushes the events when the controller stops.
+func (c *Controller) shutDown() {
+	c.queue.ShutDown()
+	if c.broadcaster != nil {
+		c.broadcaster.Shutdown()
+	}
+}
+
+// startInformers starts the informers and waits for their caches to sync.
+func (c *Controller) startInformers(stopCh <-chan struct{}, stopSyncCh <-chan struct{}) error {
 	logrus.Info("Starting informers...")
+	informerSynced.WithLabelValues("nodes").Set(0)
 	c.informerFactory.Start(stopCh)
 	logrus.Info("Syncing informer cache...")
 	if !cache.WaitForCacheSync(stopSyncCh, c.nodeInformer.Informer().HasSynced) {
 		return fmt.Errorf("Failed to sync node informer cache")
 	}
+	informerSynced.WithLabelValues("nodes").Set(1)
+	c.synced.Store(true)
 	logrus.Info("Informer cache synced.")
-	<-stopCh
 	return nil
 }
 
+// runWorkers processes the queued nodes until the stop channel is signalled.
+// The workers only start once all spec sources have loaded their specs, as
+// processing nodes with some of the specs missing would remove the labels
+// produced by the missing ones.
+func (c *Controller) runWorkers(stopCh <-chan struct{}) {
+	for _, loaded := range c.sourcesLoaded {
+		select {
+		case <-loaded:
+		case <-stopCh:
+			return
+		}
+	}
+	c.markProgress()
+	c.leading.Store(true)
+	defer c.leading.Store(false)
+	logrus.WithField("workers", c.options.Workers).Info("Starting workers...")
+	for i := 0; i < c.options.Workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+	for _, callback := range c.leadingCallbacks {
+		go callback()
+	}
+	<-stopCh
+}
+
+// onStartedLeading registers a callback to call when the controller starts
+// processing nodes. Must be called before the controller is run.
+func (c *Controller) onStartedLeading(callback func()) {
+	c.leadingCallbacks = append(c.leadingCallbacks, callback)
+}
+
+// waitForSource registers a channel closed once a spec source has loaded its
+// specs, so that the workers wait for it. Must be called before the
+// controller is run.
+func (c *Controller) waitForSource(loaded <-chan struct{}) {
+	c.sourcesLoaded = append(c.sourcesLoaded, loaded)
+}
+
+// IsLeading returns true while the controller is processing nodes, i.e.
+// while it holds the leader lease when running with leader election.
+func (c *Controller) IsLeading() bool {
+	return c.leading.Load()
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+// processNextItem processes a single node from the queue, requeueing it with
+// backoff on failure. Returns false when the queue is shut down.
+func (c *Controller) processNextItem() bool {
+	idle := c.queue.Len() == 0
+	name, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(name)
+	if idle {
+		// The controller had no nodes to process until now, so the liveness
+		// timeout starts with this one.
+		c.markProgress()
+	}
+
+	c.processing.Add(1)
+	err := c.syncNode(name)
+	c.processing.Add(-1)
+	if err == nil {
+		c.markProgress()
+		c.queue.Forget(name)
+		return true
+	}
+	logger := logrus.WithField("node", name).WithError(err)
+	if c.queue.NumRequeues(name) < c.options.MaxRetries {
+		logger.Warn("Failed to process node, will retry")
+		c.queue.AddRateLimited(name)
+		return true
+	}
+	logger.Error("Failed to process node, giving up")
+	c.queue.Forget(name)
+	return true
+}
+
+// SetSpecs atomically replaces the specs coming from the named source and
+// re-evaluates all nodes known to the controller against the new combined
+// specs.
+func (c *Controller) SetSpecs(source string, newSpecs specs.Specs) {
+	c.setSpecs(source, newSpecs)
+	logrus.WithField("source", source).Info("Relabel specs updated, re-evaluating nodes")
+	c.requeueAllNodes()
+}
+
+// requeueAllNodes re-evaluates all nodes known to the controller.
+func (c *Controller) requeueAllNodes() {
+	nodes, err := c.nodeInformer.Lister().List(labels.Everything())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list nodes")
+		return
+	}
+	for _, node := range nodes {
+		c.queue.Add(node.Name)
+	}
+}
+
+func (c *Controller) setSpecs(source string, newSpecs specs.Specs) {
+	c.specsLock.Lock()
+	defer c.specsLock.Unlock()
+
+	if c.specSources == nil {
+		c.specSources = map[string]specs.Specs{}
+	}
+	if _, ok := c.specSources[source]; !ok {
+		c.sourceOrder = append(c.sourceOrder, source)
+	}
+	c.specSources[source] = newSpecs
+
+	var combined specs.Specs
+	for _, name := range c.sourceOrder {
+		combined = append(combined, c.specSources[name]...)
+	}
+	c.specs = combined
+	combined.ForgetRemovedRules()
+}
+
+func (c *Controller) currentSpecs() specs.Specs {
+	c.specsLock.RLock()
+	defer c.specsLock.RUnlock()
+	return c.specs
+}
+
 func (c *Controller) addNode(obj interface{}) {
-	c.updateNode(nil, obj)
+	c.enqueueNode("add", obj)
 }
 
 func (c *Controller) updateNode(oldObj interface{}, newObj interface{}) {
-	node, ok := newObj.(*core_v1.Node)
+	c.enqueueNode("update", newObj)
+}
+
+func (c *Controller) enqueueNode(event string, obj interface{}) {
+	node, ok := obj.(*core_v1.Node)
 	if !ok {
-		logrus.WithField("obj", newObj).Error("Unexpected object received (not a Node)")
+		logrus.WithField("obj", obj).Error("Unexpected object received (not a Node)")
+		return
 	}
+	nodeEvents.WithLabelValues(event).Inc()
 	logrus.WithField("name", node.Name).Info("Received node update")
+	c.queue.Add(node.Name)
+}
+
+// deleteNode queues deleted nodes so that their state in the metrics is
+// cleared when they are processed.
+func (c *Controller) deleteNode(obj interface{}) {
+	name, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		logrus.WithField("obj", obj).WithError(err).Error("Unexpected object deleted")
+		return
+	}
+	nodeEvents.WithLabelValues("delete").Inc()
+	logrus.WithField("name", name).Info("Received node deletion")
+	c.queue.Add(name)
+}
+
+// syncNode brings the labels of the named node in line with the specs.
+func (c *Controller) syncNode(name string) error {
+	node, err := c.nodeInformer.Lister().Get(name)
+	if errors.IsNotFound(err) {
+		logrus.WithField("node", name).Debug("Node no longer exists")
+		c.recordUnmatched(name, nil)
+		c.recordMatched(name, nil)
+		c.recordCompliance(name, true)
+		c.recordDryRunChanges(name, nil)
+		specs.ForgetNode(name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.relabelNode(node)
+}
+
+func (c *Controller) relabelNode(node *core_v1.Node) error {
+	logrus.WithField("name", node.Name).Debug("Processing node")
 
-	replacements := c.specs.ApplyTo(node.Labels)
-
-	updated := false
-	for key, value := range replacements {
-		if oldValue, ok := node.Labels[key]; !ok || value != oldValue {
-			fields := logrus.Fields{"node": node.Name, "key": key, "newValue": value}
-			if ok {
-				fields["oldValue"] = oldValue
-			}
-			logrus.WithFields(fields).Debug("Updated node label")
-			node.Labels[key] = value
-			updated = true
+	result := c.currentSpecs().ApplyToNode(node)
+	c.recordUnmatched(node.Name, result.Unmatched)
+	c.recordMatched(node.Name, result.MatchedRules())
+	c.recordRuleFailures(node, result.Errors)
+	update := newNodeUpdate(node, result)
+	if update.empty() {
+		c.recordCompliance(node.Name, true)
+		c.recordDryRunChanges(node.Name, nil)
+		return result.Err
+	}
+	if c.options.DryRun != DryRunNone {
+		if err := c.dryRunUpdate(node, update); err != nil {
+			return err
 		}
+		return result.Err
+	}
+	logrus.WithField("node", node.Name).Info("Updating node")
+	err := c.writeNode(node, update)
+	c.recordCompliance(node.Name, err == nil)
+	if errors.IsConflict(err) {
+		nodeUpdates.WithLabelValues(updateResultConflict).Inc()
+		err = fmt.Errorf("Conflict updating node labels: %w", err)
+		c.recordUpdateFailure(node, err)
+		return err
+	}
+	if err != nil {
+		nodeUpdates.WithLabelValues(updateResultError).Inc()
+		err = fmt.Errorf("Failed to update node: %w", err)
+		c.recordUpdateFailure(node, err)
+		return err
+	}
+	nodeUpdates.WithLabelValues(updateResultSuccess).Inc()
+	for key := range update.labels.changed {
+		labelsAdded.WithLabelValues(update.labels.rules[key]).Inc()
+	}
+	for _, key := range update.labels.removed {
+		labelsRemoved.WithLabelValues(update.labels.rules[key]).Inc()
+	}
+	c.recordLabelEvents(node, update)
+	// Plugin rules with the retry failure policy make the node processed
+	// again, after the changes from the other rules are written.
+	return result.Err
+}
+
+// recordUnmatched records the lookup rules that found no row for the node
+// in the unmatched nodes metric.
+func (c *Controller) recordUnmatched(name string, rules []string) {
+	c.unmatchedLock.Lock()
+	defer c.unmatchedLock.Unlock()
+	if c.unmatched == nil {
+		c.unmatched = map[string][]string{}
+	}
+	for _, rule := range c.unmatched[name] {
+		lookupUnmatchedNodes.WithLabelValues(rule).Dec()
 	}
-	if updated {
-		logrus.WithField("node", node.Name).Info("Updating node")
-		_, err := c.client.CoreV1().Nodes().Update(
-			context.TODO(),
-			node,
-			meta_v1.UpdateOptions{})
-		if err != nil {
-			logrus.WithField("node", node.Name).WithError(err).Error(
-				"Failed to update node")
+	for _, rule := range rules {
+		lookupUnmatchedNodes.WithLabelValues(rule).Inc()
+	}
+	if len(rules) == 0 {
+		delete(c.unmatched, name)
+	} else {
+		c.unmatched[name] = rules
+	}
+}
+
+// recordMatched records the rules that matched the node.
+func (c *Controller) recordMatched(name string, rules []string) {
+	c.matchedLock.Lock()
+	defer c.matchedLock.Unlock()
+	if c.matched == nil {
+		c.matched = map[string][]string{}
+	}
+	if len(rules) == 0 {
+		delete(c.matched, name)
+	} else {
+		c.matched[name] = rules
+	}
+}
+
+// matchedNodes returns the number of nodes each rule matched when they were
+// last processed, by rule name.
+func (c *Controller) matchedNodes() map[string]int32 {
+	c.matchedLock.Lock()
+	defer c.matchedLock.Unlock()
+	counts := map[string]int32{}
+	for _, rules := range c.matched {
+		for _, rule := range rules {
+			counts[rule]++
 		}
 	}
+	return counts
+}
+
+// recordCompliance records whether the node's labels, taints, and
+// annotations match the rules in the out of compliance nodes metric.
+func (c *Controller) recordCompliance(name string, compliant bool) {
+	c.complianceLock.Lock()
+	defer c.complianceLock.Unlock()
+	if c.outOfCompliance == nil {
+		c.outOfCompliance = map[string]bool{}
+	}
+	if compliant {
+		delete(c.outOfCompliance, name)
+	} else {
+		c.outOfCompliance[name] = true
+	}
+	nodesOutOfCompliance.Set(float64(len(c.outOfCompliance)))
 }
@@ -2,17 +2,22 @@ package kube
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vladlosev/node-relabeler/pkg/specs"
 	core_v1 "k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	apply_core_v1 "k8s.io/client-go/applyconfigurations/core/v1"
 	"k8s.io/client-go/kubernetes/fake"
 	go_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 func TestControllerLabelUpdate(t *testing.T) {
@@ -82,63 +87,386 @@ func TestControllerLabelUpdate(t *testing.T) {
 		},
 	}
 
+	strategies := []struct {
+		name    string
+		options Options
+	}{
+		// Replacing existing labels conflicts with their original owner, so
+		// the apply strategy needs to force conflicts here.
+		{"Apply", Options{UpdateStrategy: UpdateStrategyApply, ForceConflicts: true}},
+		{"Patch", Options{UpdateStrategy: UpdateStrategyPatch}},
+	}
+	for _, strategy := range strategies {
+		for _, testItem := range testData {
+			t.Run(strategy.name+"/"+testItem.name, func(t *testing.T) {
+				specs, err := specs.Parse(testItem.specs)
+				require.NoError(t, err)
+				node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+					Name:   "test-node-" + testItem.name,
+					Labels: testItem.labels,
+				}}
+				fakeClient := fake.NewClientset(node)
+				updateChan := make(chan struct{})
+				fakeClient.PrependReactor(
+					"patch",
+					"nodes",
+					func(action go_testing.Action) (bool, runtime.Object, error) {
+						// Apply the patch before signalling, so that it's visible to the
+						// test once updateChan is closed.
+						handled, obj, err := go_testing.ObjectReaction(fakeClient.Tracker())(action)
+						// Make sure we don't close updateChan more than once when multiple
+						// updates arrive.
+						select {
+						case <-updateChan:
+							break
+						default:
+							close(updateChan)
+						}
+						return handled, obj, err
+					},
+				)
+
+				controller, err := NewController(fakeClient, specs, strategy.options)
+				require.NoError(t, err)
+				stopChan := make(chan struct{})
+				stopSyncChan := make(chan struct{})
+				doneChan := make(chan struct{})
+
+				go func(stop, stopSync <-chan struct{}, done chan<- struct{}) {
+					// We use runInternal here to avoid interupting the cache sync.
+					err = controller.runInternal(stop, stopSync)
+					assert.NoError(t, err)
+					close(done)
+				}(stopChan, stopSyncChan, doneChan)
+
+				select {
+				case <-updateChan:
+					close(stopChan)
+					<-doneChan
+					updated, err := fakeClient.CoreV1().Nodes().Get(
+						context.TODO(),
+						node.Name,
+						meta_v1.GetOptions{},
+					)
+					require.NoError(t, err)
+					testItem.validate(t, updated)
+					break
+				case <-time.After(1000 * time.Millisecond):
+					assert.Fail(t, "No expected node updates received")
+					close(stopSyncChan)
+					close(stopChan)
+					<-doneChan
+				}
+			})
+		}
+	}
+}
+
+func TestControllerLabelUpdateApplyConflictRetried(t *testing.T) {
+	specs, err := specs.Parse([]string{"abc=def:abc=xyz"})
+	require.NoError(t, err)
+	fakeClient := fake.NewClientset()
+	node, err := fakeClient.CoreV1().Nodes().Apply(
+		context.TODO(),
+		apply_core_v1.Node("test-node").WithLabels(map[string]string{"abc": "def"}),
+		meta_v1.ApplyOptions{FieldManager: "other-manager"},
+	)
+	require.NoError(t, err)
+	applies := 0
+	fakeClient.PrependReactor(
+		"patch",
+		"nodes",
+		func(action go_testing.Action) (bool, runtime.Object, error) {
+			applies++
+			return false, nil, nil
+		},
+	)
+
+	// The chart does not force conflicts by default.
+	recorder := record.NewFakeRecorder(10)
+	controller, err := NewController(
+		fakeClient,
+		specs,
+		Options{UpdateStrategy: UpdateStrategyApply, EventRecorder: recorder},
+	)
+	require.NoError(t, err)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	controller.informerFactory.Start(stopChan)
+	require.True(t, cache.WaitForCacheSync(stopChan, controller.nodeInformer.Informer().HasSynced))
+	initialConflicts := testutil.ToFloat64(nodeUpdates.WithLabelValues(updateResultConflict))
+
+	controller.queue.Add(node.Name)
+	for i := 0; i < 2; i++ {
+		require.True(t, controller.processNextItem())
+		assert.Equal(t, i+1, controller.queue.NumRequeues(node.Name))
+	}
+	assert.Equal(t, 2, applies)
+	assert.Equal(
+		t,
+		2.0,
+		testutil.ToFloat64(nodeUpdates.WithLabelValues(updateResultConflict))-initialConflicts,
+	)
+	events := receiveEvents(recorder)
+	require.Len(t, events, 2)
+	assert.Regexp(t, "^Warning UpdateFailed Conflict updating node labels", events[0])
+
+	updated, err := fakeClient.CoreV1().Nodes().Get(
+		context.TODO(),
+		node.Name,
+		meta_v1.GetOptions{},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "def", updated.Labels["abc"])
+}
+
+func TestControllerApplyConflicts(t *testing.T) {
+	testData := []struct {
+		name           string
+		forceConflicts bool
+		expectedValue  string
+	}{
+		{"ReportsConflict", false, "def"},
+		{"ForcesConflict", true, "xyz"},
+	}
+
 	for _, testItem := range testData {
 		t.Run(testItem.name, func(t *testing.T) {
-			specs, err := specs.Parse(testItem.specs)
+			specs, err := specs.Parse([]string{"abc=def:abc=xyz"})
 			require.NoError(t, err)
-			node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
-				Name:   "test-node-" + testItem.name,
-				Labels: testItem.labels,
-			}}
-			fakeClient := fake.NewSimpleClientset(node)
-			updateChan := make(chan struct{})
-			fakeClient.PrependReactor(
-				"update",
-				"nodes",
-				func(action go_testing.Action) (bool, runtime.Object, error) {
-					// Make sure we don't close updateChan more than once when multiple
-					// updates arrive.
-					select {
-					case <-updateChan:
-						break
-					default:
-						close(updateChan)
-					}
-					return false, nil, nil
-				},
+			fakeClient := fake.NewClientset()
+			node, err := fakeClient.CoreV1().Nodes().Apply(
+				context.TODO(),
+				apply_core_v1.Node("test-node").WithLabels(map[string]string{"abc": "def"}),
+				meta_v1.ApplyOptions{FieldManager: "other-manager"},
 			)
-
-			controller, err := NewController(fakeClient, specs)
 			require.NoError(t, err)
-			stopChan := make(chan struct{})
-			stopSyncChan := make(chan struct{})
-			doneChan := make(chan struct{})
 
-			go func(stop, stopSync <-chan struct{}, done chan<- struct{}) {
-				// We use runInternal here to avoid interupting the cache sync.
-				err = controller.runInternal(stop, stopSync)
+			controller, err := NewController(
+				fakeClient,
+				specs,
+				Options{ForceConflicts: testItem.forceConflicts},
+			)
+			require.NoError(t, err)
+			err = controller.relabelNode(node)
+			if testItem.forceConflicts {
 				assert.NoError(t, err)
-				close(done)
-			}(stopChan, stopSyncChan, doneChan)
-
-			select {
-			case <-updateChan:
-				close(stopChan)
-				<-doneChan
-				updated, err := fakeClient.CoreV1().Nodes().Get(
-					context.TODO(),
-					node.Name,
-					meta_v1.GetOptions{},
-				)
-				require.NoError(t, err)
-				testItem.validate(t, updated)
-				break
-			case <-time.After(1000 * time.Millisecond):
-				assert.Fail(t, "No expected node updates received")
-				close(stopSyncChan)
-				close(stopChan)
-				<-doneChan
+			} else {
+				require.Error(t, err)
+				assert.Regexp(t, "Conflict updating node labels", err.Error())
 			}
+
+			updated, err := fakeClient.CoreV1().Nodes().Get(
+				context.TODO(),
+				node.Name,
+				meta_v1.GetOptions{},
+			)
+			require.NoError(t, err)
+			assert.Equal(t, testItem.expectedValue, updated.Labels["abc"])
 		})
 	}
 }
+
+func TestControllerApplySetsFieldManager(t *testing.T) {
+	specs, err := specs.Parse([]string{"abc=def:uvw=xyz"})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"abc": "def"},
+	}}
+	fakeClient := fake.NewClientset(node)
+	controller, err := NewController(fakeClient, specs, Options{})
+	require.NoError(t, err)
+	err = controller.relabelNode(node)
+	require.NoError(t, err)
+
+	updated, err := fakeClient.CoreV1().Nodes().Get(
+		context.TODO(),
+		node.Name,
+		meta_v1.GetOptions{},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "xyz", updated.Labels["uvw"])
+	managers := []string{}
+	for _, entry := range updated.ManagedFields {
+		managers = append(managers, entry.Manager)
+	}
+	assert.Contains(t, managers, FieldManager)
+}
+
+func TestControllerRetriesFailedUpdates(t *testing.T) {
+	specs, err := specs.Parse([]string{"abc=def:uvw=xyz"})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"abc": "def"},
+	}}
+	fakeClient := fake.NewClientset(node)
+	attempts := 0
+	updateChan := make(chan struct{})
+	fakeClient.PrependReactor(
+		"patch",
+		"nodes",
+		func(action go_testing.Action) (bool, runtime.Object, error) {
+			attempts++
+			if attempts < 3 {
+				return true, nil, fmt.Errorf("Transient error")
+			}
+			handled, obj, err := go_testing.ObjectReaction(fakeClient.Tracker())(action)
+			close(updateChan)
+			return handled, obj, err
+		},
+	)
+
+	controller, err := NewController(fakeClient, specs, Options{})
+	require.NoError(t, err)
+	stopChan := make(chan struct{})
+	stopSyncChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	go func() {
+		// We use runInternal here to avoid interupting the cache sync.
+		err := controller.runInternal(stopChan, stopSyncChan)
+		assert.NoError(t, err)
+		close(doneChan)
+	}()
+	defer func() {
+		close(stopChan)
+		<-doneChan
+	}()
+
+	select {
+	case <-updateChan:
+		updated, err := fakeClient.CoreV1().Nodes().Get(
+			context.TODO(),
+			node.Name,
+			meta_v1.GetOptions{},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, "xyz", updated.Labels["uvw"])
+		assert.Equal(t, 3, attempts)
+	case <-time.After(1000 * time.Millisecond):
+		assert.Fail(t, "No expected node updates received")
+	}
+}
+
+func TestControllerGivesUpAfterMaxRetries(t *testing.T) {
+	specs, err := specs.Parse([]string{"abc=def:uvw=xyz"})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"abc": "def"},
+	}}
+	fakeClient := fake.NewClientset(node)
+	fakeClient.PrependReactor(
+		"patch",
+		"nodes",
+		func(action go_testing.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("Permanent error")
+		},
+	)
+	controller, err := NewController(fakeClient, specs, Options{MaxRetries: 2})
+	require.NoError(t, err)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	controller.informerFactory.Start(stopChan)
+	require.True(t, cache.WaitForCacheSync(stopChan, controller.nodeInformer.Informer().HasSynced))
+
+	controller.queue.Add(node.Name)
+	for i := 0; i < 2; i++ {
+		require.True(t, controller.processNextItem())
+		assert.Equal(t, i+1, controller.queue.NumRequeues(node.Name))
+	}
+	require.True(t, controller.processNextItem())
+	assert.Equal(t, 0, controller.queue.NumRequeues(node.Name))
+	controller.queue.ShutDown()
+	assert.False(t, controller.processNextItem())
+}
+
+func TestNewControllerInvalidUpdateStrategy(t *testing.T) {
+	_, err := NewController(fake.NewClientset(), nil, Options{UpdateStrategy: "replace"})
+	require.Error(t, err)
+	assert.Regexp(t, "Invalid update strategy", err.Error())
+}
+
+func TestControllerSetSpecsReevaluatesNodes(t *testing.T) {
+	initialSpecs, err := specs.Parse([]string{"abc=xyz:uvw=xyz"})
+	require.NoError(t, err)
+	newSpecs, err := specs.Parse([]string{"abc=def:uvw=xyz"})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"abc": "def"},
+	}}
+	fakeClient := fake.NewClientset(node)
+	updateChan := make(chan struct{})
+	fakeClient.PrependReactor(
+		"patch",
+		"nodes",
+		func(action go_testing.Action) (bool, runtime.Object, error) {
+			handled, obj, err := go_testing.ObjectReaction(fakeClient.Tracker())(action)
+			close(updateChan)
+			return handled, obj, err
+		},
+	)
+
+	controller, err := NewController(fakeClient, initialSpecs, Options{})
+	require.NoError(t, err)
+	stopChan := make(chan struct{})
+	stopSyncChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	go func() {
+		// We use runInternal here to avoid interupting the cache sync.
+		err := controller.runInternal(stopChan, stopSyncChan)
+		assert.NoError(t, err)
+		close(doneChan)
+	}()
+	defer func() {
+		close(stopChan)
+		<-doneChan
+	}()
+	require.Eventually(
+		t,
+		controller.nodeInformer.Informer().HasSynced,
+		time.Second,
+		10*time.Millisecond,
+	)
+
+	controller.SetSpecs("test", newSpecs)
+	select {
+	case <-updateChan:
+		updated, err := fakeClient.CoreV1().Nodes().Get(
+			context.TODO(),
+			node.Name,
+			meta_v1.GetOptions{},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, "xyz", updated.Labels["uvw"])
+	case <-time.After(1000 * time.Millisecond):
+		assert.Fail(t, "No expected node updates received")
+	}
+}
+
+func TestControllerSetSpecsCombinesSources(t *testing.T) {
+	commandLineSpecs, err := specs.Parse([]string{"abc=def:uvw=xyz"})
+	require.NoError(t, err)
+	configSpecs, err := specs.Parse([]string{"abc=*:def=*"})
+	require.NoError(t, err)
+	newConfigSpecs, err := specs.Parse([]string{"abc=*:ghi=*"})
+	require.NoError(t, err)
+
+	controller, err := NewController(fake.NewSimpleClientset(), commandLineSpecs, Options{})
+	require.NoError(t, err)
+	controller.SetSpecs(ConfigSpecsSource, configSpecs)
+	assert.Equal(
+		t,
+		map[string]string{"uvw": "xyz", "def": "def"},
+		controller.currentSpecs().ApplyTo(map[string]string{"abc": "def"}),
+	)
+
+	controller.SetSpecs(ConfigSpecsSource, newConfigSpecs)
+	assert.Equal(
+		t,
+		map[string]string{"uvw": "xyz", "ghi": "def"},
+		controller.currentSpecs().ApplyTo(map[string]string{"abc": "def"}),
+	)
+}
@@ -0,0 +1,93 @@
+package kube
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// dryRunChange is a label change pending on a node in dry run mode.
+type dryRunChange struct {
+	rule string
+	// change is set or remove.
+	change string
+}
+
+// dryRunUpdate logs the update the controller would make to the node and
+// records it in the metrics instead of writing it. In the server dry run
+// mode, the update is also sent to the API server for validation.
+func (c *Controller) dryRunUpdate(node *core_v1.Node, update nodeUpdate) error {
+	logger := logrus.WithFields(update.logFields()).WithField("node", node.Name)
+	// Nodes stay out of compliance until the changes are really written.
+	c.recordCompliance(node.Name, false)
+	var changes []dryRunChange
+	for key := range update.labels.changed {
+		changes = append(changes, dryRunChange{update.labels.rules[key], "set"})
+	}
+	for _, key := range update.labels.removed {
+		changes = append(changes, dryRunChange{update.labels.rules[key], "remove"})
+	}
+	c.recordDryRunChanges(node.Name, changes)
+	if c.options.DryRun == DryRunServer {
+		if err := c.writeNode(node, update); err != nil {
+			logger.WithError(err).Warn("Dry run: node update rejected by the API server")
+			return fmt.Errorf("Dry run update of node failed: %w", err)
+		}
+	}
+	logger.Info("Dry run: would update node")
+	return nil
+}
+
+// recordDryRunChanges records the label changes pending on the node in the
+// dry run label changes metric, replacing the ones recorded when the node was
+// last processed.
+func (c *Controller) recordDryRunChanges(name string, changes []dryRunChange) {
+	c.dryRunLock.Lock()
+	defer c.dryRunLock.Unlock()
+	if c.dryRunChanges == nil {
+		c.dryRunChanges = map[string][]dryRunChange{}
+	}
+	for _, change := range c.dryRunChanges[name] {
+		dryRunLabelChanges.WithLabelValues(change.rule, change.change).Dec()
+	}
+	for _, change := range changes {
+		dryRunLabelChanges.WithLabelValues(change.rule, change.change).Inc()
+	}
+	if len(changes) == 0 {
+		delete(c.dryRunChanges, name)
+	} else {
+		c.dryRunChanges[name] = changes
+	}
+}
+
+// dryRunOption returns the dry run option of the writes to nodes.
+func (c *Controller) dryRunOption() []string {
+	if c.options.DryRun == DryRunServer {
+		return []string{meta_v1.DryRunAll}
+	}
+	return nil
+}
+
+// logFields returns the changes in the update as log fields. Kinds of values
+// without changes are left out.
+func (u nodeUpdate) logFields() logrus.Fields {
+	fields := logrus.Fields{}
+	for kind, changes := range map[string]ownedChanges{
+		"Labels":      u.labels,
+		"Taints":      u.taints,
+		"Annotations": u.annotations,
+	} {
+		if len(changes.changed) > 0 {
+			fields["set"+kind] = changes.changed
+		}
+		if len(changes.removed) > 0 {
+			fields["removed"+kind] = changes.removed
+		}
+	}
+	if len(u.labels.rules) > 0 {
+		fields["labelRules"] = u.labels.rules
+	}
+	return fields
+}
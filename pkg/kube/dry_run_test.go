@@ -0,0 +1,147 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	go_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+func TestControllerDryRun(t *testing.T) {
+	parsedSpecs, err := specs.ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: test-dry-run
+  match: {key: abc, value: def}
+  set: {key: uvw, value: xyz}
+  action: move
+`))
+	require.NoError(t, err)
+
+	testData := []struct {
+		name        string
+		mode        DryRunMode
+		patchErr    error
+		expectedErr string
+		patches     int
+	}{
+		{"Client", DryRunClient, nil, "", 0},
+		{"Server", DryRunServer, nil, "", 1},
+		{
+			"ServerRejected",
+			DryRunServer,
+			fmt.Errorf("Invalid label"),
+			"Dry run update of node failed: Invalid label",
+			1,
+		},
+	}
+	logHook := logrus_test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+				Name:   "test-dry-run-" + string(testItem.mode),
+				Labels: map[string]string{"abc": "def"},
+			}}
+			fakeClient := fake.NewClientset(node)
+			var patchOptions []meta_v1.PatchOptions
+			fakeClient.PrependReactor(
+				"patch",
+				"nodes",
+				func(action go_testing.Action) (bool, runtime.Object, error) {
+					patchOptions = append(
+						patchOptions, action.(go_testing.PatchActionImpl).PatchOptions)
+					return true, node, testItem.patchErr
+				},
+			)
+			recorder := record.NewFakeRecorder(10)
+			controller, err := NewController(fakeClient, parsedSpecs, Options{
+				UpdateStrategy: UpdateStrategyPatch,
+				DryRun:         testItem.mode,
+				EventRecorder:  recorder,
+			})
+			require.NoError(t, err)
+
+			setChanges := dryRunLabelChanges.WithLabelValues("test-dry-run", "set")
+			removeChanges := dryRunLabelChanges.WithLabelValues("test-dry-run", "remove")
+			initialSet := testutil.ToFloat64(setChanges)
+			initialRemove := testutil.ToFloat64(removeChanges)
+			logHook.Reset()
+
+			err = controller.relabelNode(node)
+			if testItem.expectedErr != "" {
+				require.Error(t, err)
+				assert.Equal(t, testItem.expectedErr, err.Error())
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Len(t, patchOptions, testItem.patches)
+			for _, options := range patchOptions {
+				assert.Equal(t, []string{meta_v1.DryRunAll}, options.DryRun)
+			}
+			updated, err := fakeClient.CoreV1().Nodes().Get(
+				context.TODO(),
+				node.Name,
+				meta_v1.GetOptions{},
+			)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"abc": "def"}, updated.Labels)
+			assert.Empty(t, receiveEvents(recorder))
+
+			assert.Equal(t, 1.0, testutil.ToFloat64(setChanges)-initialSet)
+			assert.Equal(t, 1.0, testutil.ToFloat64(removeChanges)-initialRemove)
+			assert.Equal(t, 1.0, testutil.ToFloat64(nodesOutOfCompliance))
+
+			// Processing the node again does not count its changes twice, and
+			// deleting it drops them.
+			_ = controller.relabelNode(node)
+			assert.Equal(t, 1.0, testutil.ToFloat64(setChanges)-initialSet)
+			assert.Equal(t, 1.0, testutil.ToFloat64(removeChanges)-initialRemove)
+			require.NoError(t, controller.syncNode(node.Name))
+			assert.Equal(t, 0.0, testutil.ToFloat64(setChanges)-initialSet)
+			assert.Equal(t, 0.0, testutil.ToFloat64(removeChanges)-initialRemove)
+			assert.Equal(t, 0.0, testutil.ToFloat64(nodesOutOfCompliance))
+
+			var entry *logrus.Entry
+			for _, e := range logHook.AllEntries() {
+				if e.Message == "Dry run: would update node" {
+					entry = e
+				}
+			}
+			if testItem.expectedErr != "" {
+				assert.Nil(t, entry)
+				return
+			}
+			require.NotNil(t, entry)
+			assert.Equal(t, node.Name, entry.Data["node"])
+			assert.Equal(t, map[string]string{"uvw": "xyz"}, entry.Data["setLabels"])
+			assert.Equal(t, []string{"abc"}, entry.Data["removedLabels"])
+			assert.Equal(
+				t,
+				map[string]string{"abc": "test-dry-run", "uvw": "test-dry-run"},
+				entry.Data["labelRules"],
+			)
+		})
+	}
+}
+
+func TestNewControllerInvalidDryRunMode(t *testing.T) {
+	_, err := NewController(fake.NewClientset(), nil, Options{DryRun: "always"})
+	require.Error(t, err)
+	assert.Equal(t, "Invalid dry run mode: always", err.Error())
+}
@@ -0,0 +1,143 @@
+package kube
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	client_go_scheme "k8s.io/client-go/kubernetes/scheme"
+	typed_core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/vladlosev/node-relabeler/pkg/apis/noderelabeler/v1alpha1"
+)
+
+// Reasons of the events the controller records.
+const (
+	// EventReasonLabelsSet is the reason of the events on nodes listing the
+	// labels a rule has set or changed.
+	EventReasonLabelsSet = "LabelsSet"
+	// EventReasonLabelsRemoved is the reason of the events on nodes listing
+	// the labels removed by a rule, or because a rule no longer produces
+	// them.
+	EventReasonLabelsRemoved = "LabelsRemoved"
+	// EventReasonUpdateFailed is the reason of the warnings on nodes the
+	// controller has failed to update.
+	EventReasonUpdateFailed = "UpdateFailed"
+	// EventReasonRuleFailed is the reason of the warnings on nodes for which
+	// a plugin rule has failed.
+	EventReasonRuleFailed = "RuleFailed"
+	// EventReasonInvalidRule is the reason of the warnings on
+	// NodeRelabelRule objects with errors.
+	EventReasonInvalidRule = "InvalidRule"
+)
+
+const (
+	// eventBurst and eventQPS rate limit the events with the same type and
+	// reason across all objects.
+	eventBurst = 100
+	eventQPS   = 1
+)
+
+// newEventBroadcaster returns a broadcaster writing events to the API
+// server. The broadcaster's correlator aggregates similar events on the same
+// object, and rate limits the events by type and reason rather than by
+// object, so that relabeling many nodes at once or failing on all of them
+// does not flood the API server.
+func newEventBroadcaster(client kubernetes.Interface) record.EventBroadcaster {
+	broadcaster := record.NewBroadcaster(record.WithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize:   eventBurst,
+		QPS:         eventQPS,
+		SpamKeyFunc: eventSpamKey,
+	}))
+	broadcaster.StartRecordingToSink(&typed_core_v1.EventSinkImpl{
+		Interface: client.CoreV1().Events(""),
+	})
+	return broadcaster
+}
+
+// eventSpamKey returns the key of the events sharing a rate limit.
+func eventSpamKey(event *core_v1.Event) string {
+	return strings.Join([]string{event.Source.Component, event.Type, event.Reason}, "/")
+}
+
+// newEventScheme returns the scheme used to refer to the objects events are
+// recorded on.
+func newEventScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	// Adding the types to an empty scheme only fails on conflicting
+	// registrations.
+	if err := client_go_scheme.AddToScheme(scheme); err != nil {
+		panic(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		panic(err)
+	}
+	return scheme
+}
+
+// recordLabelEvents records an event on the node for each rule that has set
+// or removed its labels in the update, listing the labels.
+func (c *Controller) recordLabelEvents(node *core_v1.Node, update nodeUpdate) {
+	set := map[string][]string{}
+	for _, key := range sortedKeys(update.labels.changed) {
+		rule := update.labels.rules[key]
+		set[rule] = append(set[rule], key+"="+update.labels.changed[key])
+	}
+	removed := map[string][]string{}
+	for _, key := range update.labels.removed {
+		rule := update.labels.rules[key]
+		removed[rule] = append(removed[rule], key)
+	}
+	for _, rule := range sortedRules(set) {
+		c.recorder.Eventf(
+			node, core_v1.EventTypeNormal, EventReasonLabelsSet,
+			"Rule %s set labels %s", rule, strings.Join(set[rule], ", "))
+	}
+	for _, rule := range sortedRules(removed) {
+		c.recorder.Eventf(
+			node, core_v1.EventTypeNormal, EventReasonLabelsRemoved,
+			"Rule %s removed labels %s", rule, strings.Join(removed[rule], ", "))
+	}
+}
+
+// recordRuleFailures records a warning on the node for each rule that has
+// failed for it.
+func (c *Controller) recordRuleFailures(node *core_v1.Node, errs map[string]error) {
+	rules := make([]string, 0, len(errs))
+	for rule := range errs {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		c.recorder.Eventf(
+			node, core_v1.EventTypeWarning, EventReasonRuleFailed,
+			"Rule %s failed: %s", rule, errs[rule])
+	}
+}
+
+// recordUpdateFailure records a warning on the node the controller has
+// failed to update.
+func (c *Controller) recordUpdateFailure(node *core_v1.Node, err error) {
+	c.recorder.Event(node, core_v1.EventTypeWarning, EventReasonUpdateFailed, err.Error())
+}
+
+// recordInvalidRule records a warning on the NodeRelabelRule object with the
+// rule's error.
+func (c *Controller) recordInvalidRule(rule *v1alpha1.NodeRelabelRule, message string) {
+	c.recorder.Event(
+		rule, core_v1.EventTypeWarning, EventReasonInvalidRule,
+		fmt.Sprintf("Invalid rule: %s", message))
+}
+
+func sortedRules(labels map[string][]string) []string {
+	rules := make([]string, 0, len(labels))
+	for rule := range labels {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	return rules
+}
@@ -0,0 +1,263 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	go_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+const eventsTestConfig = `
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: test-events
+  match: {key: abc, value: def}
+  set: {key: uvw, value: xyz}
+- name: test-events-copy
+  match: {key: abc, value: "*"}
+  set: {key: copy, value: "*"}
+`
+
+// receiveEvents returns the events recorded by the fake recorder so far.
+func receiveEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestControllerRecordsEvents(t *testing.T) {
+	_, err := specs.RegisterPlugin("test-events-broken", "/nonexistent/plugin", time.Second)
+	require.NoError(t, err)
+	parsedSpecs, err := specs.ParseConfig([]byte(eventsTestConfig + `
+- name: test-events-plugin
+  plugin: {name: test-events-broken}
+`))
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"abc": "def"},
+	}}
+	fakeClient := fake.NewClientset(node)
+	recorder := record.NewFakeRecorder(10)
+	controller, err := NewController(
+		fakeClient,
+		parsedSpecs,
+		Options{UpdateStrategy: UpdateStrategyPatch, EventRecorder: recorder},
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, controller.relabelNode(node))
+	events := receiveEvents(recorder)
+	require.Len(t, events, 3)
+	assert.Regexp(
+		t,
+		"^Warning RuleFailed Rule test-events-plugin failed: Plugin test-events-broken failed",
+		events[0],
+	)
+	assert.Equal(t, []string{
+		"Normal LabelsSet Rule test-events set labels uvw=xyz",
+		"Normal LabelsSet Rule test-events-copy set labels copy=def",
+	}, events[1:])
+
+	updated, err := fakeClient.CoreV1().Nodes().Get(
+		context.TODO(),
+		node.Name,
+		meta_v1.GetOptions{},
+	)
+	require.NoError(t, err)
+	updated.Labels["abc"] = "other"
+	require.NoError(t, controller.relabelNode(updated))
+	events = receiveEvents(recorder)
+	require.Len(t, events, 3)
+	assert.Equal(t, []string{
+		"Normal LabelsSet Rule test-events-copy set labels copy=other",
+		"Normal LabelsRemoved Rule test-events removed labels uvw",
+	}, events[1:])
+
+	fakeClient.PrependReactor(
+		"patch",
+		"nodes",
+		func(action go_testing.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("Permanent error")
+		},
+	)
+	require.Error(t, controller.relabelNode(node))
+	events = receiveEvents(recorder)
+	require.Len(t, events, 2)
+	assert.Equal(t, "Warning UpdateFailed Failed to update node: Permanent error", events[1])
+}
+
+func TestControllerKeepsLabelsOfFailedEvaluations(t *testing.T) {
+	parsedSpecs, err := specs.ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: test-condition
+  condition: node.labels.pool == 'gpu'
+  set: {key: accelerated, value: "true"}
+- name: test-template
+  match: {key: owner, value: "*"}
+  set: {key: owner-prefix, value: "{{slice .Value 0 3}}"}
+`))
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"owner": "platform", "pool": "gpu"},
+	}}
+	fakeClient := fake.NewClientset(node)
+	recorder := record.NewFakeRecorder(10)
+	controller, err := NewController(
+		fakeClient,
+		parsedSpecs,
+		Options{UpdateStrategy: UpdateStrategyPatch, EventRecorder: recorder},
+	)
+	require.NoError(t, err)
+
+	getNode := func() *core_v1.Node {
+		updated, err := fakeClient.CoreV1().Nodes().Get(
+			context.TODO(),
+			node.Name,
+			meta_v1.GetOptions{},
+		)
+		require.NoError(t, err)
+		return updated
+	}
+
+	require.NoError(t, controller.relabelNode(node))
+	receiveEvents(recorder)
+
+	// The condition now refers to a missing label and the template slices
+	// past the end of the value, so both rules fail and keep their labels.
+	updated := getNode()
+	updated.Labels["owner"] = "ml"
+	delete(updated.Labels, "pool")
+	_, err = fakeClient.CoreV1().Nodes().Update(
+		context.TODO(),
+		updated,
+		meta_v1.UpdateOptions{FieldManager: "test"},
+	)
+	require.NoError(t, err)
+	require.NoError(t, controller.relabelNode(getNode()))
+	assert.Equal(
+		t,
+		map[string]string{"owner": "ml", "accelerated": "true", "owner-prefix": "pla"},
+		getNode().Labels,
+	)
+	events := receiveEvents(recorder)
+	require.Len(t, events, 2)
+	assert.Equal(
+		t,
+		"Warning RuleFailed Rule test-condition failed: no such key: pool",
+		events[0],
+	)
+	assert.Regexp(
+		t,
+		"^Warning RuleFailed Rule test-template failed: .*index out of range",
+		events[1],
+	)
+}
+
+func TestControllerWritesEventsToAPIServer(t *testing.T) {
+	parsedSpecs, err := specs.ParseConfig([]byte(eventsTestConfig))
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		UID:    "1234",
+		Labels: map[string]string{"abc": "def"},
+	}}
+	fakeClient := fake.NewClientset(node)
+	controller, err := NewController(
+		fakeClient,
+		parsedSpecs,
+		Options{UpdateStrategy: UpdateStrategyPatch},
+	)
+	require.NoError(t, err)
+	defer controller.shutDown()
+
+	require.NoError(t, controller.relabelNode(node))
+	var events *core_v1.EventList
+	require.Eventually(
+		t,
+		func() bool {
+			events, err = fakeClient.CoreV1().Events(meta_v1.NamespaceDefault).List(
+				context.TODO(),
+				meta_v1.ListOptions{},
+			)
+			require.NoError(t, err)
+			return len(events.Items) == 2
+		},
+		time.Second,
+		10*time.Millisecond,
+	)
+	for _, event := range events.Items {
+		assert.Equal(t, "Node", event.InvolvedObject.Kind)
+		assert.Equal(t, "test-node", event.InvolvedObject.Name)
+		assert.Equal(t, "1234", string(event.InvolvedObject.UID))
+		assert.Equal(t, EventReasonLabelsSet, event.Reason)
+		assert.Equal(t, FieldManager, event.Source.Component)
+	}
+}
+
+func TestControllerRateLimitsEventsAcrossNodes(t *testing.T) {
+	parsedSpecs, err := specs.ParseConfig([]byte(eventsTestConfig))
+	require.NoError(t, err)
+	var nodes []*core_v1.Node
+	var objects []runtime.Object
+	for i := 0; i < 2*eventBurst; i++ {
+		node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+			Name:   fmt.Sprintf("node-%d", i),
+			Labels: map[string]string{"abc": "def"},
+		}}
+		nodes = append(nodes, node)
+		objects = append(objects, node)
+	}
+	fakeClient := fake.NewClientset(objects...)
+	controller, err := NewController(
+		fakeClient,
+		parsedSpecs,
+		Options{UpdateStrategy: UpdateStrategyPatch},
+	)
+	require.NoError(t, err)
+	defer controller.shutDown()
+
+	start := time.Now()
+	for _, node := range nodes {
+		require.NoError(t, controller.relabelNode(node))
+	}
+	countEvents := func() int {
+		events, err := fakeClient.CoreV1().Events(meta_v1.NamespaceDefault).List(
+			context.TODO(),
+			meta_v1.ListOptions{},
+		)
+		require.NoError(t, err)
+		return len(events.Items)
+	}
+	require.Eventually(
+		t,
+		func() bool { return countEvents() >= eventBurst },
+		time.Second,
+		10*time.Millisecond,
+	)
+	// Let the events beyond the burst through, if they are not dropped.
+	time.Sleep(100 * time.Millisecond)
+	refilled := int(time.Since(start).Seconds()*eventQPS) + 1
+	assert.LessOrEqual(t, countEvents(), eventBurst+refilled)
+}
@@ -0,0 +1,59 @@
+package kube
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Ready returns an error until the node informer cache is synced, so that
+// the replica is not reported ready before it knows about all the nodes.
+func (c *Controller) Ready() error {
+	if !c.synced.Load() {
+		return fmt.Errorf("Node informer cache is not synced")
+	}
+	return nil
+}
+
+// Healthy returns an error if the controller has had nodes to process for
+// longer than Options.LivenessTimeout without processing any of them
+// successfully, e.g. because the workers are stuck. Replicas that are not
+// processing nodes, such as leader election standbys, are always healthy.
+// The check does not count as progress itself.
+func (c *Controller) Healthy() error {
+	pending := c.queue.Len() + int(c.processing.Load())
+	if !c.IsLeading() || pending == 0 {
+		return nil
+	}
+	since := time.Since(time.Unix(0, c.lastProgress.Load()))
+	if since > c.options.LivenessTimeout {
+		return fmt.Errorf(
+			"No nodes processed successfully in %s, %d pending",
+			since.Round(time.Second), pending)
+	}
+	return nil
+}
+
+// markProgress records that the controller is making progress.
+func (c *Controller) markProgress() {
+	c.lastProgress.Store(time.Now().UnixNano())
+}
+
+// HealthHandler returns an HTTP handler for health probes, responding with
+// 200 OK if the check passes and 503 Service Unavailable with the error
+// otherwise.
+func HealthHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			logrus.WithField("path", r.URL.Path).WithError(err).Warn("Health check failed")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, err.Error()+"\n")
+			return
+		}
+		_, _ = io.WriteString(w, "ok\n")
+	})
+}
@@ -0,0 +1,147 @@
+package kube
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	go_testing "k8s.io/client-go/testing"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+func TestControllerReadyAfterCacheSync(t *testing.T) {
+	controller, err := NewController(fake.NewClientset(), nil, Options{})
+	require.NoError(t, err)
+	err = controller.Ready()
+	require.Error(t, err)
+	assert.Equal(t, "Node informer cache is not synced", err.Error())
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	require.NoError(t, controller.startInformers(stopChan, stopChan))
+	assert.NoError(t, controller.Ready())
+}
+
+func TestControllerHealthy(t *testing.T) {
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: "test-node"}}
+	controller, err := NewController(
+		fake.NewClientset(node),
+		nil,
+		Options{LivenessTimeout: time.Minute},
+	)
+	require.NoError(t, err)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	require.NoError(t, controller.startInformers(stopChan, stopChan))
+	stale := time.Now().Add(-2 * time.Minute).UnixNano()
+
+	// Standbys do not process nodes, so they cannot be stuck.
+	controller.queue.Add(node.Name)
+	controller.lastProgress.Store(stale)
+	assert.NoError(t, controller.Healthy())
+
+	controller.leading.Store(true)
+	controller.lastProgress.Store(stale)
+	err = controller.Healthy()
+	require.Error(t, err)
+	assert.Equal(t, "No nodes processed successfully in 2m0s, 1 pending", err.Error())
+
+	require.True(t, controller.processNextItem())
+	assert.NoError(t, controller.Healthy())
+
+	// An idle controller is healthy however long ago it has processed a
+	// node, and probing it does not count as progress.
+	controller.lastProgress.Store(stale)
+	assert.NoError(t, controller.Healthy())
+	assert.Equal(t, stale, controller.lastProgress.Load())
+
+	// Nodes queued and not processed past the timeout make it unhealthy.
+	controller.queue.Add(node.Name)
+	err = controller.Healthy()
+	require.Error(t, err)
+	assert.Equal(t, "No nodes processed successfully in 2m0s, 1 pending", err.Error())
+	require.True(t, controller.processNextItem())
+	assert.NoError(t, controller.Healthy())
+}
+
+func TestControllerHealthyAfterIdle(t *testing.T) {
+	parsedSpecs, err := specs.Parse([]string{"abc=def:uvw=xyz"})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"abc": "def"},
+	}}
+	fakeClient := fake.NewClientset(node)
+	fakeClient.PrependReactor(
+		"patch",
+		"nodes",
+		func(action go_testing.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("Permanent error")
+		},
+	)
+	controller, err := NewController(
+		fakeClient,
+		parsedSpecs,
+		Options{LivenessTimeout: time.Minute, MaxRetries: 1},
+	)
+	require.NoError(t, err)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	require.NoError(t, controller.startInformers(stopChan, stopChan))
+	controller.leading.Store(true)
+	stale := time.Now().Add(-2 * time.Minute).UnixNano()
+
+	// Failing to process a node does not count as progress.
+	controller.lastProgress.Store(stale)
+	require.True(t, controller.processNextItem())
+	require.Eventually(
+		t,
+		func() bool { return controller.queue.Len() == 1 },
+		time.Second,
+		10*time.Millisecond,
+	)
+	require.True(t, controller.processNextItem())
+	assert.Equal(t, stale, controller.lastProgress.Load())
+
+	// A worker waiting for nodes starts the timeout when it gets one, even
+	// if processing it fails.
+	doneChan := make(chan struct{})
+	go func() {
+		assert.True(t, controller.processNextItem())
+		close(doneChan)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	controller.queue.Add(node.Name)
+	<-doneChan
+	assert.Greater(t, controller.lastProgress.Load(), stale)
+}
+
+func TestHealthHandler(t *testing.T) {
+	testData := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Passing", nil, http.StatusOK, "ok\n"},
+		{"Failing", fmt.Errorf("Stuck"), http.StatusServiceUnavailable, "Stuck\n"},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			handler := HealthHandler(func() error { return testItem.err })
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			assert.Equal(t, testItem.expectedStatus, recorder.Code)
+			assert.Equal(t, testItem.expectedBody, recorder.Body.String())
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// serviceAccountNamespaceFile contains the namespace of the pod when running
+// in a cluster.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// LeaderElectionOptions configures leader election between the controller
+// replicas.
+type LeaderElectionOptions struct {
+	// LeaseName is the name of the Lease object used as the lock.
+	LeaseName string
+	// LeaseNamespace is the namespace of the Lease object. Defaults to the
+	// namespace of the pod, or "default" when running outside a cluster.
+	LeaseNamespace string
+	// Identity identifies this replica in the Lease. Defaults to the host
+	// name with a unique suffix.
+	Identity string
+	// LeaseDuration is how long standbys wait before taking over a lease
+	// that has not been renewed.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps retrying to renew the lease
+	// before giving up leadership.
+	RenewDeadline time.Duration
+	// RetryPeriod is how often the replicas try to acquire or renew the
+	// lease.
+	RetryPeriod time.Duration
+}
+
+// RunWithLeaderElection runs the controller until the stop channel is
+// signalled, processing nodes only while holding the leader lease. The
+// informer caches are kept warm on all replicas, so that a standby can take
+// over quickly. Returns an error if the leadership is lost, in which case the
+// process is expected to exit and restart as a standby.
+func (c *Controller) RunWithLeaderElection(
+	stopCh <-chan struct{},
+	options LeaderElectionOptions,
+) error {
+	defer c.shutDown()
+	if options.LeaseNamespace == "" {
+		options.LeaseNamespace = podNamespace()
+	}
+	if options.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("Failed to get host name: %w", err)
+		}
+		options.Identity = hostname + "_" + string(uuid.NewUUID())
+	}
+
+	if err := c.startInformers(stopCh, stopCh); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logger := logrus.WithFields(logrus.Fields{
+		"lease":    options.LeaseNamespace + "/" + options.LeaseName,
+		"identity": options.Identity,
+	})
+	lostLeadership := false
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: meta_v1.ObjectMeta{
+				Name:      options.LeaseName,
+				Namespace: options.LeaseNamespace,
+			},
+			Client:     c.client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: options.Identity},
+		},
+		LeaseDuration:   options.LeaseDuration,
+		RenewDeadline:   options.RenewDeadline,
+		RetryPeriod:     options.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            options.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logger.Info("Acquired leader lease")
+				c.runWorkers(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				select {
+				case <-stopCh:
+					logger.Info("Released leader lease")
+				default:
+					logger.Error("Lost leader lease")
+					lostLeadership = true
+				}
+			},
+			OnNewLeader: func(identity string) {
+				if identity != options.Identity {
+					logger.WithField("leader", identity).Info("Waiting for leader lease")
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Starting leader election...")
+	elector.Run(ctx)
+	if lostLeadership {
+		return fmt.Errorf("Lost leader lease %s/%s", options.LeaseNamespace, options.LeaseName)
+	}
+	return nil
+}
+
+// podNamespace returns the namespace of the pod the process runs in, or
+// "default" when running outside a cluster.
+func podNamespace() string {
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err == nil {
+		if namespace := strings.TrimSpace(string(data)); namespace != "" {
+			return namespace
+		}
+	}
+	return "default"
+}
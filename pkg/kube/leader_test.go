@@ -0,0 +1,97 @@
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+func testLeaderElectionOptions(identity string) LeaderElectionOptions {
+	return LeaderElectionOptions{
+		LeaseName:      "node-relabeler",
+		LeaseNamespace: "system",
+		Identity:       identity,
+		LeaseDuration:  2 * time.Second,
+		RenewDeadline:  time.Second,
+		RetryPeriod:    100 * time.Millisecond,
+	}
+}
+
+func TestControllerLeaderElection(t *testing.T) {
+	parsedSpecs, err := specs.Parse([]string{"abc=def:uvw=xyz"})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"abc": "def"},
+	}}
+	fakeClient := fake.NewClientset(node)
+
+	leader, err := NewController(fakeClient, parsedSpecs, Options{})
+	require.NoError(t, err)
+	standby, err := NewController(fakeClient, parsedSpecs, Options{})
+	require.NoError(t, err)
+
+	leaderStopChan := make(chan struct{})
+	leaderDoneChan := make(chan struct{})
+	go func() {
+		err := leader.RunWithLeaderElection(leaderStopChan, testLeaderElectionOptions("leader"))
+		assert.NoError(t, err)
+		close(leaderDoneChan)
+	}()
+	require.Eventually(t, leader.IsLeading, 5*time.Second, 10*time.Millisecond)
+
+	standbyStopChan := make(chan struct{})
+	standbyDoneChan := make(chan struct{})
+	go func() {
+		err := standby.RunWithLeaderElection(standbyStopChan, testLeaderElectionOptions("standby"))
+		assert.NoError(t, err)
+		close(standbyDoneChan)
+	}()
+	defer func() {
+		close(standbyStopChan)
+		<-standbyDoneChan
+	}()
+
+	require.Eventually(
+		t,
+		func() bool {
+			updated, err := fakeClient.CoreV1().Nodes().Get(
+				context.TODO(),
+				node.Name,
+				meta_v1.GetOptions{},
+			)
+			require.NoError(t, err)
+			return updated.Labels["uvw"] == "xyz"
+		},
+		time.Second,
+		10*time.Millisecond,
+	)
+	lease, err := fakeClient.CoordinationV1().Leases("system").Get(
+		context.TODO(),
+		"node-relabeler",
+		meta_v1.GetOptions{},
+	)
+	require.NoError(t, err)
+	require.NotNil(t, lease.Spec.HolderIdentity)
+	assert.Equal(t, "leader", *lease.Spec.HolderIdentity)
+	assert.False(t, standby.IsLeading())
+
+	// The standby takes over once the leader releases the lease.
+	close(leaderStopChan)
+	<-leaderDoneChan
+	assert.Eventually(
+		t,
+		func() bool { return !leader.IsLeading() },
+		time.Second,
+		10*time.Millisecond,
+	)
+	assert.Eventually(t, standby.IsLeading, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package kube
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+// LookupTableFileWatcher reloads a lookup table whenever the contents of its
+// file change, and re-evaluates all nodes against the new table.
+type LookupTableFileWatcher struct {
+	controller *Controller
+	table      *specs.LookupTable
+	path       string
+	logger     *logrus.Entry
+	source     *fileSource
+}
+
+// NewLookupTableFileWatcher loads the lookup table from the file and returns
+// a watcher that keeps it up to date. Returns an error if the initial load
+// fails.
+func NewLookupTableFileWatcher(
+	controller *Controller,
+	table *specs.LookupTable,
+	path string,
+	interval time.Duration,
+) (*LookupTableFileWatcher, error) {
+	watcher := &LookupTableFileWatcher{
+		controller: controller,
+		table:      table,
+		path:       path,
+		logger:     logrus.WithField("table", table.Name()),
+	}
+	source, data, err := newFileSource(path, interval, watcher.logger, watcher.reload)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read lookup table file %s: %w", path, err)
+	}
+	if err := table.Load(path, data); err != nil {
+		return nil, err
+	}
+	watcher.source = source
+	return watcher, nil
+}
+
+// Run polls the lookup table file until the stop channel is signalled.
+func (w *LookupTableFileWatcher) Run(stopCh <-chan struct{}) {
+	w.source.Run(stopCh)
+}
+
+func (w *LookupTableFileWatcher) reload(data []byte) {
+	logger := w.logger.WithField("path", w.path)
+	if err := w.table.Load(w.path, data); err != nil {
+		logger.WithError(err).Error("Invalid lookup table file, keeping previous table")
+		return
+	}
+	logger.Info("Lookup table file changed, re-evaluating nodes")
+	w.controller.requeueAllNodes()
+}
+
+// LookupTableConfigMapWatcher reloads a lookup table whenever a key in a
+// ConfigMap changes, and re-evaluates all nodes against the new table.
+type LookupTableConfigMapWatcher struct {
+	controller *Controller
+	table      *specs.LookupTable
+	key        string
+	logger     *logrus.Entry
+	source     *configMapSource
+}
+
+// NewLookupTableConfigMapWatcher loads the lookup table from the ConfigMap
+// key and returns a watcher that keeps it up to date. The format of the
+// table is selected by the extension of the key. Returns an error if the
+// initial load fails.
+func NewLookupTableConfigMapWatcher(
+	client kubernetes.Interface,
+	controller *Controller,
+	table *specs.LookupTable,
+	namespace string,
+	name string,
+	key string,
+) (*LookupTableConfigMapWatcher, error) {
+	watcher := &LookupTableConfigMapWatcher{
+		controller: controller,
+		table:      table,
+		key:        key,
+		logger: logrus.WithFields(logrus.Fields{
+			"table":     table.Name(),
+			"namespace": namespace,
+			"name":      name,
+		}),
+	}
+	source, data, err := newConfigMapSource(
+		client, namespace, name, key, watcher.logger, watcher.reload)
+	if err != nil {
+		return nil, err
+	}
+	if err := table.Load(key, data); err != nil {
+		return nil, fmt.Errorf("Invalid lookup table in ConfigMap %s/%s: %w", namespace, name, err)
+	}
+	watcher.source = source
+	return watcher, nil
+}
+
+// Run watches the ConfigMap until the stop channel is signalled.
+func (w *LookupTableConfigMapWatcher) Run(stopCh <-chan struct{}) {
+	w.source.Run(stopCh)
+}
+
+func (w *LookupTableConfigMapWatcher) reload(data []byte) {
+	if err := w.table.Load(w.key, data); err != nil {
+		w.logger.WithError(err).Error("Invalid lookup table in ConfigMap, keeping previous table")
+		return
+	}
+	w.logger.Info("Lookup table ConfigMap changed, re-evaluating nodes")
+	w.controller.requeueAllNodes()
+}
@@ -0,0 +1,150 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+func lookupRule(table *specs.LookupTable) string {
+	return fmt.Sprintf(
+		"lookup: {table: %s, key: .metadata.name, default: {rack: unknown}}", table.Name())
+}
+
+func lookupNode(t *testing.T, table *specs.LookupTable, name string) map[string]string {
+	parsedSpecs, err := specs.ParseConfig([]byte(makeRuleConfig("test", lookupRule(table))))
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: name}}
+	return parsedSpecs.ApplyToNode(node).Labels
+}
+
+func TestLookupTableFileWatcherReloads(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "hosts.csv")
+	err := os.WriteFile(fileName, []byte("hostname,rack\nnode-1,r1\n"), 0666)
+	require.NoError(t, err)
+
+	controller, err := NewController(fake.NewSimpleClientset(), nil, Options{})
+	require.NoError(t, err)
+	table := specs.RegisterLookupTable("test-file-watcher")
+	watcher, err := NewLookupTableFileWatcher(controller, table, fileName, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"rack": "r1"}, lookupNode(t, table, "node-1"))
+
+	err = os.WriteFile(fileName, []byte("hostname\n"), 0666)
+	require.NoError(t, err)
+	watcher.source.check()
+	assert.Equal(
+		t,
+		map[string]string{"rack": "r1"},
+		lookupNode(t, table, "node-1"),
+		"Invalid table must not replace previous table",
+	)
+
+	err = os.WriteFile(fileName, []byte("hostname,rack\nnode-1,r2\n"), 0666)
+	require.NoError(t, err)
+	watcher.source.check()
+	assert.Equal(t, map[string]string{"rack": "r2"}, lookupNode(t, table, "node-1"))
+
+	_, err = NewLookupTableFileWatcher(
+		controller, table, filepath.Join(dir, "missing.csv"), time.Second)
+	require.Error(t, err)
+	assert.Regexp(t, "Failed to read lookup table file", err.Error())
+}
+
+func TestLookupTableConfigMapWatcherReloads(t *testing.T) {
+	configMap := &core_v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: "system", Name: "inventory"},
+		Data:       map[string]string{"hosts.yaml": "node-1: {rack: r1}\n"},
+	}
+	fakeClient := fake.NewSimpleClientset(configMap)
+	controller, err := NewController(fakeClient, nil, Options{})
+	require.NoError(t, err)
+	table := specs.RegisterLookupTable("test-config-map-watcher")
+	watcher, err := NewLookupTableConfigMapWatcher(
+		fakeClient, controller, table, "system", "inventory", "hosts.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"rack": "r1"}, lookupNode(t, table, "node-1"))
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go watcher.Run(stopChan)
+
+	configMap = configMap.DeepCopy()
+	configMap.Data["hosts.yaml"] = "node-1: {rack: r2}\n"
+	_, err = fakeClient.CoreV1().ConfigMaps("system").Update(
+		context.TODO(),
+		configMap,
+		meta_v1.UpdateOptions{},
+	)
+	require.NoError(t, err)
+	assert.Eventually(
+		t,
+		func() bool {
+			return lookupNode(t, table, "node-1")["rack"] == "r2"
+		},
+		time.Second,
+		10*time.Millisecond,
+	)
+
+	_, err = NewLookupTableConfigMapWatcher(
+		fakeClient, controller, table, "system", "inventory", "hosts.csv")
+	require.Error(t, err)
+	assert.Regexp(t, "has no key hosts.csv", err.Error())
+}
+
+func TestControllerReportsUnmatchedNodes(t *testing.T) {
+	table := specs.RegisterLookupTable("test-unmatched")
+	require.NoError(t, table.Load("hosts.csv", []byte("hostname,rack\nnode-1,r1\n")))
+	parsedSpecs, err := specs.ParseConfig([]byte(makeRuleConfig("test-unmatched", lookupRule(table))))
+	require.NoError(t, err)
+
+	nodes := []*core_v1.Node{
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "node-2"}},
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "node-3"}},
+	}
+	fakeClient := fake.NewClientset(nodes[0], nodes[1], nodes[2])
+	controller, err := NewController(
+		fakeClient,
+		parsedSpecs,
+		Options{UpdateStrategy: UpdateStrategyPatch},
+	)
+	require.NoError(t, err)
+
+	unmatchedMetric := func() float64 {
+		return testutil.ToFloat64(lookupUnmatchedNodes.WithLabelValues("test-unmatched"))
+	}
+
+	for _, node := range nodes {
+		require.NoError(t, controller.relabelNode(node))
+	}
+	assert.Equal(t, 2.0, unmatchedMetric())
+	updated, err := fakeClient.CoreV1().Nodes().Get(
+		context.TODO(),
+		"node-2",
+		meta_v1.GetOptions{},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"rack": "unknown"}, updated.Labels)
+
+	require.NoError(t, table.Load("hosts.csv", []byte("hostname,rack\nnode-1,r1\nnode-2,r2\n")))
+	require.NoError(t, controller.relabelNode(nodes[1]))
+	assert.Equal(t, 1.0, unmatchedMetric())
+
+	// Deleted nodes are no longer counted.
+	require.NoError(t, controller.syncNode("node-3"))
+	assert.Equal(t, 0.0, unmatchedMetric())
+}
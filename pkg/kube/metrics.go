@@ -0,0 +1,194 @@
+package kube
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/vladlosev/node-relabeler/pkg/metrics"
+)
+
+var (
+	// lookupUnmatchedNodes counts the nodes whose value is missing from the
+	// lookup table of a rule.
+	lookupUnmatchedNodes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "node_relabeler_lookup_unmatched_nodes",
+			Help: "Number of nodes whose value is not found in the lookup table of a rule.",
+		},
+		[]string{"rule"},
+	)
+	// nodeEvents counts the node events received from the informer, by
+	// event type: add, update, or delete.
+	nodeEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "node_relabeler_node_events_total",
+			Help: "Number of node events received, by event type.",
+		},
+		[]string{"event"},
+	)
+	// labelsAdded counts the labels set or changed on nodes, by the rule
+	// producing them.
+	labelsAdded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "node_relabeler_labels_added_total",
+			Help: "Number of labels set or changed on nodes, by rule.",
+		},
+		[]string{"rule"},
+	)
+	// labelsRemoved counts the labels removed from nodes, by the rule
+	// removing them or the rule that produced them earlier.
+	labelsRemoved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "node_relabeler_labels_removed_total",
+			Help: "Number of labels removed from nodes, by rule.",
+		},
+		[]string{"rule"},
+	)
+	// dryRunLabelChanges counts the label changes pending on nodes because
+	// the controller runs in dry run mode, by rule and change: set or remove.
+	dryRunLabelChanges = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "node_relabeler_dry_run_label_changes",
+			Help: "Number of label changes pending on nodes in dry run mode, by rule and change.",
+		},
+		[]string{"rule", "change"},
+	)
+	// nodeUpdates counts the writes to nodes, by result: success, conflict,
+	// or error.
+	nodeUpdates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "node_relabeler_node_updates_total",
+			Help: "Number of node updates sent to the API server, by result.",
+		},
+		[]string{"result"},
+	)
+	// informerSynced is 1 for the informers whose caches are synced and 0
+	// for the ones still syncing.
+	informerSynced = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "node_relabeler_informer_synced",
+			Help: "Whether the cache of an informer is synced (1) or not (0).",
+		},
+		[]string{"informer"},
+	)
+	// nodesOutOfCompliance counts the nodes whose labels, taints, or
+	// annotations do not match the rules, because writing them has failed or
+	// the controller runs in dry run mode.
+	nodesOutOfCompliance = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "node_relabeler_nodes_out_of_compliance",
+			Help: "Number of nodes whose labels, taints, or annotations do not match the rules.",
+		},
+	)
+)
+
+// Node update results in the nodeUpdates metric.
+const (
+	updateResultSuccess  = "success"
+	updateResultConflict = "conflict"
+	updateResultError    = "error"
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		lookupUnmatchedNodes,
+		nodeEvents,
+		labelsAdded,
+		labelsRemoved,
+		dryRunLabelChanges,
+		nodeUpdates,
+		informerSynced,
+		nodesOutOfCompliance,
+	)
+	// The provider only applies to the queues created after it is set.
+	workqueue.SetProvider(newWorkqueueMetricsProvider(metrics.Registry))
+}
+
+// workqueueMetricsProvider exports the metrics of the work queues, such as
+// the node queue's depth and latency, with the queue name in the name label.
+// The metric names are the same as in the Kubernetes components.
+type workqueueMetricsProvider struct {
+	depth                   *prometheus.GaugeVec
+	adds                    *prometheus.CounterVec
+	latency                 *prometheus.HistogramVec
+	workDuration            *prometheus.HistogramVec
+	unfinishedWork          *prometheus.GaugeVec
+	longestRunningProcessor *prometheus.GaugeVec
+	retries                 *prometheus.CounterVec
+}
+
+// newWorkqueueMetricsProvider constructs a workqueueMetricsProvider and
+// registers its metrics in the registry.
+func newWorkqueueMetricsProvider(registry prometheus.Registerer) *workqueueMetricsProvider {
+	buckets := prometheus.ExponentialBuckets(10e-9, 10, 12)
+	provider := &workqueueMetricsProvider{
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "workqueue_depth",
+			Help: "Current depth of the work queue.",
+		}, []string{"name"}),
+		adds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "workqueue_adds_total",
+			Help: "Number of items added to the work queue.",
+		}, []string{"name"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "workqueue_queue_duration_seconds",
+			Help:    "Time in seconds an item stays in the work queue before being processed.",
+			Buckets: buckets,
+		}, []string{"name"}),
+		workDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "workqueue_work_duration_seconds",
+			Help:    "Time in seconds processing an item from the work queue takes.",
+			Buckets: buckets,
+		}, []string{"name"}),
+		unfinishedWork: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "workqueue_unfinished_work_seconds",
+			Help: "Time in seconds the items being processed have been in progress.",
+		}, []string{"name"}),
+		longestRunningProcessor: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "workqueue_longest_running_processor_seconds",
+			Help: "Time in seconds the longest running item has been in progress.",
+		}, []string{"name"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "workqueue_retries_total",
+			Help: "Number of retries of items in the work queue.",
+		}, []string{"name"}),
+	}
+	registry.MustRegister(
+		provider.depth,
+		provider.adds,
+		provider.latency,
+		provider.workDuration,
+		provider.unfinishedWork,
+		provider.longestRunningProcessor,
+		provider.retries,
+	)
+	return provider
+}
+
+func (p *workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return p.depth.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return p.adds.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return p.latency.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return p.workDuration.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.unfinishedWork.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.longestRunningProcessor.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return p.retries.WithLabelValues(name)
+}
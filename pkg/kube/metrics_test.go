@@ -0,0 +1,138 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	go_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vladlosev/node-relabeler/pkg/metrics"
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+func TestControllerMetrics(t *testing.T) {
+	parsedSpecs, err := specs.ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: test-metrics
+  match: {key: abc, value: def}
+  set: {key: uvw, value: xyz}
+`))
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"abc": "def"},
+	}}
+	fakeClient := fake.NewClientset(node)
+	attempts := 0
+	fakeClient.PrependReactor(
+		"patch",
+		"nodes",
+		func(action go_testing.Action) (bool, runtime.Object, error) {
+			attempts++
+			if attempts == 1 {
+				return true, nil, fmt.Errorf("Transient error")
+			}
+			return false, nil, nil
+		},
+	)
+	controller, err := NewController(
+		fakeClient,
+		parsedSpecs,
+		Options{UpdateStrategy: UpdateStrategyPatch},
+	)
+	require.NoError(t, err)
+
+	// The counters are shared by all the tests, so only check how they
+	// change.
+	counters := map[string]func() float64{
+		"add": func() float64 {
+			return testutil.ToFloat64(nodeEvents.WithLabelValues("add"))
+		},
+		"update": func() float64 {
+			return testutil.ToFloat64(nodeEvents.WithLabelValues("update"))
+		},
+		"delete": func() float64 {
+			return testutil.ToFloat64(nodeEvents.WithLabelValues("delete"))
+		},
+		"success": func() float64 {
+			return testutil.ToFloat64(nodeUpdates.WithLabelValues(updateResultSuccess))
+		},
+		"error": func() float64 {
+			return testutil.ToFloat64(nodeUpdates.WithLabelValues(updateResultError))
+		},
+		"added": func() float64 {
+			return testutil.ToFloat64(labelsAdded.WithLabelValues("test-metrics"))
+		},
+		"removed": func() float64 {
+			return testutil.ToFloat64(labelsRemoved.WithLabelValues("test-metrics"))
+		},
+	}
+	initial := map[string]float64{}
+	for name, counter := range counters {
+		initial[name] = counter()
+	}
+	assertCounters := func(expected map[string]float64) {
+		t.Helper()
+		for name, counter := range counters {
+			assert.Equal(t, expected[name], counter()-initial[name], name)
+		}
+	}
+
+	require.Error(t, controller.relabelNode(node))
+	assertCounters(map[string]float64{"error": 1})
+	assert.Equal(t, 1.0, testutil.ToFloat64(nodesOutOfCompliance))
+
+	require.NoError(t, controller.relabelNode(node))
+	assertCounters(map[string]float64{"error": 1, "success": 1, "added": 1})
+	assert.Equal(t, 0.0, testutil.ToFloat64(nodesOutOfCompliance))
+
+	updated, err := fakeClient.CoreV1().Nodes().Get(
+		context.TODO(),
+		node.Name,
+		meta_v1.GetOptions{},
+	)
+	require.NoError(t, err)
+	updated.Labels["abc"] = "other"
+	require.NoError(t, controller.relabelNode(updated))
+	assertCounters(map[string]float64{"error": 1, "success": 2, "added": 1, "removed": 1})
+
+	controller.addNode(node)
+	controller.updateNode(node, updated)
+	controller.deleteNode(cache.DeletedFinalStateUnknown{Key: "deleted-node", Obj: node})
+	assertCounters(map[string]float64{
+		"error":   1,
+		"success": 2,
+		"added":   1,
+		"removed": 1,
+		"add":     1,
+		"update":  1,
+		"delete":  1,
+	})
+	assert.Equal(t, 2, controller.queue.Len())
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	require.NoError(t, controller.startInformers(stopChan, stopChan))
+	assert.Equal(t, 1.0, testutil.ToFloat64(informerSynced.WithLabelValues("nodes")))
+
+	// The node queue reports its metrics through the workqueue provider.
+	count, err := testutil.GatherAndCount(
+		metrics.Registry,
+		"workqueue_depth",
+		"workqueue_adds_total",
+		"workqueue_queue_duration_seconds",
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
@@ -0,0 +1,461 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	apply_core_v1 "k8s.io/client-go/applyconfigurations/core/v1"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+// ManagedLabelsAnnotation is the node annotation where the controller
+// records the labels it has created, as a JSON object mapping label keys to
+// the names of the rules that produced them. Only these labels are removed
+// when no rule produces them anymore.
+const ManagedLabelsAnnotation = "node-relabeler.vladlosev.github.io/managed-labels"
+
+// ManagedTaintsAnnotation is the node annotation where the controller
+// records the taints it has created, as a JSON object mapping taint IDs (the
+// key and the effect separated by a colon) to the names of the rules that
+// produced them.
+const ManagedTaintsAnnotation = "node-relabeler.vladlosev.github.io/managed-taints"
+
+// ManagedAnnotationsAnnotation is the node annotation where the controller
+// records the annotations it has created, mapped to the names of the rules
+// that produced them.
+const ManagedAnnotationsAnnotation = "node-relabeler.vladlosev.github.io/managed-annotations"
+
+// nodeUpdate describes the changes to make to a node.
+type nodeUpdate struct {
+	// labels are the changes to the node's labels.
+	labels ownedChanges
+	// taints are the changes to the node's taints, keyed by taint ID.
+	taints ownedChanges
+	// annotations are the changes to the node's annotations, other than the
+	// managed labels, taints, and annotations annotations.
+	annotations ownedChanges
+}
+
+// ownedChanges describes the changes to make to the labels or the taints of
+// a node.
+type ownedChanges struct {
+	// values are all the values produced by the specs.
+	values map[string]string
+	// changed are the values that are missing on the node or differ there.
+	changed map[string]string
+	// removed are the keys of the values to remove: the managed values that
+	// no rule produces anymore and the values removed by the rules.
+	removed []string
+	// rules maps the changed and the removed keys to the rules changing
+	// them, or the rules that produced the removed managed values.
+	rules map[string]string
+	// managed are the values owned by the controller after the update,
+	// mapped to the rules that produce them.
+	managed map[string]string
+	// managedChanged is set if managed differs from the node's annotation.
+	managedChanged bool
+}
+
+// newNodeUpdate computes the changes needed to bring the node in line with
+// the result of applying the specs to it. The values owned by rules that
+// failed are kept as they are.
+func newNodeUpdate(node *core_v1.Node, result specs.Result) nodeUpdate {
+	taints := taintValues(node)
+	failed := map[string]bool{}
+	for _, rule := range result.Failed {
+		failed[rule] = true
+	}
+	return nodeUpdate{
+		labels: newOwnedChanges(
+			node, "label", node.Labels, ManagedLabelsAnnotation, result.LabelChanges(), failed),
+		taints: newOwnedChanges(
+			node, "taint", taints, ManagedTaintsAnnotation, result.Taints, failed),
+		annotations: newOwnedChanges(
+			node, "annotation", node.Annotations, ManagedAnnotationsAnnotation,
+			withoutManagedAnnotations(node, result.Annotations), failed),
+	}
+}
+
+// taintValues returns the values of the node's taints by taint ID.
+func taintValues(node *core_v1.Node) map[string]string {
+	taints := map[string]string{}
+	for _, taint := range node.Spec.Taints {
+		taints[specs.TaintID(taint.Key, string(taint.Effect))] = taint.Value
+	}
+	return taints
+}
+
+// withoutManagedAnnotations returns the annotation changes without the
+// annotations the controller uses to record its own state.
+func withoutManagedAnnotations(node *core_v1.Node, changes specs.Changes) specs.Changes {
+	filtered := specs.Changes{
+		Set:     map[string]string{},
+		Rules:   changes.Rules,
+		Moved:   changes.Moved,
+		Removed: map[string]string{},
+	}
+	for key, value := range changes.Set {
+		if isManagedAnnotation(key) {
+			logrus.WithFields(logrus.Fields{
+				"node": node.Name,
+				"key":  key,
+				"rule": changes.Rules[key],
+			}).Warn("Rules cannot set the relabeler's own annotations, ignoring")
+			continue
+		}
+		filtered.Set[key] = value
+	}
+	for key, rule := range changes.Removed {
+		if !isManagedAnnotation(key) {
+			filtered.Removed[key] = rule
+		}
+	}
+	return filtered
+}
+
+// isManagedAnnotation returns true if the annotation records the values
+// owned by the controller.
+func isManagedAnnotation(key string) bool {
+	return key == ManagedLabelsAnnotation ||
+		key == ManagedTaintsAnnotation ||
+		key == ManagedAnnotationsAnnotation
+}
+
+// newOwnedChanges computes the changes needed to bring the current values
+// of the node in line with the changes produced by the specs. The values
+// owned by the controller are recorded in the annotation. The values owned
+// by the failed rules stay owned and are not removed.
+func newOwnedChanges(
+	node *core_v1.Node,
+	kind string,
+	current map[string]string,
+	annotation string,
+	changes specs.Changes,
+	failed map[string]bool,
+) ownedChanges {
+	previous := managedValues(node, annotation)
+	update := ownedChanges{
+		values:  changes.Set,
+		changed: map[string]string{},
+		managed: map[string]string{},
+		rules:   map[string]string{},
+	}
+	for key, value := range changes.Set {
+		oldValue, ok := current[key]
+		// Values that already exist on the node belong to whoever created
+		// them, unless the controller has created them itself earlier. Moved
+		// values take over from the old ones and are not owned either.
+		if _, wasManaged := previous[key]; !changes.Moved[key] && (wasManaged || !ok) {
+			update.managed[key] = changes.Rules[key]
+		}
+		if !ok || value != oldValue {
+			fields := logrus.Fields{
+				"node":     node.Name,
+				"key":      key,
+				"newValue": value,
+				"rule":     changes.Rules[key],
+			}
+			if ok {
+				fields["oldValue"] = oldValue
+			}
+			logrus.WithFields(fields).Debug("Updated node " + kind)
+			update.changed[key] = value
+			update.rules[key] = changes.Rules[key]
+		}
+	}
+	removed := map[string]string{}
+	for key, rule := range previous {
+		if _, ok := changes.Set[key]; ok {
+			continue
+		}
+		if failed[rule] {
+			update.managed[key] = rule
+			continue
+		}
+		removed[key] = rule
+	}
+	for key, rule := range changes.Removed {
+		removed[key] = rule
+	}
+	for key, rule := range removed {
+		if oldValue, ok := current[key]; ok {
+			logrus.WithFields(logrus.Fields{
+				"node":     node.Name,
+				"key":      key,
+				"oldValue": oldValue,
+				"rule":     rule,
+			}).Debug("Removed node " + kind)
+			update.removed = append(update.removed, key)
+			update.rules[key] = rule
+		}
+	}
+	sort.Strings(update.removed)
+	update.managedChanged = encodeManaged(update.managed) != node.Annotations[annotation]
+	return update
+}
+
+// empty returns true if the update does not change anything.
+func (u nodeUpdate) empty() bool {
+	return u.labels.empty() && u.taints.empty() && u.annotations.empty()
+}
+
+// empty returns true if the changes do not change anything.
+func (c ownedChanges) empty() bool {
+	return len(c.changed) == 0 && len(c.removed) == 0 && !c.managedChanged
+}
+
+// managedValues returns the values recorded in one of the node's managed
+// labels, taints, or annotations annotations.
+func managedValues(node *core_v1.Node, annotation string) map[string]string {
+	managed := map[string]string{}
+	value, ok := node.Annotations[annotation]
+	if !ok || value == "" {
+		return managed
+	}
+	if err := json.Unmarshal([]byte(value), &managed); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"node":       node.Name,
+			"annotation": annotation,
+		}).WithError(err).Warn("Invalid managed values annotation, ignoring")
+		return map[string]string{}
+	}
+	return managed
+}
+
+// encodeManaged returns the value of a managed labels, taints, or
+// annotations annotation for the values, or an empty string if there are
+// none.
+func encodeManaged(managed map[string]string) string {
+	if len(managed) == 0 {
+		return ""
+	}
+	// Maps are marshalled with sorted keys, so the encoding is stable.
+	data, err := json.Marshal(managed)
+	if err != nil {
+		// Marshalling a map of strings cannot fail.
+		panic(err)
+	}
+	return string(data)
+}
+
+// managedAnnotations returns the managed labels, taints, and annotations
+// annotations to write for the update, with empty values for the
+// annotations to remove.
+func (u nodeUpdate) managedAnnotations() map[string]string {
+	return map[string]string{
+		ManagedLabelsAnnotation:      encodeManaged(u.labels.managed),
+		ManagedTaintsAnnotation:      encodeManaged(u.taints.managed),
+		ManagedAnnotationsAnnotation: encodeManaged(u.annotations.managed),
+	}
+}
+
+// updatedTaints returns the taints of the node with the update applied.
+func (u nodeUpdate) updatedTaints(node *core_v1.Node) []core_v1.Taint {
+	removed := map[string]bool{}
+	for _, id := range u.taints.removed {
+		removed[id] = true
+	}
+	taints := []core_v1.Taint{}
+	seen := map[string]bool{}
+	for _, taint := range node.Spec.Taints {
+		id := specs.TaintID(taint.Key, string(taint.Effect))
+		if removed[id] {
+			continue
+		}
+		if value, ok := u.taints.changed[id]; ok {
+			taint.Value = value
+		}
+		seen[id] = true
+		taints = append(taints, taint)
+	}
+	for _, id := range sortedKeys(u.taints.changed) {
+		if !seen[id] {
+			taints = append(taints, newTaint(id, u.taints.changed[id]))
+		}
+	}
+	return taints
+}
+
+// newTaint returns the taint with the ID and the value.
+func newTaint(id string, value string) core_v1.Taint {
+	key, effect := specs.ParseTaintID(id)
+	return core_v1.Taint{Key: key, Value: value, Effect: core_v1.TaintEffect(effect)}
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeNode writes the update to the node using the configured update
+// strategy.
+func (c *Controller) writeNode(node *core_v1.Node, update nodeUpdate) error {
+	if c.options.UpdateStrategy == UpdateStrategyPatch {
+		return c.patchNode(node, update)
+	}
+	return c.applyNode(node, update)
+}
+
+// patchNode writes the changed and removed labels, annotations, and taints
+// to the node with a JSON merge patch.
+func (c *Controller) patchNode(node *core_v1.Node, update nodeUpdate) error {
+	labels := map[string]interface{}{}
+	for key, value := range update.labels.changed {
+		labels[key] = value
+	}
+	for _, key := range update.labels.removed {
+		labels[key] = nil
+	}
+	annotations := map[string]interface{}{}
+	for key, value := range update.annotations.changed {
+		annotations[key] = value
+	}
+	for _, key := range update.annotations.removed {
+		annotations[key] = nil
+	}
+	bookkeeping := false
+	for annotation, value := range update.managedAnnotations() {
+		if value == node.Annotations[annotation] {
+			continue
+		}
+		bookkeeping = true
+		if value == "" {
+			annotations[annotation] = nil
+		} else {
+			annotations[annotation] = value
+		}
+	}
+	metadata := map[string]interface{}{
+		"labels":      labels,
+		"annotations": annotations,
+	}
+	patchData := map[string]interface{}{"metadata": metadata}
+	taints := len(update.taints.changed) > 0 || len(update.taints.removed) > 0
+	if taints {
+		// Merge patches replace lists, so the patch has to include all the
+		// taints of the node.
+		patchData["spec"] = map[string]interface{}{
+			"taints": update.updatedTaints(node),
+		}
+	}
+	if taints || bookkeeping {
+		// The taints and the bookkeeping annotations are computed from the
+		// node as we have seen it, so the resource version makes the API
+		// server reject the patch if the node has changed since. Label
+		// changes alone are sent without it, so that they do not conflict
+		// with the kubelet's status updates.
+		metadata["resourceVersion"] = node.ResourceVersion
+	}
+	patch, err := json.Marshal(patchData)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.CoreV1().Nodes().Patch(
+		context.TODO(),
+		node.Name,
+		types.MergePatchType,
+		patch,
+		meta_v1.PatchOptions{FieldManager: FieldManager, DryRun: c.dryRunOption()})
+	return err
+}
+
+// applyNode writes all the labels and annotations owned by the controller to
+// the node with server-side apply. Taint changes are written with a JSON
+// merge patch.
+func (c *Controller) applyNode(node *core_v1.Node, update nodeUpdate) error {
+	if len(update.taints.changed) > 0 || len(update.taints.removed) > 0 {
+		// The taints are an atomic list, so applying them would take over
+		// the ownership of the taints set by other components.
+		logrus.WithField("node", node.Name).Debug(
+			"Taints are changed, patching node instead")
+		return c.patchNode(node, update)
+	}
+	// With server-side apply, the applied configuration has to include all
+	// the labels we want to own, not only the changed ones. Labels left out
+	// of it are removed if no other field manager owns them, so keep the
+	// ones applied earlier unless they are being removed.
+	previous, err := apply_core_v1.ExtractNode(node, FieldManager)
+	if err != nil {
+		return err
+	}
+	removed := map[string]bool{}
+	for _, key := range update.labels.removed {
+		// Leaving a label out of the applied configuration cannot remove it
+		// unless it has been applied by us before.
+		if _, ok := previous.Labels[key]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"node": node.Name,
+				"key":  key,
+			}).Debug("Removed label is not applied by the relabeler, patching node instead")
+			return c.patchNode(node, update)
+		}
+		removed[key] = true
+	}
+	removedAnnotations := map[string]bool{}
+	for _, key := range update.annotations.removed {
+		if _, ok := previous.Annotations[key]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"node": node.Name,
+				"key":  key,
+			}).Debug("Removed annotation is not applied by the relabeler, patching node instead")
+			return c.patchNode(node, update)
+		}
+		removedAnnotations[key] = true
+	}
+	managedAnnotations := update.managedAnnotations()
+	for annotation, value := range managedAnnotations {
+		if _, ok := node.Annotations[annotation]; ok && value == "" {
+			if _, applied := previous.Annotations[annotation]; !applied {
+				return c.patchNode(node, update)
+			}
+		}
+		if value == "" {
+			delete(managedAnnotations, annotation)
+		}
+	}
+	labels := map[string]string{}
+	for key := range previous.Labels {
+		if value, ok := node.Labels[key]; ok && !removed[key] {
+			labels[key] = value
+		}
+	}
+	for key, value := range update.labels.values {
+		labels[key] = value
+	}
+	annotations := map[string]string{}
+	for key := range previous.Annotations {
+		value, ok := node.Annotations[key]
+		if ok && !removedAnnotations[key] && !isManagedAnnotation(key) {
+			annotations[key] = value
+		}
+	}
+	for key, value := range update.annotations.values {
+		annotations[key] = value
+	}
+	for key, value := range managedAnnotations {
+		annotations[key] = value
+	}
+	applyConfig := apply_core_v1.Node(node.Name).WithLabels(labels)
+	if len(annotations) > 0 {
+		applyConfig.WithAnnotations(annotations)
+	}
+	_, err = c.client.CoreV1().Nodes().Apply(
+		context.TODO(),
+		applyConfig,
+		meta_v1.ApplyOptions{
+			FieldManager: FieldManager,
+			Force:        c.options.ForceConflicts,
+			DryRun:       c.dryRunOption(),
+		})
+	return err
+}
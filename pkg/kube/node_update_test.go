@@ -0,0 +1,574 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	go_testing "k8s.io/client-go/testing"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+func TestNewNodeUpdateOwnership(t *testing.T) {
+	parsedSpecs, err := specs.Parse([]string{"role=*:node-role.kubernetes.io/*=", "abc=def:abc=xyz"})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name: "test-node",
+		Labels: map[string]string{
+			"role":                          "gpu",
+			"abc":                           "def",
+			"node-role.kubernetes.io/stale": "",
+			"node-role.kubernetes.io/other": "",
+		},
+		Annotations: map[string]string{
+			ManagedLabelsAnnotation: `{"node-role.kubernetes.io/stale":"old-rule","gone":"old-rule"}`,
+		},
+	}}
+
+	update := newNodeUpdate(node, parsedSpecs.Apply(node.Labels))
+	assert.Equal(
+		t,
+		map[string]string{"node-role.kubernetes.io/gpu": "", "abc": "xyz"},
+		update.labels.changed,
+	)
+	// The replaced label existed before, so it is not owned by the relabeler.
+	assert.Equal(
+		t,
+		map[string]string{"node-role.kubernetes.io/gpu": "role=*:node-role.kubernetes.io/*="},
+		update.labels.managed,
+	)
+	// Labels that are not managed are never removed, and managed labels
+	// that are already gone need no removal.
+	assert.Equal(t, []string{"node-role.kubernetes.io/stale"}, update.labels.removed)
+	assert.True(t, update.labels.managedChanged)
+	assert.False(t, update.empty())
+}
+
+func TestNewNodeUpdateNoChanges(t *testing.T) {
+	parsedSpecs, err := specs.Parse([]string{"role=*:node-role.kubernetes.io/*="})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name: "test-node",
+		Labels: map[string]string{
+			"role":                        "gpu",
+			"node-role.kubernetes.io/gpu": "",
+		},
+		Annotations: map[string]string{
+			ManagedLabelsAnnotation: `{"node-role.kubernetes.io/gpu":"role=*:node-role.kubernetes.io/*="}`,
+		},
+	}}
+
+	update := newNodeUpdate(node, parsedSpecs.Apply(node.Labels))
+	assert.True(t, update.empty())
+}
+
+func TestNewNodeUpdateInvalidAnnotation(t *testing.T) {
+	parsedSpecs, err := specs.Parse([]string{"role=*:node-role.kubernetes.io/*="})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:        "test-node",
+		Labels:      map[string]string{"abc": "def"},
+		Annotations: map[string]string{ManagedLabelsAnnotation: "not json"},
+	}}
+
+	update := newNodeUpdate(node, parsedSpecs.Apply(node.Labels))
+	assert.Empty(t, update.labels.removed)
+	assert.True(t, update.labels.managedChanged)
+}
+
+func TestControllerRemovesOwnedLabels(t *testing.T) {
+	strategies := []UpdateStrategy{UpdateStrategyApply, UpdateStrategyPatch}
+	for _, strategy := range strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			parsedSpecs, err := specs.Parse([]string{"role=*:node-role.kubernetes.io/*="})
+			require.NoError(t, err)
+			node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+				Name: "test-node",
+				Labels: map[string]string{
+					"role":                        "gpu",
+					"node-role.kubernetes.io/cpu": "",
+				},
+			}}
+			fakeClient := fake.NewClientset(node)
+			controller, err := NewController(
+				fakeClient,
+				parsedSpecs,
+				Options{UpdateStrategy: strategy},
+			)
+			require.NoError(t, err)
+
+			getNode := func() *core_v1.Node {
+				updated, err := fakeClient.CoreV1().Nodes().Get(
+					context.TODO(),
+					node.Name,
+					meta_v1.GetOptions{},
+				)
+				require.NoError(t, err)
+				return updated
+			}
+
+			require.NoError(t, controller.relabelNode(getNode()))
+			updated := getNode()
+			assert.Contains(t, updated.Labels, "node-role.kubernetes.io/gpu")
+			assert.Equal(
+				t,
+				`{"node-role.kubernetes.io/gpu":"role=*:node-role.kubernetes.io/*="}`,
+				updated.Annotations[ManagedLabelsAnnotation],
+			)
+
+			// Switch the source label. The label derived from the old value
+			// goes away, but the pre-existing label is left alone.
+			updated.Labels["role"] = "cpu"
+			_, err = fakeClient.CoreV1().Nodes().Update(
+				context.TODO(),
+				updated,
+				meta_v1.UpdateOptions{FieldManager: "test"},
+			)
+			require.NoError(t, err)
+			require.NoError(t, controller.relabelNode(getNode()))
+			updated = getNode()
+			assert.NotContains(t, updated.Labels, "node-role.kubernetes.io/gpu")
+			assert.Contains(t, updated.Labels, "node-role.kubernetes.io/cpu")
+			assert.NotContains(t, updated.Annotations, ManagedLabelsAnnotation)
+
+			// Removing the source label altogether keeps the label the
+			// relabeler did not create.
+			delete(updated.Labels, "role")
+			_, err = fakeClient.CoreV1().Nodes().Update(
+				context.TODO(),
+				updated,
+				meta_v1.UpdateOptions{FieldManager: "test"},
+			)
+			require.NoError(t, err)
+			require.NoError(t, controller.relabelNode(getNode()))
+			updated = getNode()
+			assert.Contains(t, updated.Labels, "node-role.kubernetes.io/cpu")
+		})
+	}
+}
+
+func TestControllerRemovesLabels(t *testing.T) {
+	testData := []struct {
+		name     string
+		spec     string
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{
+			"Delete",
+			"-deprecated=*",
+			map[string]string{"deprecated": "abc", "abc": "def"},
+			map[string]string{"abc": "def"},
+		},
+		{
+			"Move",
+			"-old.example.com/*=true:new.example.com/*=true",
+			map[string]string{"old.example.com/gpu": "true", "abc": "def"},
+			map[string]string{"new.example.com/gpu": "true", "abc": "def"},
+		},
+	}
+	strategies := []UpdateStrategy{UpdateStrategyApply, UpdateStrategyPatch}
+	for _, strategy := range strategies {
+		for _, testItem := range testData {
+			t.Run(string(strategy)+testItem.name, func(t *testing.T) {
+				parsedSpecs, err := specs.Parse([]string{testItem.spec})
+				require.NoError(t, err)
+				node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+					Name:   "test-node",
+					Labels: testItem.labels,
+				}}
+				fakeClient := fake.NewClientset(node)
+				controller, err := NewController(
+					fakeClient,
+					parsedSpecs,
+					Options{UpdateStrategy: strategy},
+				)
+				require.NoError(t, err)
+
+				require.NoError(t, controller.relabelNode(node))
+				updated, err := fakeClient.CoreV1().Nodes().Get(
+					context.TODO(),
+					node.Name,
+					meta_v1.GetOptions{},
+				)
+				require.NoError(t, err)
+				assert.Equal(t, testItem.expected, updated.Labels)
+				// Neither deleted nor moved labels are owned by the relabeler.
+				assert.NotContains(t, updated.Annotations, ManagedLabelsAnnotation)
+
+				update := newNodeUpdate(updated, parsedSpecs.Apply(updated.Labels))
+				assert.True(t, update.empty())
+			})
+		}
+	}
+}
+
+func TestControllerLabelsFromNodeFields(t *testing.T) {
+	parsedSpecs, err := specs.ParseRegex([]string{
+		`\.status\.nodeInfo\.containerRuntimeVersion=(\w+)\://.*:runtime=$1`,
+	})
+	require.NoError(t, err)
+	node := &core_v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "test-node"},
+		Status: core_v1.NodeStatus{NodeInfo: core_v1.NodeSystemInfo{
+			ContainerRuntimeVersion: "containerd://1.7.2",
+		}},
+	}
+	fakeClient := fake.NewClientset(node)
+	controller, err := NewController(
+		fakeClient,
+		parsedSpecs,
+		Options{UpdateStrategy: UpdateStrategyPatch},
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, controller.relabelNode(node))
+	updated, err := fakeClient.CoreV1().Nodes().Get(
+		context.TODO(),
+		node.Name,
+		meta_v1.GetOptions{},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"runtime": "containerd"}, updated.Labels)
+}
+
+func TestControllerManagesTaints(t *testing.T) {
+	strategies := []UpdateStrategy{UpdateStrategyApply, UpdateStrategyPatch}
+	for _, strategy := range strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			parsedSpecs, err := specs.Parse([]string{
+				"dedicated=*:dedicated=*@NoSchedule",
+				"-legacy=*@*",
+			})
+			require.NoError(t, err)
+			otherTaint := core_v1.Taint{Key: "other", Value: "x", Effect: core_v1.TaintEffectNoSchedule}
+			node := &core_v1.Node{
+				ObjectMeta: meta_v1.ObjectMeta{
+					Name:   "test-node",
+					Labels: map[string]string{"dedicated": "gpu"},
+				},
+				Spec: core_v1.NodeSpec{Taints: []core_v1.Taint{
+					otherTaint,
+					{Key: "legacy", Effect: core_v1.TaintEffectNoExecute},
+				}},
+			}
+			fakeClient := fake.NewClientset(node)
+			controller, err := NewController(
+				fakeClient,
+				parsedSpecs,
+				Options{UpdateStrategy: strategy},
+			)
+			require.NoError(t, err)
+
+			getNode := func() *core_v1.Node {
+				updated, err := fakeClient.CoreV1().Nodes().Get(
+					context.TODO(),
+					node.Name,
+					meta_v1.GetOptions{},
+				)
+				require.NoError(t, err)
+				return updated
+			}
+			updateNode := func(node *core_v1.Node) {
+				_, err := fakeClient.CoreV1().Nodes().Update(
+					context.TODO(),
+					node,
+					meta_v1.UpdateOptions{FieldManager: "test"},
+				)
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, controller.relabelNode(getNode()))
+			updated := getNode()
+			assert.ElementsMatch(
+				t,
+				[]core_v1.Taint{
+					otherTaint,
+					{Key: "dedicated", Value: "gpu", Effect: core_v1.TaintEffectNoSchedule},
+				},
+				updated.Spec.Taints,
+			)
+			assert.Equal(
+				t,
+				`{"dedicated:NoSchedule":"dedicated=*:dedicated=*@NoSchedule"}`,
+				updated.Annotations[ManagedTaintsAnnotation],
+			)
+			assert.Equal(t, map[string]string{"dedicated": "gpu"}, updated.Labels)
+
+			// Changing the source label updates the taint value.
+			updated.Labels["dedicated"] = "cpu"
+			updateNode(updated)
+			require.NoError(t, controller.relabelNode(getNode()))
+			updated = getNode()
+			assert.ElementsMatch(
+				t,
+				[]core_v1.Taint{
+					otherTaint,
+					{Key: "dedicated", Value: "cpu", Effect: core_v1.TaintEffectNoSchedule},
+				},
+				updated.Spec.Taints,
+			)
+
+			// Removing the source label removes the owned taint only.
+			delete(updated.Labels, "dedicated")
+			updateNode(updated)
+			require.NoError(t, controller.relabelNode(getNode()))
+			updated = getNode()
+			assert.Equal(t, []core_v1.Taint{otherTaint}, updated.Spec.Taints)
+			assert.NotContains(t, updated.Annotations, ManagedTaintsAnnotation)
+
+			update := newNodeUpdate(updated, parsedSpecs.ApplyToNode(updated))
+			assert.True(t, update.empty())
+		})
+	}
+}
+
+func TestControllerManagesAnnotations(t *testing.T) {
+	strategies := []UpdateStrategy{UpdateStrategyApply, UpdateStrategyPatch}
+	for _, strategy := range strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			parsedSpecs, err := specs.Parse([]string{
+				"role=*:example.com/role=*@annotation",
+				"-legacy=*@annotation",
+			})
+			require.NoError(t, err)
+			node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+				Name:        "test-node",
+				Labels:      map[string]string{"role": "gpu"},
+				Annotations: map[string]string{"other": "x", "legacy": "y"},
+			}}
+			fakeClient := fake.NewClientset(node)
+			controller, err := NewController(
+				fakeClient,
+				parsedSpecs,
+				Options{UpdateStrategy: strategy},
+			)
+			require.NoError(t, err)
+
+			getNode := func() *core_v1.Node {
+				updated, err := fakeClient.CoreV1().Nodes().Get(
+					context.TODO(),
+					node.Name,
+					meta_v1.GetOptions{},
+				)
+				require.NoError(t, err)
+				return updated
+			}
+
+			require.NoError(t, controller.relabelNode(getNode()))
+			updated := getNode()
+			assert.Equal(
+				t,
+				map[string]string{
+					"other":            "x",
+					"example.com/role": "gpu",
+					ManagedAnnotationsAnnotation: `{"example.com/role":` +
+						`"role=*:example.com/role=*@annotation"}`,
+				},
+				updated.Annotations,
+			)
+			assert.Equal(t, map[string]string{"role": "gpu"}, updated.Labels)
+
+			// Removing the source label removes the owned annotation only.
+			delete(updated.Labels, "role")
+			_, err = fakeClient.CoreV1().Nodes().Update(
+				context.TODO(),
+				updated,
+				meta_v1.UpdateOptions{FieldManager: "test"},
+			)
+			require.NoError(t, err)
+			require.NoError(t, controller.relabelNode(getNode()))
+			updated = getNode()
+			assert.Equal(t, map[string]string{"other": "x"}, updated.Annotations)
+
+			update := newNodeUpdate(updated, parsedSpecs.ApplyToNode(updated))
+			assert.True(t, update.empty())
+		})
+	}
+}
+
+func TestNewNodeUpdateIgnoresManagedAnnotations(t *testing.T) {
+	parsedSpecs, err := specs.Parse([]string{
+		"role=*:" + ManagedLabelsAnnotation + "=*@annotation",
+		"-" + ManagedLabelsAnnotation + "=*@annotation",
+	})
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"role": "gpu"},
+		Annotations: map[string]string{
+			ManagedLabelsAnnotation: `{"abc":"def"}`,
+		},
+	}}
+
+	update := newNodeUpdate(node, parsedSpecs.ApplyToNode(node))
+	assert.Empty(t, update.annotations.changed)
+	assert.Empty(t, update.annotations.removed)
+}
+
+func TestControllerKeepsLabelsOfFailedPlugins(t *testing.T) {
+	strategies := []UpdateStrategy{UpdateStrategyApply, UpdateStrategyPatch}
+	for _, strategy := range strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			var failing atomic.Bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing.Load() {
+					http.Error(w, "database is down", http.StatusServiceUnavailable)
+					return
+				}
+				_, _ = io.WriteString(w, `{"labels": {"rack": "r1"}}`)
+			}))
+			defer server.Close()
+			pluginName := "test-failed-" + string(strategy)
+			_, err := specs.RegisterPlugin(pluginName, server.URL, time.Second)
+			require.NoError(t, err)
+			parsedSpecs, err := specs.ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: cmdb
+  plugin: {name: ` + pluginName + `, failurePolicy: retry}
+- name: roles
+  match: {key: role, value: "*"}
+  set: {key: node-role.kubernetes.io/*}
+`))
+			require.NoError(t, err)
+			node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+				Name:   "test-node",
+				Labels: map[string]string{"role": "gpu"},
+			}}
+			fakeClient := fake.NewClientset(node)
+			controller, err := NewController(
+				fakeClient,
+				parsedSpecs,
+				Options{UpdateStrategy: strategy},
+			)
+			require.NoError(t, err)
+
+			getNode := func() *core_v1.Node {
+				updated, err := fakeClient.CoreV1().Nodes().Get(
+					context.TODO(),
+					node.Name,
+					meta_v1.GetOptions{},
+				)
+				require.NoError(t, err)
+				return updated
+			}
+
+			require.NoError(t, controller.relabelNode(getNode()))
+			assert.Equal(t, "r1", getNode().Labels["rack"])
+
+			// The plugin failing keeps its labels, while the other rules
+			// still apply.
+			failing.Store(true)
+			updated := getNode()
+			updated.Labels["role"] = "cpu"
+			_, err = fakeClient.CoreV1().Nodes().Update(
+				context.TODO(),
+				updated,
+				meta_v1.UpdateOptions{FieldManager: "test"},
+			)
+			require.NoError(t, err)
+			err = controller.relabelNode(getNode())
+			require.Error(t, err)
+			assert.Regexp(t, "Rule cmdb: Plugin test-failed-.* failed", err.Error())
+			assert.Equal(
+				t,
+				map[string]string{
+					"role":                        "cpu",
+					"rack":                        "r1",
+					"node-role.kubernetes.io/cpu": "",
+				},
+				getNode().Labels,
+			)
+		})
+	}
+}
+
+func TestControllerPatchPreconditions(t *testing.T) {
+	testData := []struct {
+		name         string
+		specs        []string
+		node         *core_v1.Node
+		precondition bool
+	}{
+		{
+			"OwnedLabelChanged",
+			[]string{"abc=*:uvw=*"},
+			&core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+				Name:        "test-node",
+				Labels:      map[string]string{"abc": "new", "uvw": "old"},
+				Annotations: map[string]string{ManagedLabelsAnnotation: `{"uvw":"abc=*:uvw=*"}`},
+			}},
+			false,
+		},
+		{
+			"LabelAdded",
+			[]string{"abc=*:uvw=*"},
+			&core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+				Name:   "test-node",
+				Labels: map[string]string{"abc": "new"},
+			}},
+			true,
+		},
+		{
+			"TaintRemoved",
+			[]string{"-legacy=*@*"},
+			&core_v1.Node{
+				ObjectMeta: meta_v1.ObjectMeta{Name: "test-node"},
+				Spec: core_v1.NodeSpec{Taints: []core_v1.Taint{
+					{Key: "legacy", Effect: core_v1.TaintEffectNoExecute},
+				}},
+			},
+			true,
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			parsedSpecs, err := specs.Parse(testItem.specs)
+			require.NoError(t, err)
+			testItem.node.ResourceVersion = "42"
+			fakeClient := fake.NewClientset()
+			var metadata map[string]interface{}
+			fakeClient.PrependReactor(
+				"patch",
+				"nodes",
+				func(action go_testing.Action) (bool, runtime.Object, error) {
+					var patch struct {
+						Metadata map[string]interface{} `json:"metadata"`
+					}
+					err := json.Unmarshal(action.(go_testing.PatchAction).GetPatch(), &patch)
+					require.NoError(t, err)
+					metadata = patch.Metadata
+					return true, testItem.node, nil
+				},
+			)
+			controller, err := NewController(
+				fakeClient,
+				parsedSpecs,
+				Options{UpdateStrategy: UpdateStrategyPatch},
+			)
+			require.NoError(t, err)
+
+			require.NoError(t, controller.relabelNode(testItem.node))
+			require.NotNil(t, metadata)
+			if testItem.precondition {
+				assert.Equal(t, "42", metadata["resourceVersion"])
+			} else {
+				assert.NotContains(t, metadata, "resourceVersion")
+			}
+		})
+	}
+}
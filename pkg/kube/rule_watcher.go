@@ -0,0 +1,219 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vladlosev/node-relabeler/pkg/apis/noderelabeler/v1alpha1"
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+// RuleSpecsSource is the name of the specs source for the rules coming from
+// NodeRelabelRule objects.
+const RuleSpecsSource = "noderelabelrules"
+
+// ruleStatusResync is how often rule statuses are recomputed, so that the
+// match counts follow the nodes processed since.
+const ruleStatusResync = time.Minute
+
+// RuleWatcher merges the rules from all NodeRelabelRule objects into the
+// controller's specs and reports their state back into the objects' status.
+type RuleWatcher struct {
+	client          dynamic.Interface
+	controller      *Controller
+	informerFactory dynamicinformer.DynamicSharedInformerFactory
+	ruleInformer    informers.GenericInformer
+
+	// loaded is closed once the first sync has passed the rules to the
+	// controller.
+	loaded     chan struct{}
+	loadedOnce sync.Once
+
+	// syncLock serializes syncs and guards the fields below it.
+	syncLock sync.Mutex
+	// lastRules keeps the valid rule specs passed to the controller during
+	// the last sync, by rule name.
+	lastRules map[string]v1alpha1.RuleSpec
+	// reportedErrors keeps the errors InvalidRule events have been recorded
+	// for, by rule name. The statuses in the informer cache lag behind the
+	// updates, so they cannot tell whether an error has been reported.
+	reportedErrors map[string]string
+}
+
+// NewRuleWatcher constructs new instance of RuleWatcher.
+func NewRuleWatcher(client dynamic.Interface, controller *Controller) *RuleWatcher {
+	informerFactory := dynamicinformer.NewDynamicSharedInformerFactory(client, ruleStatusResync)
+	watcher := &RuleWatcher{
+		client:          client,
+		controller:      controller,
+		informerFactory: informerFactory,
+		ruleInformer:    informerFactory.ForResource(v1alpha1.NodeRelabelRuleResource),
+		loaded:          make(chan struct{}),
+		reportedErrors:  map[string]string{},
+	}
+	watcher.ruleInformer.Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				watcher.ruleChanged()
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				watcher.ruleChanged()
+			},
+			DeleteFunc: func(obj interface{}) {
+				watcher.ruleChanged()
+			},
+		},
+	)
+	// Rule status is only reported by the leader, so refresh it as soon as
+	// this replica becomes one.
+	controller.onStartedLeading(watcher.ruleChanged)
+	// Nodes processed without the rules would lose the labels they produce.
+	controller.waitForSource(watcher.loaded)
+	return watcher
+}
+
+// Run watches NodeRelabelRule objects until the stop channel is signalled.
+func (w *RuleWatcher) Run(stopCh <-chan struct{}) error {
+	return w.runInternal(stopCh, stopCh)
+}
+
+func (w *RuleWatcher) runInternal(stopCh <-chan struct{}, stopSyncCh <-chan struct{}) error {
+	informerSynced.WithLabelValues("noderelabelrules").Set(0)
+	w.informerFactory.Start(stopCh)
+	logrus.Info("Syncing NodeRelabelRule informer cache...")
+	if !cache.WaitForCacheSync(
+		stopSyncCh,
+		w.ruleInformer.Informer().HasSynced,
+		w.controller.nodeInformer.Informer().HasSynced,
+	) {
+		return fmt.Errorf("Failed to sync NodeRelabelRule informer cache")
+	}
+	informerSynced.WithLabelValues("noderelabelrules").Set(1)
+	logrus.Info("NodeRelabelRule informer cache synced.")
+	w.sync()
+	<-stopCh
+	return nil
+}
+
+func (w *RuleWatcher) ruleChanged() {
+	// The initial sync happens in Run once the caches are synced.
+	if !w.ruleInformer.Informer().HasSynced() ||
+		!w.controller.nodeInformer.Informer().HasSynced() {
+		return
+	}
+	w.sync()
+}
+
+func (w *RuleWatcher) sync() {
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+
+	objects, err := w.ruleInformer.Lister().List(labels.Everything())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list NodeRelabelRule objects")
+		return
+	}
+
+	rules := make([]*v1alpha1.NodeRelabelRule, 0, len(objects))
+	for _, obj := range objects {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			logrus.WithField("obj", obj).Error("Unexpected object received (not Unstructured)")
+			continue
+		}
+		rule := &v1alpha1.NodeRelabelRule{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), rule)
+		if err != nil {
+			logrus.WithField("name", u.GetName()).WithError(err).Error(
+				"Failed to convert NodeRelabelRule")
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+	// The match counts come from the nodes processed by the controller, so
+	// that computing them never calls plugins.
+	matchedNodes := w.controller.matchedNodes()
+	var combined specs.Specs
+	validRules := map[string]v1alpha1.RuleSpec{}
+	names := map[string]bool{}
+	for _, rule := range rules {
+		names[rule.Name] = true
+		status := v1alpha1.NodeRelabelRuleStatus{ObservedGeneration: rule.Generation}
+		ruleSpecs, err := specs.CompileRule(rule.Name, rule.Spec)
+		if err != nil {
+			status.Error = err.Error()
+		} else {
+			combined = append(combined, ruleSpecs...)
+			validRules[rule.Name] = rule.Spec
+			status.MatchedNodes = matchedNodes[rule.Name]
+		}
+		// Only the replica processing nodes reports rule status.
+		if !w.controller.IsLeading() {
+			continue
+		}
+		reported, ok := w.reportedErrors[rule.Name]
+		if !ok {
+			// Errors reported before a restart are in the status already.
+			reported = rule.Status.Error
+		}
+		if status.Error != reported {
+			if status.Error != "" {
+				w.controller.recordInvalidRule(rule, status.Error)
+			}
+			w.reportedErrors[rule.Name] = status.Error
+		}
+		if status != rule.Status {
+			w.updateStatus(rule, status)
+		}
+	}
+	for name := range w.reportedErrors {
+		if !names[name] {
+			delete(w.reportedErrors, name)
+		}
+	}
+
+	if w.lastRules == nil || !reflect.DeepEqual(validRules, w.lastRules) {
+		w.lastRules = validRules
+		w.controller.SetSpecs(RuleSpecsSource, combined)
+	}
+	w.loadedOnce.Do(func() { close(w.loaded) })
+}
+
+func (w *RuleWatcher) updateStatus(rule *v1alpha1.NodeRelabelRule, status v1alpha1.NodeRelabelRuleStatus) {
+	logger := logrus.WithField("rule", rule.Name)
+	rule = rule.DeepCopy()
+	rule.Status = status
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(rule)
+	if err != nil {
+		logger.WithError(err).Error("Failed to convert NodeRelabelRule")
+		return
+	}
+	_, err = w.client.Resource(v1alpha1.NodeRelabelRuleResource).UpdateStatus(
+		context.TODO(),
+		&unstructured.Unstructured{Object: content},
+		meta_v1.UpdateOptions{})
+	if err != nil {
+		logger.WithError(err).Error("Failed to update NodeRelabelRule status")
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"error":        status.Error,
+		"matchedNodes": status.MatchedNodes,
+	}).Debug("Updated NodeRelabelRule status")
+}
@@ -0,0 +1,268 @@
+package kube
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamic_fake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	go_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/vladlosev/node-relabeler/pkg/apis/noderelabeler/v1alpha1"
+)
+
+func makeRule(t *testing.T, name string, spec v1alpha1.RuleSpec) *unstructured.Unstructured {
+	rule := &v1alpha1.NodeRelabelRule{
+		TypeMeta: meta_v1.TypeMeta{
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Kind:       "NodeRelabelRule",
+		},
+		ObjectMeta: meta_v1.ObjectMeta{Name: name},
+		Spec:       spec,
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(rule)
+	require.NoError(t, err)
+	return &unstructured.Unstructured{Object: content}
+}
+
+func getRuleStatus(t *testing.T, client *dynamic_fake.FakeDynamicClient, name string) v1alpha1.NodeRelabelRuleStatus {
+	obj, err := client.Resource(v1alpha1.NodeRelabelRuleResource).Get(
+		context.TODO(),
+		name,
+		meta_v1.GetOptions{},
+	)
+	require.NoError(t, err)
+	rule := &v1alpha1.NodeRelabelRule{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), rule)
+	require.NoError(t, err)
+	return rule.Status
+}
+
+func TestRuleWatcherMergesRulesAndReportsStatus(t *testing.T) {
+	nodes := []runtime.Object{
+		&core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"role": "gpu"},
+		}},
+		&core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+			Name:   "node-2",
+			Labels: map[string]string{"role": "cpu"},
+		}},
+	}
+	dynamicClient := dynamic_fake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.NodeRelabelRuleResource: "NodeRelabelRuleList"},
+		makeRule(t, "roles", v1alpha1.RuleSpec{
+			Match: v1alpha1.Label{Key: "role", Value: "*"},
+			Set:   v1alpha1.Label{Key: "node-role.kubernetes.io/*"},
+		}),
+		makeRule(t, "gpus", v1alpha1.RuleSpec{
+			Match: v1alpha1.Label{Key: "role", Value: "gpu"},
+			Set:   v1alpha1.Label{Key: "gpu", Value: "true"},
+		}),
+		makeRule(t, "invalid", v1alpha1.RuleSpec{
+			Match: v1alpha1.Label{Key: "role", Value: "gpu"},
+			Set:   v1alpha1.Label{Key: "gpu*", Value: "true"},
+		}),
+		makeRule(t, "malformed", v1alpha1.RuleSpec{
+			Regex: true,
+			Match: v1alpha1.Label{Key: "role[", Value: "(.*)"},
+			Set:   v1alpha1.Label{Key: "role", Value: "$1"},
+		}),
+	)
+
+	recorder := record.NewFakeRecorder(100)
+	controller, err := NewController(
+		fake.NewSimpleClientset(nodes...),
+		nil,
+		Options{EventRecorder: recorder},
+	)
+	require.NoError(t, err)
+	watcher := NewRuleWatcher(dynamicClient, controller)
+	stopChan := make(chan struct{})
+	stopSyncChan := make(chan struct{})
+	controllerDoneChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	go func() {
+		// We use runInternal here to avoid interupting the cache sync.
+		assert.NoError(t, controller.runInternal(stopChan, stopSyncChan))
+		close(controllerDoneChan)
+	}()
+	go func() {
+		assert.NoError(t, watcher.runInternal(stopChan, stopSyncChan))
+		close(doneChan)
+	}()
+	defer func() {
+		close(stopChan)
+		<-doneChan
+		<-controllerDoneChan
+	}()
+
+	require.Eventually(
+		t,
+		func() bool { return len(controller.currentSpecs()) == 2 },
+		time.Second,
+		10*time.Millisecond,
+	)
+	assert.Equal(
+		t,
+		map[string]string{"node-role.kubernetes.io/gpu": "", "gpu": "true"},
+		controller.currentSpecs().ApplyTo(map[string]string{"role": "gpu"}),
+	)
+	require.Eventually(
+		t,
+		func() bool { return getRuleStatus(t, dynamicClient, "invalid").Error != "" },
+		time.Second,
+		10*time.Millisecond,
+	)
+	assert.Regexp(t, "Wildcard pattern cannot appear", getRuleStatus(t, dynamicClient, "invalid").Error)
+	// The nodes are relabeled at the same time, so look for the rule's event
+	// among theirs.
+	var ruleEvents []string
+	for _, event := range receiveEvents(recorder) {
+		if strings.HasPrefix(event, "Warning InvalidRule ") {
+			ruleEvents = append(ruleEvents, event)
+		}
+	}
+	require.Len(t, ruleEvents, 2)
+	assert.Regexp(t, "^Warning InvalidRule Invalid rule: .*Wildcard pattern cannot appear", ruleEvents[0])
+	assert.Regexp(t, "^Warning InvalidRule Invalid rule: Invalid key pattern", ruleEvents[1])
+	assert.Regexp(t, "Invalid key pattern", getRuleStatus(t, dynamicClient, "malformed").Error)
+
+	// Syncs running at the same time as the status updates do not report the
+	// errors again.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watcher.sync()
+		}()
+	}
+	wg.Wait()
+	for _, event := range receiveEvents(recorder) {
+		assert.False(t, strings.HasPrefix(event, "Warning InvalidRule "), event)
+	}
+
+	// The match counts come from the nodes the controller has processed.
+	require.Eventually(
+		t,
+		func() bool {
+			matched := controller.matchedNodes()
+			return matched["roles"] == 2 && matched["gpus"] == 1
+		},
+		time.Second,
+		10*time.Millisecond,
+	)
+	watcher.ruleChanged()
+	assert.Equal(t, int32(0), getRuleStatus(t, dynamicClient, "invalid").MatchedNodes)
+	assert.Equal(t, int32(2), getRuleStatus(t, dynamicClient, "roles").MatchedNodes)
+	assert.Equal(t, int32(1), getRuleStatus(t, dynamicClient, "gpus").MatchedNodes)
+	assert.Empty(t, getRuleStatus(t, dynamicClient, "gpus").Error)
+
+	err = dynamicClient.Resource(v1alpha1.NodeRelabelRuleResource).Delete(
+		context.TODO(),
+		"gpus",
+		meta_v1.DeleteOptions{},
+	)
+	require.NoError(t, err)
+	assert.Eventually(
+		t,
+		func() bool { return len(controller.currentSpecs()) == 1 },
+		time.Second,
+		10*time.Millisecond,
+	)
+}
+
+func TestRuleWatcherDelaysWorkersUntilRulesLoaded(t *testing.T) {
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "node-1",
+		Labels: map[string]string{"role": "gpu"},
+	}}
+	dynamicClient := dynamic_fake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.NodeRelabelRuleResource: "NodeRelabelRuleList"},
+		makeRule(t, "gpus", v1alpha1.RuleSpec{
+			Match: v1alpha1.Label{Key: "role", Value: "gpu"},
+			Set:   v1alpha1.Label{Key: "gpu", Value: "true"},
+		}),
+	)
+	listedChan := make(chan struct{})
+	dynamicClient.PrependReactor(
+		"list",
+		"noderelabelrules",
+		func(action go_testing.Action) (bool, runtime.Object, error) {
+			<-listedChan
+			return false, nil, nil
+		},
+	)
+	fakeClient := fake.NewClientset(node)
+	patched := make(chan map[string]string, 10)
+	fakeClient.PrependReactor(
+		"patch",
+		"nodes",
+		func(action go_testing.Action) (bool, runtime.Object, error) {
+			handled, obj, err := go_testing.ObjectReaction(fakeClient.Tracker())(action)
+			if err == nil {
+				patched <- obj.(*core_v1.Node).Labels
+			}
+			return handled, obj, err
+		},
+	)
+	controller, err := NewController(
+		fakeClient,
+		nil,
+		Options{UpdateStrategy: UpdateStrategyPatch, EventRecorder: record.NewFakeRecorder(100)},
+	)
+	require.NoError(t, err)
+	watcher := NewRuleWatcher(dynamicClient, controller)
+	stopChan := make(chan struct{})
+	stopSyncChan := make(chan struct{})
+	controllerDoneChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	go func() {
+		// We use runInternal here to avoid interupting the cache sync.
+		assert.NoError(t, controller.runInternal(stopChan, stopSyncChan))
+		close(controllerDoneChan)
+	}()
+	go func() {
+		assert.NoError(t, watcher.runInternal(stopChan, stopSyncChan))
+		close(doneChan)
+	}()
+	defer func() {
+		close(stopChan)
+		<-doneChan
+		<-controllerDoneChan
+	}()
+
+	// The node cache syncs, but the nodes are not processed without the
+	// rules.
+	require.Eventually(
+		t,
+		func() bool { return controller.Ready() == nil },
+		time.Second,
+		10*time.Millisecond,
+	)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, controller.IsLeading())
+	assert.Empty(t, patched)
+
+	close(listedChan)
+	select {
+	case labels := <-patched:
+		assert.Equal(t, map[string]string{"role": "gpu", "gpu": "true"}, labels)
+	case <-time.After(time.Second):
+		assert.Fail(t, "No expected node updates received")
+	}
+}
@@ -0,0 +1,174 @@
+package kube
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+// Operations of NodeChange.
+const (
+	OperationAdd    = "add"
+	OperationChange = "change"
+	OperationRemove = "remove"
+)
+
+// NodeChange is a change the controller would make to a node.
+type NodeChange struct {
+	// Type is label, taint, or annotation.
+	Type string `json:"type" yaml:"type"`
+	// Operation is add, change, or remove.
+	Operation string `json:"operation" yaml:"operation"`
+	// Key is the key of the label or the annotation, or the ID of the taint
+	// (the key and the effect separated by a colon).
+	Key string `json:"key" yaml:"key"`
+	// OldValue is the value before a change or a removal.
+	OldValue string `json:"oldValue" yaml:"oldValue"`
+	// NewValue is the value after an addition or a change.
+	NewValue string `json:"newValue" yaml:"newValue"`
+	// Rule is the name of the rule making the change, or of the rule that
+	// has produced a removed value earlier.
+	Rule string `json:"rule,omitempty" yaml:"rule,omitempty"`
+}
+
+// NodeDiff is the difference between a node and the node updated by the
+// controller.
+type NodeDiff struct {
+	Name    string       `json:"name" yaml:"name"`
+	Changes []NodeChange `json:"changes,omitempty" yaml:"changes,omitempty"`
+	// Errors maps the names of the rules that have failed for the node to
+	// their errors.
+	Errors map[string]string `json:"errors,omitempty" yaml:"errors,omitempty"`
+}
+
+// DiffNode returns the changes the controller would make to the node with
+// the specs. Changes to the annotations recording what the controller owns
+// are left out.
+func DiffNode(nodeSpecs specs.Specs, node *core_v1.Node) NodeDiff {
+	result := nodeSpecs.ApplyToNode(node)
+	update := newNodeUpdate(node, result)
+	diff := NodeDiff{Name: node.Name}
+	diff.addChanges("label", node.Labels, update.labels)
+	diff.addChanges("taint", taintValues(node), update.taints)
+	diff.addChanges("annotation", node.Annotations, update.annotations)
+	for rule, err := range result.Errors {
+		if diff.Errors == nil {
+			diff.Errors = map[string]string{}
+		}
+		diff.Errors[rule] = err.Error()
+	}
+	return diff
+}
+
+// addChanges adds the changed and removed values, ordered by key.
+func (d *NodeDiff) addChanges(kind string, current map[string]string, changes ownedChanges) {
+	var kindChanges []NodeChange
+	for key, value := range changes.changed {
+		change := NodeChange{
+			Type:      kind,
+			Operation: OperationAdd,
+			Key:       key,
+			NewValue:  value,
+			Rule:      changes.rules[key],
+		}
+		if oldValue, ok := current[key]; ok {
+			change.Operation = OperationChange
+			change.OldValue = oldValue
+		}
+		kindChanges = append(kindChanges, change)
+	}
+	for _, key := range changes.removed {
+		kindChanges = append(kindChanges, NodeChange{
+			Type:      kind,
+			Operation: OperationRemove,
+			Key:       key,
+			OldValue:  current[key],
+			Rule:      changes.rules[key],
+		})
+	}
+	sort.Slice(kindChanges, func(i, j int) bool { return kindChanges[i].Key < kindChanges[j].Key })
+	d.Changes = append(d.Changes, kindChanges...)
+}
+
+// ReadNodes reads the nodes from the output of kubectl get nodes in YAML or
+// JSON: a List or a NodeList of nodes, or a stream of nodes or lists.
+func ReadNodes(reader io.Reader) ([]*core_v1.Node, error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(reader, 4096)
+	var nodes []*core_v1.Node
+	for {
+		var object json.RawMessage
+		err := decoder.Decode(&object)
+		if errors.Is(err, io.EOF) {
+			return nodes, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse nodes: %w", err)
+		}
+		if len(object) == 0 || string(object) == "null" {
+			// Empty YAML documents.
+			continue
+		}
+		kind, err := objectKind(object)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "Node":
+			node, err := decodeNode(object)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, node)
+		case "List", "NodeList":
+			list := struct {
+				Items []json.RawMessage `json:"items"`
+			}{}
+			if err := json.Unmarshal(object, &list); err != nil {
+				return nil, fmt.Errorf("Failed to parse %s: %w", kind, err)
+			}
+			for i, item := range list.Items {
+				itemKind, err := objectKind(item)
+				if err != nil {
+					return nil, err
+				}
+				// The items of a NodeList may leave out their kind.
+				if itemKind != "Node" && !(kind == "NodeList" && itemKind == "") {
+					return nil, fmt.Errorf("Item %d of the %s is a %s, not a Node", i, kind, itemKind)
+				}
+				node, err := decodeNode(item)
+				if err != nil {
+					return nil, err
+				}
+				nodes = append(nodes, node)
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported kind %q, must be Node, NodeList, or List", kind)
+		}
+	}
+}
+
+// objectKind returns the kind of the JSON object.
+func objectKind(object json.RawMessage) (string, error) {
+	typeMeta := struct {
+		Kind string `json:"kind"`
+	}{}
+	if err := json.Unmarshal(object, &typeMeta); err != nil {
+		return "", fmt.Errorf("Failed to parse nodes: %w", err)
+	}
+	return typeMeta.Kind, nil
+}
+
+func decodeNode(object json.RawMessage) (*core_v1.Node, error) {
+	node := &core_v1.Node{}
+	if err := json.Unmarshal(object, node); err != nil {
+		return nil, fmt.Errorf("Failed to parse node: %w", err)
+	}
+	return node, nil
+}
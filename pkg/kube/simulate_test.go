@@ -0,0 +1,205 @@
+package kube
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vladlosev/node-relabeler/pkg/specs"
+)
+
+func TestReadNodes(t *testing.T) {
+	testData := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			"YAMLList",
+			`
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Node
+  metadata: {name: node-1}
+- apiVersion: v1
+  kind: Node
+  metadata: {name: node-2}
+`,
+			[]string{"node-1", "node-2"},
+		},
+		{
+			"JSONNodeList",
+			`{"apiVersion": "v1", "kind": "NodeList", "items": [{"metadata": {"name": "node-1"}}]}`,
+			[]string{"node-1"},
+		},
+		{
+			"YAMLStream",
+			`---
+apiVersion: v1
+kind: Node
+metadata: {name: node-1}
+---
+---
+apiVersion: v1
+kind: Node
+metadata: {name: node-2}
+`,
+			[]string{"node-1", "node-2"},
+		},
+		{
+			"JSONStream",
+			`{"kind": "Node", "metadata": {"name": "node-1"}}
+{"kind": "List", "items": [{"kind": "Node", "metadata": {"name": "node-2"}}]}`,
+			[]string{"node-1", "node-2"},
+		},
+		{"Empty", "", nil},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			nodes, err := ReadNodes(strings.NewReader(testItem.input))
+			require.NoError(t, err)
+			var names []string
+			for _, node := range nodes {
+				names = append(names, node.Name)
+			}
+			assert.Equal(t, testItem.expected, names)
+		})
+	}
+}
+
+func TestReadNodesFailures(t *testing.T) {
+	testData := []struct {
+		name    string
+		input   string
+		message string
+	}{
+		{
+			"UnsupportedKind",
+			"apiVersion: v1\nkind: Pod\nmetadata: {name: pod-1}\n",
+			`Unsupported kind "Pod", must be Node, NodeList, or List`,
+		},
+		{
+			"ListOfPods",
+			`{"kind": "List", "items": [{"kind": "Node"}, {"kind": "Pod"}]}`,
+			"Item 1 of the List is a Pod, not a Node",
+		},
+		{
+			"InvalidNode",
+			`{"kind": "Node", "metadata": {"name": 1}}`,
+			"Failed to parse node: ",
+		},
+		{
+			"InvalidYAML",
+			"kind: Node\nmetadata: [\n",
+			"Failed to parse nodes: ",
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := ReadNodes(strings.NewReader(testItem.input))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), testItem.message)
+		})
+	}
+}
+
+func TestDiffNode(t *testing.T) {
+	_, err := specs.RegisterPlugin("test-diff-broken", "/nonexistent/plugin", time.Second)
+	require.NoError(t, err)
+	parsedSpecs, err := specs.ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: roles
+  match: {key: role, value: "*"}
+  set: {key: node-role.kubernetes.io/*}
+- name: legacy
+  action: move
+  match: {key: legacy, value: "*"}
+  set: {key: modern, value: "*"}
+- name: dedicated
+  match: {key: role, value: gpu}
+  set: {type: taint, key: dedicated, value: gpu, effect: NoSchedule}
+- name: owner
+  match: {key: role, value: "*"}
+  set: {type: annotation, key: example.com/owner, value: team-*}
+- name: cmdb
+  plugin: {name: test-diff-broken}
+`))
+	require.NoError(t, err)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name: "node-1",
+		Labels: map[string]string{
+			"role":                        "gpu",
+			"legacy":                      "yes",
+			"node-role.kubernetes.io/gpu": "old",
+			"stale":                       "1",
+		},
+		Annotations: map[string]string{
+			ManagedLabelsAnnotation: `{"stale":"removed-rule"}`,
+		},
+	}}
+
+	diff := DiffNode(parsedSpecs, node)
+	assert.Equal(t, "node-1", diff.Name)
+	assert.Equal(t, []NodeChange{
+		{
+			Type:      "label",
+			Operation: OperationRemove,
+			Key:       "legacy",
+			OldValue:  "yes",
+			Rule:      "legacy",
+		},
+		{
+			Type:      "label",
+			Operation: OperationAdd,
+			Key:       "modern",
+			NewValue:  "yes",
+			Rule:      "legacy",
+		},
+		{
+			Type:      "label",
+			Operation: OperationChange,
+			Key:       "node-role.kubernetes.io/gpu",
+			OldValue:  "old",
+			Rule:      "roles",
+		},
+		{
+			Type:      "label",
+			Operation: OperationRemove,
+			Key:       "stale",
+			OldValue:  "1",
+			Rule:      "removed-rule",
+		},
+		{
+			Type:      "taint",
+			Operation: OperationAdd,
+			Key:       "dedicated:NoSchedule",
+			NewValue:  "gpu",
+			Rule:      "dedicated",
+		},
+		{
+			Type:      "annotation",
+			Operation: OperationAdd,
+			Key:       "example.com/owner",
+			NewValue:  "team-gpu",
+			Rule:      "owner",
+		},
+	}, diff.Changes)
+	require.Contains(t, diff.Errors, "cmdb")
+	assert.Contains(t, diff.Errors["cmdb"], "Plugin test-diff-broken failed")
+
+	// Nodes already in line with the rules have no changes.
+	unchanged := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "node-2",
+		Labels: map[string]string{"other": "label"},
+	}}
+	assert.Empty(t, DiffNode(parsedSpecs[:2], unchanged).Changes)
+}
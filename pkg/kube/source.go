@@ -0,0 +1,165 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fileSource polls a file and passes its contents to a callback whenever
+// they change.
+type fileSource struct {
+	path     string
+	interval time.Duration
+	logger   *logrus.Entry
+	onChange func(data []byte)
+	lastData []byte
+}
+
+// newFileSource reads the file and returns its contents along with a
+// source calling onChange with the new contents whenever they change.
+// Returns an error if the file cannot be read.
+func newFileSource(
+	path string,
+	interval time.Duration,
+	logger *logrus.Entry,
+	onChange func(data []byte),
+) (*fileSource, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	source := &fileSource{
+		path:     path,
+		interval: interval,
+		logger:   logger.WithField("path", path),
+		onChange: onChange,
+		lastData: data,
+	}
+	return source, data, nil
+}
+
+// Run polls the file until the stop channel is signalled. Mounted
+// ConfigMaps are updated by swapping symlinks, which polling handles
+// transparently.
+func (s *fileSource) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+func (s *fileSource) check() {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to read file, keeping previous contents")
+		return
+	}
+	if bytes.Equal(data, s.lastData) {
+		return
+	}
+	s.lastData = data
+	s.onChange(data)
+}
+
+// configMapSource watches a key in a ConfigMap and passes its value to a
+// callback whenever it changes.
+type configMapSource struct {
+	key             string
+	logger          *logrus.Entry
+	onChange        func(data []byte)
+	informerFactory informers.SharedInformerFactory
+	lastData        string
+}
+
+// newConfigMapSource gets the ConfigMap and returns the value of its key
+// along with a source calling onChange with the new value whenever it
+// changes. Returns an error if the ConfigMap or its key is missing.
+func newConfigMapSource(
+	client kubernetes.Interface,
+	namespace string,
+	name string,
+	key string,
+	logger *logrus.Entry,
+	onChange func(data []byte),
+) (*configMapSource, []byte, error) {
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(
+		context.TODO(),
+		name,
+		meta_v1.GetOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get ConfigMap %s/%s: %w", namespace, name, err)
+	}
+	data, ok := configMap.Data[key]
+	if !ok {
+		return nil, nil, fmt.Errorf("ConfigMap %s/%s has no key %s", namespace, name, key)
+	}
+
+	source := &configMapSource{
+		key:      key,
+		logger:   logger.WithField("key", key),
+		onChange: onChange,
+		informerFactory: informers.NewSharedInformerFactoryWithOptions(
+			client,
+			time.Hour*24,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *meta_v1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector(
+					"metadata.name", name).String()
+			}),
+		),
+		lastData: data,
+	}
+	source.informerFactory.Core().V1().ConfigMaps().Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: source.addConfigMap,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				source.addConfigMap(newObj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				source.logger.Warn("ConfigMap deleted, keeping previous contents")
+			},
+		},
+	)
+	return source, []byte(data), nil
+}
+
+// Run watches the ConfigMap until the stop channel is signalled.
+func (s *configMapSource) Run(stopCh <-chan struct{}) {
+	s.informerFactory.Start(stopCh)
+	<-stopCh
+}
+
+func (s *configMapSource) addConfigMap(obj interface{}) {
+	configMap, ok := obj.(*core_v1.ConfigMap)
+	if !ok {
+		logrus.WithField("obj", obj).Error("Unexpected object received (not a ConfigMap)")
+		return
+	}
+	data, ok := configMap.Data[s.key]
+	if !ok {
+		s.logger.Error("ConfigMap has no key, keeping previous contents")
+		return
+	}
+	if data == s.lastData {
+		return
+	}
+	s.lastData = data
+	s.onChange([]byte(data))
+}
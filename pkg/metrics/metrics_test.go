@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "test_handler_total",
+		Help: "A test counter.",
+	})
+	Registry.MustRegister(counter)
+	defer Registry.Unregister(counter)
+	counter.Add(3)
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Regexp(t, "^text/plain", recorder.Header().Get("Content-Type"))
+	body := recorder.Body.String()
+	assert.Contains(t, body, "# HELP test_handler_total A test counter.\n")
+	assert.Contains(t, body, "test_handler_total 3\n")
+	assert.Contains(t, body, "go_goroutines ")
+}
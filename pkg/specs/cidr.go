@@ -0,0 +1,105 @@
+package specs
+
+import (
+	"fmt"
+	"net/netip"
+	"text/template"
+
+	core_v1 "k8s.io/api/core/v1"
+
+	"github.com/vladlosev/node-relabeler/pkg/apis/noderelabeler/v1alpha1"
+)
+
+// addressesPathPrefix is the prefix of the paths identifying node addresses
+// of a type in CIDR specs, followed by the address type.
+const addressesPathPrefix = ".status.addresses."
+
+// cidrMatch sorts nodes into network ranges by their addresses.
+type cidrMatch struct {
+	addressType core_v1.NodeAddressType
+	// path identifies the matched addresses in templates and specs.
+	path   string
+	ranges []cidrRange
+}
+
+// cidrRange is a network range with the label value to set for it.
+type cidrRange struct {
+	prefix        netip.Prefix
+	value         string
+	valueTemplate *template.Template
+}
+
+// compileCIDR validates the CIDR match of a rule.
+func compileCIDR(match *v1alpha1.CIDRMatch) (*cidrMatch, error) {
+	addressType := core_v1.NodeAddressType(match.AddressType)
+	switch addressType {
+	case "":
+		addressType = core_v1.NodeInternalIP
+	case core_v1.NodeInternalIP, core_v1.NodeExternalIP:
+	default:
+		return nil, fmt.Errorf(
+			"Unknown address type %q, must be %s or %s",
+			match.AddressType, core_v1.NodeInternalIP, core_v1.NodeExternalIP)
+	}
+	if len(match.Ranges) == 0 {
+		return nil, fmt.Errorf("CIDR match must have at least one range")
+	}
+	compiled := &cidrMatch{
+		addressType: addressType,
+		path:        addressesPathPrefix + string(addressType),
+	}
+	seen := map[netip.Prefix]int{}
+	for i, matchRange := range match.Ranges {
+		prefix, err := netip.ParsePrefix(matchRange.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cidr in range %d: %w", i+1, err)
+		}
+		// Host bits in the range are ignored.
+		prefix = prefix.Masked()
+		if previous, ok := seen[prefix]; ok {
+			return nil, fmt.Errorf(
+				"Range %d has the same cidr %s as range %d", i+1, prefix, previous)
+		}
+		seen[prefix] = i + 1
+		valueTemplate, err := parseTemplate(matchRange.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value in range %d: %w", i+1, err)
+		}
+		compiled.ranges = append(compiled.ranges, cidrRange{
+			prefix:        prefix,
+			value:         matchRange.Value,
+			valueTemplate: valueTemplate,
+		})
+	}
+	return compiled, nil
+}
+
+// find returns the range with the longest prefix containing one of the
+// addresses of the matched type, along with the address, or nil if no range
+// contains any of them.
+func (m *cidrMatch) find(addresses []core_v1.NodeAddress) (*cidrRange, string) {
+	var found *cidrRange
+	foundAddress := ""
+	for _, address := range addresses {
+		if address.Type != m.addressType {
+			continue
+		}
+		ip, err := netip.ParseAddr(address.Address)
+		if err != nil {
+			continue
+		}
+		// IPv4 addresses in the IPv4-mapped IPv6 form match IPv4 ranges.
+		ip = ip.Unmap()
+		for i := range m.ranges {
+			candidate := &m.ranges[i]
+			if !candidate.prefix.Contains(ip) {
+				continue
+			}
+			if found == nil || candidate.prefix.Bits() > found.prefix.Bits() {
+				found = candidate
+				foundAddress = address.Address
+			}
+		}
+	}
+	return found, foundAddress
+}
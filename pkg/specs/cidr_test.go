@@ -0,0 +1,188 @@
+package specs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const sampleCIDRConfig = `
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: racks
+  cidr:
+    ranges:
+    - cidr: 10.1.0.0/16
+      value: r1
+    - cidr: 10.1.2.0/24
+      value: r1-special
+    - cidr: 10.0.0.0/8
+    - cidr: fd00:1::/64
+      value: r6
+    - cidr: 192.168.0.0/16
+      value: 'net-{{.Value | replace "." "-"}}'
+  set:
+    key: rack
+    value: other
+- name: zones
+  cidr:
+    addressType: ExternalIP
+    ranges:
+    - cidr: 203.0.113.0/24
+      value: edge
+  set:
+    key: network-zone
+`
+
+func TestApplyCIDR(t *testing.T) {
+	specs, err := ParseConfig([]byte(sampleCIDRConfig))
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	assert.Equal(t, ".status.addresses.InternalIP:rack=other", specs[0].stringSpec)
+
+	testData := []struct {
+		name      string
+		addresses []core_v1.NodeAddress
+		expected  map[string]string
+	}{
+		{
+			"LongestPrefix",
+			[]core_v1.NodeAddress{{Type: core_v1.NodeInternalIP, Address: "10.1.2.3"}},
+			map[string]string{"rack": "r1-special"},
+		},
+		{
+			"ShorterPrefix",
+			[]core_v1.NodeAddress{{Type: core_v1.NodeInternalIP, Address: "10.1.3.3"}},
+			map[string]string{"rack": "r1"},
+		},
+		{
+			"DefaultValue",
+			[]core_v1.NodeAddress{{Type: core_v1.NodeInternalIP, Address: "10.2.0.1"}},
+			map[string]string{"rack": "other"},
+		},
+		{
+			"IPv6",
+			[]core_v1.NodeAddress{{Type: core_v1.NodeInternalIP, Address: "fd00:1::10"}},
+			map[string]string{"rack": "r6"},
+		},
+		{
+			"DualStack",
+			[]core_v1.NodeAddress{
+				{Type: core_v1.NodeInternalIP, Address: "fd00:1::10"},
+				{Type: core_v1.NodeInternalIP, Address: "10.1.2.3"},
+			},
+			map[string]string{"rack": "r6"},
+		},
+		{
+			"MappedIPv4",
+			[]core_v1.NodeAddress{{Type: core_v1.NodeInternalIP, Address: "::ffff:10.1.2.3"}},
+			map[string]string{"rack": "r1-special"},
+		},
+		{
+			"TemplateValue",
+			[]core_v1.NodeAddress{{Type: core_v1.NodeInternalIP, Address: "192.168.1.2"}},
+			map[string]string{"rack": "net-192-168-1-2"},
+		},
+		{
+			"NoMatch",
+			[]core_v1.NodeAddress{
+				{Type: core_v1.NodeInternalIP, Address: "172.16.0.1"},
+				{Type: core_v1.NodeInternalIP, Address: "not an address"},
+			},
+			map[string]string{},
+		},
+		{
+			"AddressType",
+			[]core_v1.NodeAddress{
+				{Type: core_v1.NodeExternalIP, Address: "203.0.113.5"},
+				{Type: core_v1.NodeHostName, Address: "10.1.2.3"},
+			},
+			map[string]string{"network-zone": "edge"},
+		},
+		{
+			"NoAddresses",
+			nil,
+			map[string]string{},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			node := &core_v1.Node{
+				ObjectMeta: meta_v1.ObjectMeta{Name: "test-node"},
+				Status:     core_v1.NodeStatus{Addresses: testItem.addresses},
+			}
+			assert.Equal(t, testItem.expected, specs.ApplyToNode(node).Labels)
+		})
+	}
+	assert.Empty(t, specs.ApplyTo(map[string]string{"abc": "def"}))
+}
+
+func TestParseCIDRFailures(t *testing.T) {
+	testData := []struct {
+		name    string
+		rule    string
+		message string
+	}{
+		{
+			"InvalidCIDR",
+			`cidr: {ranges: [{cidr: 10.1.0.0/33}]}
+  set: {key: rack}`,
+			"line 6: Invalid rule \"racks\". Invalid cidr in range 1",
+		},
+		{
+			"DuplicateCIDR",
+			`cidr: {ranges: [{cidr: 10.1.0.0/16}, {cidr: 10.1.2.3/16}]}
+  set: {key: rack}`,
+			"Range 2 has the same cidr 10.1.0.0/16 as range 1",
+		},
+		{
+			"UnknownAddressType",
+			`cidr: {addressType: Hostname, ranges: [{cidr: 10.1.0.0/16}]}
+  set: {key: rack}`,
+			"Unknown address type \"Hostname\"",
+		},
+		{
+			"NoRanges",
+			`cidr: {ranges: []}
+  set: {key: rack}`,
+			"CIDR match must have at least one range",
+		},
+		{
+			"InvalidValue",
+			`cidr: {ranges: [{cidr: 10.1.0.0/16, value: "{{.Value | nosuchfunc}}"}]}
+  set: {key: rack}`,
+			"Invalid value in range 1",
+		},
+		{
+			"WithMatch",
+			`cidr: {ranges: [{cidr: 10.1.0.0/16}]}
+  match: {key: rack, value: "*"}
+  set: {key: rack}`,
+			"line 7: Invalid rule \"racks\". Rule must not have both match and cidr",
+		},
+		{
+			"WithResource",
+			`cidr: {ranges: [{cidr: 10.1.0.0/16}]}
+  resource: {name: memory, buckets: [{min: 1Gi}]}
+  set: {key: rack}`,
+			"Rule must not have both resource and cidr",
+		},
+		{
+			"Delete",
+			`action: delete
+  cidr: {ranges: [{cidr: 10.1.0.0/16}]}`,
+			"Rule with cidr must have action set",
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(makeRuleConfig("racks", testItem.rule)))
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
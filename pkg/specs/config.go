@@ -0,0 +1,411 @@
+package specs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/cel-go/cel"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	k8s_labels "k8s.io/apimachinery/pkg/labels"
+
+	"github.com/vladlosev/node-relabeler/pkg/apis/noderelabeler/v1alpha1"
+)
+
+// ConfigAPIVersion is the version of the config file format understood by
+// ParseConfig.
+var ConfigAPIVersion = v1alpha1.SchemeGroupVersion.String()
+
+// ConfigKind is the kind of the config file document.
+const ConfigKind = "RelabelConfig"
+
+// Config is the top level document of a relabel config file.
+type Config struct {
+	APIVersion string          `json:"apiVersion" yaml:"apiVersion"`
+	Kind       string          `json:"kind" yaml:"kind"`
+	Rules      []v1alpha1.Rule `json:"rules" yaml:"rules"`
+}
+
+// ruleError is an error in a specific field of a rule.
+type ruleError struct {
+	field   string
+	message string
+}
+
+func (e *ruleError) Error() string {
+	return e.message
+}
+
+// LoadConfig reads and parses relabel rules from a YAML or JSON config file.
+func LoadConfig(path string) (Specs, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config file %s: %w", path, err)
+	}
+	parsedSpecs, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %w", path, err)
+	}
+	return parsedSpecs, nil
+}
+
+// ParseConfig parses relabel rules from a YAML or JSON document into format
+// useful to apply them.
+func ParseConfig(data []byte) (Specs, error) {
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("Config is empty")
+		}
+		return nil, err
+	}
+
+	// Decode the document again into a node tree to be able to report line
+	// numbers for errors that are not caught by the YAML decoder itself.
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	document := root.Content[0]
+
+	if config.APIVersion != ConfigAPIVersion {
+		return nil, newConfigError(
+			fieldNode(document, "apiVersion", document),
+			"apiVersion must be %s, got %q", ConfigAPIVersion, config.APIVersion)
+	}
+	if config.Kind != ConfigKind {
+		return nil, newConfigError(
+			fieldNode(document, "kind", document),
+			"kind must be %s, got %q", ConfigKind, config.Kind)
+	}
+	rulesNode := fieldNode(document, "rules", document)
+	if len(config.Rules) == 0 {
+		return nil, newConfigError(rulesNode, "At least one rule must be specified")
+	}
+
+	parsedSpecs := make([]spec, 0, len(config.Rules))
+	names := map[string]bool{}
+	for i, rule := range config.Rules {
+		ruleNode := rulesNode.Content[i]
+		if rule.Name == "" {
+			return nil, newConfigError(ruleNode, "Rule must have a name")
+		}
+		if names[rule.Name] {
+			return nil, newConfigError(
+				fieldNode(ruleNode, "name", ruleNode),
+				"Duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+		ruleSpecs, err := CompileRule(rule.Name, rule.RuleSpec)
+		if err != nil {
+			errorNode := ruleNode
+			var fieldErr *ruleError
+			if errors.As(err, &fieldErr) {
+				errorNode = fieldNode(ruleNode, fieldErr.field, ruleNode)
+			}
+			return nil, newConfigError(errorNode, "Invalid rule %q. %s", rule.Name, err)
+		}
+		parsedSpecs = append(parsedSpecs, ruleSpecs...)
+	}
+	logrus.WithField("specs", parsedSpecs).Debug("Parsed specs from config")
+	return parsedSpecs, nil
+}
+
+// CompileRule validates a single named rule and compiles it into specs.
+func CompileRule(name string, rule v1alpha1.RuleSpec) (Specs, error) {
+	var op operation
+	switch rule.Action {
+	case "", v1alpha1.ActionSet:
+		op = opSet
+	case v1alpha1.ActionMove:
+		op = opMove
+	case v1alpha1.ActionDelete:
+		op = opDelete
+	default:
+		return nil, &ruleError{
+			field: "action",
+			message: fmt.Sprintf(
+				"Unknown action %q, must be one of %s, %s, or %s",
+				rule.Action, v1alpha1.ActionSet, v1alpha1.ActionMove, v1alpha1.ActionDelete),
+		}
+	}
+	selector, err := parseSelector(rule.Selector)
+	if err != nil {
+		return nil, &ruleError{field: "selector", message: err.Error()}
+	}
+	var condition cel.Program
+	if rule.Condition != "" {
+		condition, err = compileExpression(rule.Condition, cel.BoolType)
+		if err != nil {
+			return nil, &ruleError{field: "condition", message: err.Error()}
+		}
+	}
+	if rule.Match.ValueExpression != "" {
+		return nil, &ruleError{field: "match", message: "Only set can have a valueExpression"}
+	}
+	sourceField := ""
+	for _, source := range []struct {
+		field   string
+		present bool
+	}{
+		{"resource", rule.Resource != nil},
+		{"cidr", rule.CIDR != nil},
+		{"lookup", rule.Lookup != nil},
+		{"plugin", rule.Plugin != nil},
+	} {
+		if !source.present {
+			continue
+		}
+		field := source.field
+		if sourceField != "" {
+			return nil, &ruleError{
+				field:   field,
+				message: fmt.Sprintf("Rule must not have both %s and %s", sourceField, field),
+			}
+		}
+		sourceField = field
+		if op != opSet {
+			return nil, &ruleError{
+				field:   field,
+				message: fmt.Sprintf("Rule with %s must have action %s", field, v1alpha1.ActionSet),
+			}
+		}
+		if rule.Match != (v1alpha1.Label{}) {
+			return nil, &ruleError{
+				field:   "match",
+				message: fmt.Sprintf("Rule must not have both match and %s", field),
+			}
+		}
+	}
+	if rule.Lookup != nil {
+		return compileLookupRule(name, rule, selector, condition)
+	}
+	if rule.Plugin != nil {
+		return compilePluginRule(name, rule, selector, condition)
+	}
+	if rule.Match.Key == "" {
+		if op != opSet {
+			return nil, &ruleError{field: "match", message: "Rule must have match.key"}
+		}
+		if selector == nil && condition == nil && rule.Resource == nil && rule.CIDR == nil {
+			return nil, &ruleError{
+				field: "match",
+				message: "Rule must have match.key, selector, condition, resource, cidr, " +
+					"lookup, or plugin",
+			}
+		}
+		if rule.Match.Value != "" {
+			return nil, &ruleError{field: "match", message: "Rule must have match.key"}
+		}
+	}
+	if op == opDelete {
+		if rule.Set != (v1alpha1.Label{}) {
+			return nil, &ruleError{field: "set", message: "Delete rule must not have set"}
+		}
+	} else if rule.Set.Key == "" {
+		return nil, &ruleError{field: "set", message: "Rule must have set.key"}
+	}
+	compile := compileSpec
+	if rule.Regex {
+		compile = compileRegexSpec
+	}
+	if rule.Match.Key == "" {
+		compile = compileSelectorSpec
+	}
+	newSpec, err := compile(
+		rule.Match.Key, rule.Match.Value, rule.Set.Key, rule.Set.Value)
+	if err != nil {
+		return nil, err
+	}
+	if err := newSpec.compileTemplates(); err != nil {
+		return nil, &ruleError{field: "set", message: err.Error()}
+	}
+	if rule.Set.ValueExpression != "" {
+		if rule.Set.Value != "" {
+			return nil, &ruleError{
+				field:   "set",
+				message: "Set must not have both value and valueExpression",
+			}
+		}
+		newSpec.newValueProgram, err = compileExpression(rule.Set.ValueExpression, cel.StringType)
+		if err != nil {
+			return nil, &ruleError{field: "set", message: err.Error()}
+		}
+	}
+	newSpec.selector = selector
+	newSpec.condition = condition
+	newSpec.op = op
+	oldTarget, err := compileTarget(rule.Match)
+	if err != nil {
+		return nil, &ruleError{field: "match", message: err.Error()}
+	}
+	newTarget, err := compileTarget(rule.Set)
+	if err != nil {
+		return nil, &ruleError{field: "set", message: err.Error()}
+	}
+	err = newSpec.compileTargets(oldTarget, rule.Match.Effect, newTarget, rule.Set.Effect)
+	if err != nil {
+		field := "match"
+		if newTarget == targetTaint && !isTaintEffect(rule.Set.Effect) {
+			field = "set"
+		}
+		return nil, &ruleError{field: field, message: err.Error()}
+	}
+	if err := newSpec.compileSource(); err != nil {
+		return nil, &ruleError{field: "match", message: err.Error()}
+	}
+	oldLabel := formatLabel(rule.Match)
+	if rule.Match.Key == "" {
+		oldLabel = ""
+	}
+	if rule.Resource != nil {
+		if newSpec.resource, err = compileResource(rule.Resource); err != nil {
+			return nil, &ruleError{field: "resource", message: err.Error()}
+		}
+		oldLabel = newSpec.resource.path
+	}
+	if rule.CIDR != nil {
+		if newSpec.cidr, err = compileCIDR(rule.CIDR); err != nil {
+			return nil, &ruleError{field: "cidr", message: err.Error()}
+		}
+		oldLabel = newSpec.cidr.path
+	}
+	switch op {
+	case opDelete:
+		newSpec.stringSpec = "-" + oldLabel
+	case opMove:
+		newSpec.stringSpec = fmt.Sprintf("-%s:%s", oldLabel, formatLabel(rule.Set))
+	default:
+		newSpec.stringSpec = fmt.Sprintf("%s:%s", oldLabel, formatLabel(rule.Set))
+	}
+	if selector != nil {
+		newSpec.stringSpec = selector.String() + ";" + newSpec.stringSpec
+	}
+	newSpec.name = name
+	return Specs{newSpec}, nil
+}
+
+// compileLookupRule compiles a rule setting the labels found in a lookup
+// table.
+func compileLookupRule(
+	name string,
+	rule v1alpha1.RuleSpec,
+	selector k8s_labels.Selector,
+	condition cel.Program,
+) (Specs, error) {
+	if rule.Set != (v1alpha1.Label{}) {
+		return nil, &ruleError{
+			field:   "set",
+			message: "Rule with lookup must not have set, the labels come from the table",
+		}
+	}
+	lookup, err := compileLookup(rule.Lookup)
+	if err != nil {
+		return nil, &ruleError{field: "lookup", message: err.Error()}
+	}
+	newSpec := spec{
+		lookup:     lookup,
+		selector:   selector,
+		condition:  condition,
+		op:         opSet,
+		stringSpec: lookup.String(),
+		name:       name,
+	}
+	if selector != nil {
+		newSpec.stringSpec = selector.String() + ";" + newSpec.stringSpec
+	}
+	return Specs{newSpec}, nil
+}
+
+// compilePluginRule compiles a rule setting and removing the labels returned
+// by a plugin.
+func compilePluginRule(
+	name string,
+	rule v1alpha1.RuleSpec,
+	selector k8s_labels.Selector,
+	condition cel.Program,
+) (Specs, error) {
+	if rule.Set != (v1alpha1.Label{}) {
+		return nil, &ruleError{
+			field:   "set",
+			message: "Rule with plugin must not have set, the labels come from the plugin",
+		}
+	}
+	plugin, err := compilePlugin(rule.Plugin)
+	if err != nil {
+		return nil, &ruleError{field: "plugin", message: err.Error()}
+	}
+	newSpec := spec{
+		plugin:     plugin,
+		selector:   selector,
+		condition:  condition,
+		op:         opSet,
+		stringSpec: plugin.String(),
+		name:       name,
+	}
+	if selector != nil {
+		newSpec.stringSpec = selector.String() + ";" + newSpec.stringSpec
+	}
+	return Specs{newSpec}, nil
+}
+
+// compileTarget returns what the label pattern refers to.
+func compileTarget(label v1alpha1.Label) (target, error) {
+	switch label.Type {
+	case "", v1alpha1.LabelTypeLabel:
+		if label.Effect != "" {
+			return targetLabel, fmt.Errorf("Only taints can have an effect")
+		}
+		return targetLabel, nil
+	case v1alpha1.LabelTypeTaint:
+		return targetTaint, nil
+	case v1alpha1.LabelTypeAnnotation:
+		if label.Effect != "" {
+			return targetAnnotation, fmt.Errorf("Only taints can have an effect")
+		}
+		return targetAnnotation, nil
+	default:
+		return targetLabel, fmt.Errorf(
+			"Unknown type %q, must be %s, %s, or %s",
+			label.Type, v1alpha1.LabelTypeLabel, v1alpha1.LabelTypeTaint,
+			v1alpha1.LabelTypeAnnotation)
+	}
+}
+
+// formatLabel formats the label pattern as in the --relabel specs.
+func formatLabel(label v1alpha1.Label) string {
+	formatted := fmt.Sprintf("%s=%s", label.Key, label.Value)
+	switch label.Type {
+	case v1alpha1.LabelTypeAnnotation:
+		formatted += "@" + annotationSuffix
+	case v1alpha1.LabelTypeTaint:
+		effect := label.Effect
+		if effect == "" {
+			effect = "*"
+		}
+		formatted += "@" + effect
+	}
+	return formatted
+}
+
+// fieldNode returns the value node for the key in a mapping node, or
+// fallback if the key is not present.
+func fieldNode(node *yaml.Node, key string, fallback *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1]
+			}
+		}
+	}
+	return fallback
+}
+
+func newConfigError(node *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", node.Line, fmt.Sprintf(format, args...))
+}
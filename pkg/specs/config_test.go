@@ -0,0 +1,465 @@
+package specs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sampleYAMLConfig = `
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: roles
+  match:
+    key: role
+    value: "*"
+  set:
+    key: node-role.kubernetes.io/*
+    value: ""
+- name: zones
+  match:
+    key: zone
+    value: us-*
+  set:
+    key: region
+    value: us-*
+`
+
+const sampleJSONConfig = `{
+  "apiVersion": "node-relabeler.vladlosev.github.io/v1alpha1",
+  "kind": "RelabelConfig",
+  "rules": [
+    {
+      "name": "roles",
+      "match": {"key": "role", "value": "*"},
+      "set": {"key": "node-role.kubernetes.io/*", "value": ""}
+    }
+  ]
+}`
+
+// makeRuleConfig returns a config with a single rule with the name and the
+// fields given as YAML, one per line. The rule starts on line 5, and its
+// fields on line 6.
+func makeRuleConfig(name string, fields ...string) string {
+	return `
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: ` + name + `
+  ` + strings.Join(fields, "\n  ") + `
+`
+}
+
+func TestParseConfigYAML(t *testing.T) {
+	specs, err := ParseConfig([]byte(sampleYAMLConfig))
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	assert.Equal(t, "roles", specs[0].name)
+	assert.Equal(t, "^role$", specs[0].oldKeyRegexp.String())
+	assert.Equal(t, "^(.*)$", specs[0].oldValueRegexp.String())
+	assert.Equal(t, "node-role.kubernetes.io/*", specs[0].newKey)
+	assert.Equal(t, "", specs[0].newValue)
+	assert.Equal(t, "zones", specs[1].name)
+	assert.Equal(t, "^us-(.*)$", specs[1].oldValueRegexp.String())
+
+	results := specs.ApplyTo(map[string]string{"role": "gpu", "zone": "us-east"})
+	assert.Equal(
+		t,
+		map[string]string{"node-role.kubernetes.io/gpu": "", "region": "us-east"},
+		results,
+	)
+}
+
+func TestParseConfigActions(t *testing.T) {
+	specs, err := ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: migrate
+  action: move
+  match: {key: old.example.com/*, value: "true"}
+  set: {key: new.example.com/*, value: "true"}
+- name: cleanup
+  action: delete
+  match: {key: deprecated, value: "*"}
+`))
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	assert.Equal(t, opMove, specs[0].op)
+	assert.Equal(t, "-old.example.com/*=true:new.example.com/*=true", specs[0].stringSpec)
+	assert.Equal(t, opDelete, specs[1].op)
+	assert.Equal(t, "-deprecated=*", specs[1].stringSpec)
+
+	result := specs.Apply(map[string]string{"old.example.com/gpu": "true", "deprecated": "x"})
+	assert.Equal(t, map[string]string{"new.example.com/gpu": "true"}, result.Labels)
+	assert.Equal(
+		t,
+		map[string]string{"old.example.com/gpu": "migrate", "deprecated": "cleanup"},
+		result.Removed,
+	)
+}
+
+func TestParseConfigRegex(t *testing.T) {
+	specs, err := ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: pools
+  regex: true
+  match: {key: 'pool-(\d+)', value: '(?P<size>[a-z]+)'}
+  set: {key: pool, value: '${size}-$1'}
+`))
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(
+		t,
+		map[string]string{"pool": "large-3"},
+		specs.ApplyTo(map[string]string{"pool-3": "large"}),
+	)
+}
+
+func TestParseConfigMetacharacters(t *testing.T) {
+	// Outside of regex rules, everything but the wildcard is matched
+	// literally.
+	specs, err := ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: brackets
+  match: {key: "a[", value: "*"}
+  set: {key: brackets, value: "*"}
+- name: groups
+  match: {key: "b(", value: "(*)"}
+  set: {key: groups, value: "*"}
+- name: escapes
+  match: {key: 'c\', value: "*"}
+  set: {key: escapes, value: "*"}
+- name: dots
+  match: {key: d.e, value: "*"}
+  set: {key: dots, value: "*"}
+`))
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		map[string]string{"brackets": "1", "groups": "2", "escapes": "3"},
+		specs.ApplyTo(map[string]string{"a[": "1", "b(": "(2)", `c\`: "3", "dxe": "4"}),
+	)
+}
+
+func TestParseConfigSelector(t *testing.T) {
+	specs, err := ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: ingress
+  selector: env=prod,!spot
+  set: {key: node-role.kubernetes.io/ingress}
+`))
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, "env=prod,!spot;:node-role.kubernetes.io/ingress=", specs[0].stringSpec)
+	assert.Equal(
+		t,
+		map[string]string{"node-role.kubernetes.io/ingress": ""},
+		specs.ApplyTo(map[string]string{"env": "prod"}),
+	)
+	assert.Empty(t, specs.ApplyTo(map[string]string{"env": "prod", "spot": "true"}))
+}
+
+func TestParseConfigAnnotations(t *testing.T) {
+	specs, err := ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: machines
+  match: {type: annotation, key: cluster.x-k8s.io/machine, value: "*"}
+  set: {key: machine, value: "*"}
+`))
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, "cluster.x-k8s.io/machine=*@annotation:machine=*", specs[0].stringSpec)
+
+	_, err = ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: machines
+  match: {type: annotation, key: cluster.x-k8s.io/machine, value: "*", effect: NoSchedule}
+  set: {key: machine, value: "*"}
+`))
+	require.Error(t, err)
+	assert.Regexp(t, "line 6: Invalid rule \"machines\". Only taints can have an effect", err.Error())
+}
+
+func TestParseConfigJSON(t *testing.T) {
+	specs, err := ParseConfig([]byte(sampleJSONConfig))
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, "roles", specs[0].name)
+	assert.Equal(t, "node-role.kubernetes.io/*", specs[0].newKey)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(fileName, []byte(sampleYAMLConfig), 0666)
+	require.NoError(t, err)
+
+	specs, err := LoadConfig(fileName)
+	require.NoError(t, err)
+	assert.Len(t, specs, 2)
+
+	_, err = LoadConfig(filepath.Join(dir, "missing.yaml"))
+	require.Error(t, err)
+	assert.Regexp(t, "Failed to read config file", err.Error())
+}
+
+func TestParseConfigFailures(t *testing.T) {
+	testData := []struct {
+		name    string
+		config  string
+		message string
+	}{
+		{
+			"Empty",
+			"",
+			"Config is empty",
+		},
+		{
+			"WrongAPIVersion",
+			`
+apiVersion: v1
+kind: RelabelConfig
+rules: []
+`,
+			"line 2: apiVersion must be",
+		},
+		{
+			"WrongKind",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: ConfigMap
+rules: []
+`,
+			"line 3: kind must be RelabelConfig",
+		},
+		{
+			"NoRules",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules: []
+`,
+			"line 4: At least one rule",
+		},
+		{
+			"UnknownField",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: roles
+  match: {key: role, value: "*"}
+  sett: {key: node-role.kubernetes.io/*}
+`,
+			"line 7: field sett not found",
+		},
+		{
+			"MissingName",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- match: {key: role, value: "*"}
+  set: {key: node-role.kubernetes.io/*}
+`,
+			"line 5: Rule must have a name",
+		},
+		{
+			"DuplicateName",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: roles
+  match: {key: role, value: "*"}
+  set: {key: node-role.kubernetes.io/*}
+- name: roles
+  match: {key: role, value: "*"}
+  set: {key: node-role.kubernetes.io/*}
+`,
+			"line 8: Duplicate rule name",
+		},
+		{
+			"MissingMatchKey",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: roles
+  set: {key: node-role.kubernetes.io/*}
+`,
+			"line 5: Invalid rule \"roles\". Rule must have match.key",
+		},
+		{
+			"MissingSetKey",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: roles
+  match: {key: role, value: "*"}
+  set: {value: abc}
+`,
+			"line 7: Invalid rule \"roles\". Rule must have set.key",
+		},
+		{
+			"UnknownAction",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: roles
+  action: copy
+  match: {key: role, value: "*"}
+  set: {key: node-role.kubernetes.io/*}
+`,
+			"line 6: Invalid rule \"roles\". Unknown action \"copy\"",
+		},
+		{
+			"DeleteWithSet",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: roles
+  action: delete
+  match: {key: role, value: "*"}
+  set: {key: node-role.kubernetes.io/*}
+`,
+			"line 8: Invalid rule \"roles\". Delete rule must not have set",
+		},
+		{
+			"InvalidRegex",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: pools
+  regex: true
+  match: {key: "pool-(", value: "*"}
+  set: {key: pool}
+`,
+			"line 7: Invalid rule \"pools\". Invalid key pattern",
+		},
+		{
+			"InvalidRegexClass",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: pools
+  regex: true
+  match: {key: "pool-[", value: "*"}
+  set: {key: pool}
+`,
+			"line 7: Invalid rule \"pools\". Invalid key pattern",
+		},
+		{
+			"InvalidRegexEscape",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: pools
+  regex: true
+  match: {key: pool, value: 'large\'}
+  set: {key: size}
+`,
+			"line 7: Invalid rule \"pools\". Invalid value pattern",
+		},
+		{
+			"InvalidSelector",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: ingress
+  selector: env in prod
+  set: {key: node-role.kubernetes.io/ingress}
+`,
+			"line 6: Invalid rule \"ingress\". Invalid selector",
+		},
+		{
+			"DeleteWithSelectorOnly",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: cleanup
+  action: delete
+  selector: env=prod
+`,
+			"line 5: Invalid rule \"cleanup\". Rule must have match.key",
+		},
+		{
+			"InvalidTemplate",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: teams
+  match: {key: owner, value: "*"}
+  set: {key: team, value: "{{.Value | nosuchfunc}}"}
+`,
+			"line 7: Invalid rule \"teams\". Invalid template",
+		},
+		{
+			"InvalidPattern",
+			`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: roles
+  match: {key: role, value: "*"}
+  set: {key: node-role.kubernetes.io/*}
+- name: bad
+  match: {key: abc, value: def}
+  set: {key: uvw*}
+`,
+			"line 10: Invalid rule \"bad\". Wildcard pattern cannot appear",
+		},
+		{
+			"TwoWildcards",
+			makeRuleConfig("bad", `match: {key: "a*", value: "b*"}`, `set: {key: "c*"}`),
+			"line 6: Invalid rule \"bad\". oldkey=oldvalue pair should contain no more than a single",
+		},
+		{
+			"NewLabelMatchesPattern",
+			makeRuleConfig("bad", `match: {key: "a*"}`, `set: {key: "ab*"}`),
+			"line 7: Invalid rule \"bad\". newkey=newvalue pair must not match pattern",
+		},
+		{
+			"MissingCaptureGroup",
+			makeRuleConfig("bad", "regex: true", `match: {key: "a(.*)"}`, `set: {key: b, value: $2}`),
+			"line 8: Invalid rule \"bad\". .*missing capture group",
+		},
+		{
+			"SelectorWildcard",
+			makeRuleConfig("bad", "selector: env=prod", `set: {key: "b*"}`),
+			"line 7: Invalid rule \"bad\". Wildcard pattern cannot appear",
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(testItem.config))
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
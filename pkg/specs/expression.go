@@ -0,0 +1,286 @@
+package specs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// expressionNode is the node variable of CEL expressions in rules.
+type expressionNode struct {
+	Name        string             `cel:"name"`
+	Labels      map[string]string  `cel:"labels"`
+	Annotations map[string]string  `cel:"annotations"`
+	ProviderID  string             `cel:"providerID"`
+	Taints      []expressionTaint  `cel:"taints"`
+	Capacity    map[string]float64 `cel:"capacity"`
+	Allocatable map[string]float64 `cel:"allocatable"`
+	Status      expressionStatus   `cel:"status"`
+}
+
+type expressionTaint struct {
+	Key    string `cel:"key"`
+	Value  string `cel:"value"`
+	Effect string `cel:"effect"`
+}
+
+type expressionStatus struct {
+	NodeInfo  expressionNodeInfo  `cel:"nodeInfo"`
+	Addresses []expressionAddress `cel:"addresses"`
+	// Conditions maps condition types to their statuses, e.g. Ready to
+	// True.
+	Conditions map[string]string `cel:"conditions"`
+}
+
+type expressionNodeInfo struct {
+	Architecture            string `cel:"architecture"`
+	BootID                  string `cel:"bootID"`
+	ContainerRuntimeVersion string `cel:"containerRuntimeVersion"`
+	KernelVersion           string `cel:"kernelVersion"`
+	KubeProxyVersion        string `cel:"kubeProxyVersion"`
+	KubeletVersion          string `cel:"kubeletVersion"`
+	MachineID               string `cel:"machineID"`
+	OperatingSystem         string `cel:"operatingSystem"`
+	OSImage                 string `cel:"osImage"`
+	SystemUUID              string `cel:"systemUUID"`
+}
+
+type expressionAddress struct {
+	Type    string `cel:"type"`
+	Address string `cel:"address"`
+}
+
+const (
+	// expressionCostLimit is the highest cost of evaluating an expression,
+	// both as estimated when it is compiled and as measured when it is
+	// evaluated.
+	expressionCostLimit = 1000000
+	// expressionTimeout is the longest time an expression can take to
+	// evaluate.
+	expressionTimeout = time.Second
+	// expressionMaxElements and expressionMaxStringSize are the sizes of
+	// the node's lists, maps and strings assumed when the cost of an
+	// expression is estimated.
+	expressionMaxElements   = 256
+	expressionMaxStringSize = 1024
+)
+
+// quantityFunction is the name of the CEL function converting resource
+// quantities such as 256Gi to numbers.
+const quantityFunction = "quantity"
+
+// expressionEnv returns the CEL environment rule expressions are compiled in.
+var expressionEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		ext.NativeTypes(reflect.TypeOf(&expressionNode{}), ext.ParseStructTags(true)),
+		cel.Variable("node", cel.ObjectType("specs.expressionNode")),
+		cel.CrossTypeNumericComparisons(true),
+		ext.Strings(),
+		cel.Function(
+			quantityFunction,
+			cel.Overload(
+				"quantity_string",
+				[]*cel.Type{cel.StringType},
+				cel.DoubleType,
+				cel.UnaryBinding(parseQuantity),
+			),
+		),
+		cel.ASTValidators(quantityLiteralValidator{}),
+	)
+})
+
+// parseQuantity implements the quantity function.
+func parseQuantity(value ref.Val) ref.Val {
+	quantity, err := resource.ParseQuantity(value.(types.String).Value().(string))
+	if err != nil {
+		return types.NewErr("Invalid quantity %q: %s", value, err)
+	}
+	return types.Double(quantity.AsApproximateFloat64())
+}
+
+// quantityLiteralValidator reports invalid quantity literals when an
+// expression is compiled rather than when it is evaluated.
+type quantityLiteralValidator struct{}
+
+func (quantityLiteralValidator) Name() string {
+	return "node-relabeler.validate.quantity"
+}
+
+func (quantityLiteralValidator) Validate(_ *cel.Env, _ cel.ValidatorConfig, a *ast.AST, issues *cel.Issues) {
+	calls := ast.MatchDescendants(ast.NavigateAST(a), ast.FunctionMatcher(quantityFunction))
+	for _, call := range calls {
+		args := call.AsCall().Args()
+		if len(args) != 1 || args[0].Kind() != ast.LiteralKind {
+			continue
+		}
+		literal, ok := args[0].AsLiteral().Value().(string)
+		if !ok {
+			continue
+		}
+		if _, err := resource.ParseQuantity(literal); err != nil {
+			issues.ReportErrorAtID(args[0].ID(), "invalid quantity %q", literal)
+		}
+	}
+}
+
+// expressionCostEstimator bounds the sizes of the node's fields, which are
+// otherwise unbounded when the cost of an expression is estimated.
+type expressionCostEstimator struct{}
+
+func (expressionCostEstimator) EstimateSize(element checker.AstNode) *checker.SizeEstimate {
+	switch element.Type().Kind() {
+	case types.StringKind:
+		return &checker.SizeEstimate{Min: 0, Max: expressionMaxStringSize}
+	case types.ListKind, types.MapKind:
+		return &checker.SizeEstimate{Min: 0, Max: expressionMaxElements}
+	}
+	return nil
+}
+
+func (expressionCostEstimator) EstimateCallCost(
+	function, overloadID string,
+	target *checker.AstNode,
+	args []checker.AstNode,
+) *checker.CallEstimate {
+	return nil
+}
+
+// compileExpression compiles and type checks a CEL expression, which has to
+// evaluate to the output type. Expressions whose estimated cost exceeds
+// expressionCostLimit are rejected.
+func compileExpression(expression string, outputType *cel.Type) (cel.Program, error) {
+	env, err := expressionEnv()
+	if err != nil {
+		return nil, err
+	}
+	checked, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("Invalid expression %q: %w", expression, issues.Err())
+	}
+	if !checked.OutputType().IsExactType(outputType) &&
+		!checked.OutputType().IsExactType(cel.DynType) {
+		return nil, fmt.Errorf(
+			"Expression %q must evaluate to %s, not %s",
+			expression, outputType, checked.OutputType())
+	}
+	cost, err := env.EstimateCost(checked, expressionCostEstimator{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to estimate cost of expression %q: %w", expression, err)
+	}
+	if cost.Max > expressionCostLimit {
+		return nil, fmt.Errorf(
+			"Expression %q is too expensive, its estimated cost %d exceeds the limit %d",
+			expression, cost.Max, expressionCostLimit)
+	}
+	return env.Program(
+		checked,
+		cel.CostLimit(expressionCostLimit),
+		cel.InterruptCheckFrequency(100),
+	)
+}
+
+// evalExpression evaluates the expression for the node and converts the
+// result to the Go type T. Evaluation is interrupted after expressionTimeout.
+func evalExpression[T any](program cel.Program, node *expressionNode) (T, error) {
+	var result T
+	ctx, cancel := context.WithTimeout(context.Background(), expressionTimeout)
+	defer cancel()
+	value, _, err := program.ContextEval(ctx, map[string]any{"node": node})
+	if err != nil {
+		return result, err
+	}
+	result, ok := value.Value().(T)
+	if !ok {
+		return result, fmt.Errorf("Expression must evaluate to %T, not %s", result, value.Type())
+	}
+	return result, nil
+}
+
+// newExpressionNode returns the node variable for the input. When the specs
+// are applied to labels only, only the labels and the annotations are set.
+func newExpressionNode(in input) *expressionNode {
+	node := &expressionNode{
+		Labels:      in.labels,
+		Annotations: in.annotations,
+		Capacity:    map[string]float64{},
+		Allocatable: map[string]float64{},
+		Status:      expressionStatus{Conditions: map[string]string{}},
+	}
+	if node.Labels == nil {
+		node.Labels = map[string]string{}
+	}
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+	if in.node == nil {
+		return node
+	}
+	node.Name = in.node.Name
+	node.ProviderID = in.node.Spec.ProviderID
+	for _, taint := range in.node.Spec.Taints {
+		node.Taints = append(node.Taints, expressionTaint{
+			Key:    taint.Key,
+			Value:  taint.Value,
+			Effect: string(taint.Effect),
+		})
+	}
+	for name, quantity := range in.node.Status.Capacity {
+		node.Capacity[string(name)] = quantity.AsApproximateFloat64()
+	}
+	for name, quantity := range in.node.Status.Allocatable {
+		node.Allocatable[string(name)] = quantity.AsApproximateFloat64()
+	}
+	info := in.node.Status.NodeInfo
+	node.Status.NodeInfo = expressionNodeInfo{
+		Architecture:            info.Architecture,
+		BootID:                  info.BootID,
+		ContainerRuntimeVersion: info.ContainerRuntimeVersion,
+		KernelVersion:           info.KernelVersion,
+		KubeProxyVersion:        info.KubeProxyVersion,
+		KubeletVersion:          info.KubeletVersion,
+		MachineID:               info.MachineID,
+		OperatingSystem:         info.OperatingSystem,
+		OSImage:                 info.OSImage,
+		SystemUUID:              info.SystemUUID,
+	}
+	for _, address := range in.node.Status.Addresses {
+		node.Status.Addresses = append(node.Status.Addresses, expressionAddress{
+			Type:    string(address.Type),
+			Address: address.Address,
+		})
+	}
+	for _, condition := range in.node.Status.Conditions {
+		node.Status.Conditions[string(condition.Type)] = string(condition.Status)
+	}
+	return node
+}
+
+// hasExpressions returns true if any of the specs have CEL expressions.
+func (s Specs) hasExpressions() bool {
+	for _, spec := range s {
+		if spec.condition != nil || spec.newValueProgram != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesCondition returns true if the spec has no condition or its
+// condition holds for the node. Returns an error if the condition fails to
+// evaluate.
+func (s *spec) matchesCondition(in input) (bool, error) {
+	if s.condition == nil {
+		return true, nil
+	}
+	return evalExpression[bool](s.condition, in.expressionNode)
+}
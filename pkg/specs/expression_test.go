@@ -0,0 +1,257 @@
+package specs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestApplyExpressions(t *testing.T) {
+	testData := []struct {
+		name     string
+		rule     string
+		memory   string
+		arch     string
+		expected map[string]string
+	}{
+		{
+			"ConditionHolds",
+			`condition: node.capacity.memory > quantity('256Gi') && node.labels['kubernetes.io/arch'] == 'arm64'
+  set: {key: pool, value: highmem}`,
+			"512Gi",
+			"arm64",
+			map[string]string{"pool": "highmem"},
+		},
+		{
+			"ConditionFails",
+			`condition: node.capacity.memory > quantity('256Gi') && node.labels['kubernetes.io/arch'] == 'arm64'
+  set: {key: pool, value: highmem}`,
+			"128Gi",
+			"arm64",
+			map[string]string{},
+		},
+		{
+			"CrossTypeComparison",
+			`condition: node.capacity.cpu >= 64 && node.allocatable.cpu < 64
+  set: {key: cpu-class, value: large}`,
+			"1Gi",
+			"amd64",
+			map[string]string{"cpu-class": "large"},
+		},
+		{
+			"ConditionWithMatch",
+			`condition: "'example.com/owner' in node.annotations"
+  match: {key: team, value: "*"}
+  set: {key: owned-team, value: "*"}`,
+			"1Gi",
+			"amd64",
+			map[string]string{"owned-team": "ml"},
+		},
+		{
+			"ConditionWithSelector",
+			`selector: team=ml
+  condition: node.status.conditions.Ready == 'True'
+  set: {key: ready}`,
+			"1Gi",
+			"amd64",
+			map[string]string{"ready": ""},
+		},
+		{
+			"StatusFields",
+			`condition: >-
+    node.status.addresses.exists(a, a.type == 'InternalIP' && a.address.startsWith('10.1.')) &&
+    node.taints.exists(t, t.key == 'dedicated' && t.effect == 'NoSchedule') &&
+    node.providerID.startsWith('aws://')
+  set: {key: site, value: one}`,
+			"1Gi",
+			"amd64",
+			map[string]string{"site": "one"},
+		},
+		{
+			"ValueExpression",
+			`condition: node.name != ''
+  set:
+    key: kubelet-minor
+    valueExpression: node.status.nodeInfo.kubeletVersion.split('.')[1]`,
+			"1Gi",
+			"amd64",
+			map[string]string{"kubelet-minor": "32"},
+		},
+		{
+			"ValueExpressionWithMatch",
+			`match: {key: team, value: "*"}
+  set:
+    key: os
+    valueExpression: node.status.nodeInfo.osImage.split(' ')[0].lowerAscii()`,
+			"1Gi",
+			"amd64",
+			map[string]string{"os": "ubuntu"},
+		},
+		{
+			"ValueOfBucket",
+			`resource:
+    name: memory
+    buckets:
+    - max: 8Gi
+      value: small
+    - min: 8Gi
+  set: {key: memory, valueExpression: "'large-' + node.status.nodeInfo.architecture"}`,
+			"1Gi",
+			"amd64",
+			map[string]string{"memory": "small"},
+		},
+		{
+			"EvaluationError",
+			`condition: node.labels['missing'] == 'x'
+  set: {key: never}`,
+			"1Gi",
+			"amd64",
+			map[string]string{},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			specs, err := ParseConfig([]byte(makeRuleConfig("test", testItem.rule)))
+			require.NoError(t, err)
+			node := &core_v1.Node{
+				ObjectMeta: meta_v1.ObjectMeta{
+					Name:        "node-1",
+					Labels:      map[string]string{"kubernetes.io/arch": testItem.arch, "team": "ml"},
+					Annotations: map[string]string{"example.com/owner": "alice"},
+				},
+				Spec: core_v1.NodeSpec{
+					ProviderID: "aws:///us-east-1a/i-0123",
+					Taints: []core_v1.Taint{
+						{Key: "dedicated", Value: "gpu", Effect: core_v1.TaintEffectNoSchedule},
+					},
+				},
+				Status: core_v1.NodeStatus{
+					Capacity: core_v1.ResourceList{
+						core_v1.ResourceMemory: resource.MustParse(testItem.memory),
+						core_v1.ResourceCPU:    resource.MustParse("64"),
+					},
+					Allocatable: core_v1.ResourceList{
+						core_v1.ResourceCPU: resource.MustParse("63500m"),
+					},
+					NodeInfo: core_v1.NodeSystemInfo{
+						Architecture:   testItem.arch,
+						KubeletVersion: "v1.32.1",
+						OSImage:        "Ubuntu 24.04 LTS",
+					},
+					Addresses: []core_v1.NodeAddress{
+						{Type: core_v1.NodeInternalIP, Address: "10.1.2.3"},
+					},
+					Conditions: []core_v1.NodeCondition{
+						{Type: core_v1.NodeReady, Status: core_v1.ConditionTrue},
+					},
+				},
+			}
+			assert.Equal(t, testItem.expected, specs.ApplyToNode(node).Labels)
+		})
+	}
+}
+
+func TestApplyExpressionsToLabels(t *testing.T) {
+	specs, err := ParseConfig([]byte(makeRuleConfig("test", `condition: node.labels.team == 'ml'
+  set: {key: gpu-team, valueExpression: "node.labels.team.upperAscii()"}`)))
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		map[string]string{"gpu-team": "ML"},
+		specs.ApplyTo(map[string]string{"team": "ml"}),
+	)
+	assert.Empty(t, specs.ApplyTo(map[string]string{"team": "web"}))
+	assert.Empty(t, specs.ApplyTo(nil))
+}
+
+func TestParseExpressionFailures(t *testing.T) {
+	testData := []struct {
+		name    string
+		rule    string
+		message string
+	}{
+		{
+			"SyntaxError",
+			"condition: node.name ==\n  set: {key: abc}",
+			"line 6: Invalid rule \"test\". Invalid expression \"node.name ==\": .*Syntax error",
+		},
+		{
+			"UndefinedField",
+			"condition: node.capcity.memory > 0\n  set: {key: abc}",
+			"line 6: Invalid rule \"test\". Invalid expression .*undefined field 'capcity'",
+		},
+		{
+			"UndeclaredVariable",
+			"condition: pod.name == 'x'\n  set: {key: abc}",
+			"line 6: .*undeclared reference to 'pod'",
+		},
+		{
+			"ConditionNotBool",
+			"condition: node.name\n  set: {key: abc}",
+			"line 6: Invalid rule \"test\". Expression \"node.name\" must evaluate to bool, not string",
+		},
+		{
+			"InvalidQuantity",
+			"condition: node.capacity.memory > quantity('256GiB')\n  set: {key: abc}",
+			"line 6: .*invalid quantity \"256GiB\"",
+		},
+		{
+			"TooExpensive",
+			"condition: \"node.labels.exists(a, node.annotations.exists(b, node.taints.exists(t, t.key == a + b)))\"\n  set: {key: abc}",
+			"line 6: Invalid rule \"test\". Expression .* is too expensive, its estimated cost [0-9]+ exceeds the limit 1000000",
+		},
+		{
+			"ValueNotString",
+			"condition: node.name != ''\n  set: {key: abc, valueExpression: node.capacity.cpu}",
+			"line 7: Invalid rule \"test\". Expression \"node.capacity.cpu\" must evaluate to string, not double",
+		},
+		{
+			"ValueAndValueExpression",
+			"condition: node.name != ''\n  set: {key: abc, value: x, valueExpression: node.name}",
+			"line 7: Invalid rule \"test\". Set must not have both value and valueExpression",
+		},
+		{
+			"ValueExpressionInMatch",
+			"match: {key: abc, valueExpression: node.name}\n  set: {key: abc}",
+			"line 6: Invalid rule \"test\". Only set can have a valueExpression",
+		},
+		{
+			"NoSource",
+			"set: {key: abc, valueExpression: node.name}",
+			"line 5: Invalid rule \"test\". Rule must have match.key, selector, condition",
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(makeRuleConfig("test", testItem.rule)))
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
+
+func TestApplyInvalidExpressionValue(t *testing.T) {
+	specs, err := ParseConfig([]byte(makeRuleConfig("test", `condition: has(node.labels.team)
+  set: {key: gpu-team, valueExpression: "node.labels.team + ' team'"}`)))
+	require.NoError(t, err)
+	result := specs.Apply(map[string]string{"team": "ml"})
+	assert.Empty(t, result.Labels)
+	assert.Equal(t, []string{"test"}, result.Failed)
+	require.Contains(t, result.Errors, "test")
+	assert.Contains(t, result.Errors["test"].Error(), "Invalid value of label gpu-team")
+}
+
+func TestApplyConditionFailure(t *testing.T) {
+	specs, err := ParseConfig([]byte(makeRuleConfig("test", `condition: node.labels.team == 'ml'
+  set: {key: gpu-team, value: ml}`)))
+	require.NoError(t, err)
+	result := specs.Apply(map[string]string{"role": "gpu"})
+	assert.Empty(t, result.Labels)
+	assert.Equal(t, []string{"test"}, result.Failed)
+	require.Contains(t, result.Errors, "test")
+	assert.Contains(t, result.Errors["test"].Error(), "no such key: team")
+}
@@ -0,0 +1,134 @@
+package specs
+
+import (
+	"fmt"
+	"strings"
+
+	core_v1 "k8s.io/api/core/v1"
+)
+
+// nodeFieldPaths are the paths of the node fields rules can match instead of
+// labels, as used in the old label key.
+var nodeFieldPaths = []string{
+	".metadata.name",
+	".spec.providerID",
+	".status.nodeInfo.architecture",
+	".status.nodeInfo.bootID",
+	".status.nodeInfo.containerRuntimeVersion",
+	".status.nodeInfo.kernelVersion",
+	".status.nodeInfo.kubeProxyVersion",
+	".status.nodeInfo.kubeletVersion",
+	".status.nodeInfo.machineID",
+	".status.nodeInfo.operatingSystem",
+	".status.nodeInfo.osImage",
+	".status.nodeInfo.systemUUID",
+}
+
+// nodeField returns the value of the node field with the path.
+func nodeField(node *core_v1.Node, path string) string {
+	info := node.Status.NodeInfo
+	switch path {
+	case ".metadata.name":
+		return node.Name
+	case ".spec.providerID":
+		return node.Spec.ProviderID
+	case ".status.nodeInfo.architecture":
+		return info.Architecture
+	case ".status.nodeInfo.bootID":
+		return info.BootID
+	case ".status.nodeInfo.containerRuntimeVersion":
+		return info.ContainerRuntimeVersion
+	case ".status.nodeInfo.kernelVersion":
+		return info.KernelVersion
+	case ".status.nodeInfo.kubeProxyVersion":
+		return info.KubeProxyVersion
+	case ".status.nodeInfo.kubeletVersion":
+		return info.KubeletVersion
+	case ".status.nodeInfo.machineID":
+		return info.MachineID
+	case ".status.nodeInfo.operatingSystem":
+		return info.OperatingSystem
+	case ".status.nodeInfo.osImage":
+		return info.OSImage
+	case ".status.nodeInfo.systemUUID":
+		return info.SystemUUID
+	}
+	return ""
+}
+
+// Prefixes of the paths of the node's resource quantities, followed by the
+// resource name.
+const (
+	capacityPathPrefix    = ".status.capacity."
+	allocatablePathPrefix = ".status.allocatable."
+)
+
+// NodeFields returns the values of the node fields rules can match, by path.
+// Fields that are not set are omitted.
+func NodeFields(node *core_v1.Node) map[string]string {
+	fields := map[string]string{}
+	for _, path := range nodeFieldPaths {
+		if value := nodeField(node, path); value != "" {
+			fields[path] = value
+		}
+	}
+	for name, quantity := range node.Status.Capacity {
+		fields[capacityPathPrefix+string(name)] = quantity.String()
+	}
+	for name, quantity := range node.Status.Allocatable {
+		fields[allocatablePathPrefix+string(name)] = quantity.String()
+	}
+	for name, value := range ParseProviderID(node.Spec.ProviderID) {
+		fields[providerIDPathPrefix+name] = value
+	}
+	return fields
+}
+
+// compileSource determines whether the spec matches a node field or a label,
+// and validates the field. Label keys cannot start with a dot, so old keys
+// starting with one refer to node fields. In regular expressions, the dot
+// has to be escaped, so that patterns like .* still match labels.
+func (s *spec) compileSource() error {
+	switch {
+	case s.oldKeyRegexp == nil, s.oldTarget != targetLabel:
+		return nil
+	case s.captureRegexp != nil:
+		s.fieldSource = strings.HasPrefix(s.oldKey, `\.`)
+	default:
+		s.fieldSource = strings.HasPrefix(s.oldKey, ".")
+		if s.fieldSource && !strings.Contains(s.oldKey, "*") && !isNodeField(s.oldKey) {
+			return unknownNodeFieldError(s.oldKey)
+		}
+	}
+	if s.fieldSource && s.op != opSet {
+		return fmt.Errorf("Node fields cannot be moved or deleted")
+	}
+	return nil
+}
+
+func unknownNodeFieldError(path string) error {
+	return fmt.Errorf(
+		"Unknown node field %s, must be %s<resource>, %s<resource>, "+
+			"%s<field>, or one of %s",
+		path, capacityPathPrefix, allocatablePathPrefix, providerIDPathPrefix,
+		strings.Join(nodeFieldPaths, ", "))
+}
+
+// isNodeField returns true if the path refers to a known node field.
+func isNodeField(path string) bool {
+	for _, prefix := range []string{
+		capacityPathPrefix,
+		allocatablePathPrefix,
+		providerIDPathPrefix,
+	} {
+		if strings.HasPrefix(path, prefix) && len(path) > len(prefix) {
+			return true
+		}
+	}
+	for _, fieldPath := range nodeFieldPaths {
+		if path == fieldPath {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package specs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestNode() *core_v1.Node {
+	return &core_v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:   "test-node",
+			Labels: map[string]string{"env": "prod"},
+		},
+		Spec: core_v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123456789abcdef0"},
+		Status: core_v1.NodeStatus{NodeInfo: core_v1.NodeSystemInfo{
+			KernelVersion:           "6.1.0-18-amd64",
+			OSImage:                 "Debian GNU/Linux 12 (bookworm)",
+			ContainerRuntimeVersion: "containerd://1.7.2",
+			KubeletVersion:          "v1.32.0",
+			OperatingSystem:         "linux",
+			Architecture:            "amd64",
+		}},
+	}
+}
+
+func TestNodeFields(t *testing.T) {
+	fields := NodeFields(newTestNode())
+	assert.Equal(t, "aws:///us-east-1a/i-0123456789abcdef0", fields[".spec.providerID"])
+	assert.Equal(t, "6.1.0-18-amd64", fields[".status.nodeInfo.kernelVersion"])
+	assert.Equal(t, "amd64", fields[".status.nodeInfo.architecture"])
+	assert.NotContains(t, fields, ".status.nodeInfo.bootID")
+}
+
+func TestApplyToNodeFields(t *testing.T) {
+	testData := []struct {
+		name     string
+		regex    bool
+		spec     string
+		expected map[string]string
+	}{
+		{
+			"Glob",
+			false,
+			".status.nodeInfo.architecture=*:arch=*",
+			map[string]string{"arch": "amd64"},
+		},
+		{
+			"Regex",
+			true,
+			`\.status\.nodeInfo\.containerRuntimeVersion=(\w+)\://.*:runtime=$1`,
+			map[string]string{"runtime": "containerd"},
+		},
+		{
+			"RegexKernelMajor",
+			true,
+			`\.status\.nodeInfo\.kernelVersion=(?P<major>\d+)\..*:kernel-major=${major}`,
+			map[string]string{"kernel-major": "6"},
+		},
+		{
+			"Template",
+			false,
+			`.status.nodeInfo.osImage=*:os={{.Value | lower | truncate 6}}`,
+			map[string]string{"os": "debian"},
+		},
+		{
+			"FieldsInTemplate",
+			false,
+			`env=prod;:kubelet={{index .Fields ".status.nodeInfo.kubeletVersion"}}`,
+			map[string]string{"kubelet": "v1.32.0"},
+		},
+		{
+			"LabelSpecsIgnoreFields",
+			true,
+			`.*=linux:os=linux`,
+			map[string]string{},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			parse := Parse
+			if testItem.regex {
+				parse = ParseRegex
+			}
+			specs, err := parse([]string{testItem.spec})
+			require.NoError(t, err)
+			assert.Equal(t, testItem.expected, specs.ApplyToNode(newTestNode()).Labels)
+		})
+	}
+}
+
+func TestMatchesNode(t *testing.T) {
+	specs, err := Parse([]string{".status.nodeInfo.operatingSystem=linux:os=linux"})
+	require.NoError(t, err)
+	assert.True(t, specs.MatchesNode(newTestNode()))
+	assert.False(t, specs.Matches(newTestNode().Labels))
+}
+
+func TestParseNodeFieldFailures(t *testing.T) {
+	testData := []struct {
+		name    string
+		spec    string
+		message string
+	}{
+		{"UnknownField", ".status.nodeInfo.kernel=*:kernel=*", "Unknown node field"},
+		{"Delete", "-.spec.providerID=*", "cannot be moved or deleted"},
+		{"Move", "-.spec.providerID=*:provider=*", "cannot be moved or deleted"},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := Parse([]string{testItem.spec})
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
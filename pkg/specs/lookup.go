@@ -0,0 +1,218 @@
+package specs
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/vladlosev/node-relabeler/pkg/apis/noderelabeler/v1alpha1"
+)
+
+// LookupTable maps keys, such as node names or serial numbers, to the labels
+// to set on the matching nodes. Tables are registered by name with
+// RegisterLookupTable and filled with Load, which can be called again
+// whenever the table's source changes.
+type LookupTable struct {
+	name string
+
+	// lock guards rows.
+	lock sync.RWMutex
+	// rows maps the keys to the labels. Nil until the table is loaded.
+	rows map[string]map[string]string
+}
+
+var (
+	// lookupTablesLock guards lookupTables.
+	lookupTablesLock sync.Mutex
+	// lookupTables are the registered lookup tables by name.
+	lookupTables = map[string]*LookupTable{}
+)
+
+// RegisterLookupTable registers a lookup table rules can refer to by name,
+// and returns it. Registering the same name again returns the same table.
+// Rules referring to a table that is not loaded yet are skipped.
+func RegisterLookupTable(name string) *LookupTable {
+	lookupTablesLock.Lock()
+	defer lookupTablesLock.Unlock()
+	if table, ok := lookupTables[name]; ok {
+		return table
+	}
+	table := &LookupTable{name: name}
+	lookupTables[name] = table
+	return table
+}
+
+// findLookupTable returns the registered lookup table with the name, or nil.
+func findLookupTable(name string) *LookupTable {
+	lookupTablesLock.Lock()
+	defer lookupTablesLock.Unlock()
+	return lookupTables[name]
+}
+
+// Name returns the name of the table.
+func (t *LookupTable) Name() string {
+	return t.name
+}
+
+// Load replaces the contents of the table with the data. The format is
+// selected by the extension of the file name the data comes from: .csv for
+// CSV with a header row, where the first column has the keys and the other
+// columns are labels, or .yaml, .yml, or .json for a mapping of keys to
+// mappings of labels.
+func (t *LookupTable) Load(fileName string, data []byte) error {
+	var rows map[string]map[string]string
+	var err error
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".csv":
+		rows, err = parseCSVTable(data)
+	case ".yaml", ".yml", ".json":
+		rows, err = parseYAMLTable(data)
+	default:
+		return fmt.Errorf(
+			"Unknown lookup table format of %s, must be .csv, .yaml, .yml, or .json", fileName)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid lookup table %s: %w", fileName, err)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.rows = rows
+	return nil
+}
+
+// lookup returns the labels for the key and whether the table has it, or
+// false for loaded if the table is not loaded yet.
+func (t *LookupTable) lookup(key string) (labels map[string]string, found bool, loaded bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	labels, found = t.rows[key]
+	return labels, found, t.rows != nil
+}
+
+func parseCSVTable(data []byte) (map[string]map[string]string, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("Table must have a header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < 2 {
+		return nil, fmt.Errorf("Table must have a key column and at least one label column")
+	}
+	for i, column := range header[1:] {
+		if column == "" {
+			return nil, fmt.Errorf("Column %d has no label key", i+2)
+		}
+	}
+	rows := map[string]map[string]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		key := record[0]
+		if _, ok := rows[key]; ok {
+			return nil, fmt.Errorf("line %d: Duplicate key %q", line, key)
+		}
+		labels := map[string]string{}
+		for i, value := range record[1:] {
+			// Empty cells leave the label unset.
+			if value != "" {
+				labels[header[i+1]] = value
+			}
+		}
+		rows[key] = labels
+	}
+	return rows, nil
+}
+
+func parseYAMLTable(data []byte) (map[string]map[string]string, error) {
+	rows := map[string]map[string]string{}
+	if err := yaml.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	for key, labels := range rows {
+		if labels == nil {
+			rows[key] = map[string]string{}
+		}
+	}
+	return rows, nil
+}
+
+// lookupMatch sets the labels found in a lookup table by the value of a
+// node label or field.
+type lookupMatch struct {
+	table *LookupTable
+	// key is the key of the label or the path of the node field to look
+	// up.
+	key string
+	// fieldSource is set if key refers to a node field.
+	fieldSource bool
+	// defaults are the labels to set if the value is not in the table.
+	defaults map[string]string
+}
+
+// compileLookup validates the lookup of a rule.
+func compileLookup(lookup *v1alpha1.LookupMatch) (*lookupMatch, error) {
+	if lookup.Table == "" {
+		return nil, fmt.Errorf("Lookup must have a table")
+	}
+	table := findLookupTable(lookup.Table)
+	if table == nil {
+		return nil, fmt.Errorf("Unknown lookup table %q", lookup.Table)
+	}
+	if lookup.Key == "" {
+		return nil, fmt.Errorf("Lookup must have a key")
+	}
+	compiled := &lookupMatch{
+		table:       table,
+		key:         lookup.Key,
+		fieldSource: strings.HasPrefix(lookup.Key, "."),
+		defaults:    lookup.Default,
+	}
+	if compiled.fieldSource && !isNodeField(lookup.Key) {
+		return nil, unknownNodeFieldError(lookup.Key)
+	}
+	return compiled, nil
+}
+
+// find returns the labels for the node, and whether its value was missing
+// from the table. Returns no labels if the node has no value to look up or
+// the table is not loaded yet.
+func (m *lookupMatch) find(in input) (map[string]string, bool) {
+	source := in.labels
+	if m.fieldSource {
+		source = in.fields
+	}
+	value, ok := source[m.key]
+	if !ok {
+		return nil, false
+	}
+	labels, found, loaded := m.table.lookup(value)
+	switch {
+	case !loaded:
+		return nil, false
+	case !found:
+		return m.defaults, true
+	default:
+		return labels, false
+	}
+}
+
+// String returns the lookup as shown in the spec.
+func (m *lookupMatch) String() string {
+	return fmt.Sprintf("%s@lookup(%s)", m.key, m.table.name)
+}
@@ -0,0 +1,223 @@
+package specs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const sampleCSVTable = `hostname,rack,room,owner
+node-1,r1,a,ml
+node-2, r2,b,
+`
+
+const sampleYAMLTable = `
+SN123: {rack: r1, room: a}
+SN456: {rack: r2}
+`
+
+func TestLookupTableLoad(t *testing.T) {
+	table := &LookupTable{name: "test"}
+	_, _, loaded := table.lookup("node-1")
+	assert.False(t, loaded)
+
+	require.NoError(t, table.Load("hosts.csv", []byte(sampleCSVTable)))
+	labels, found, loaded := table.lookup("node-1")
+	assert.True(t, loaded)
+	assert.True(t, found)
+	assert.Equal(t, map[string]string{"rack": "r1", "room": "a", "owner": "ml"}, labels)
+	labels, found, _ = table.lookup("node-2")
+	assert.True(t, found)
+	assert.Equal(t, map[string]string{"rack": "r2", "room": "b"}, labels)
+	_, found, _ = table.lookup("node-3")
+	assert.False(t, found)
+
+	require.NoError(t, table.Load("/etc/inventory/serials.YAML", []byte(sampleYAMLTable)))
+	labels, found, _ = table.lookup("SN456")
+	assert.True(t, found)
+	assert.Equal(t, map[string]string{"rack": "r2"}, labels)
+	_, found, _ = table.lookup("node-1")
+	assert.False(t, found)
+}
+
+func TestLookupTableLoadFailures(t *testing.T) {
+	testData := []struct {
+		name     string
+		fileName string
+		data     string
+		message  string
+	}{
+		{"UnknownFormat", "hosts.txt", "a,b\n", "Unknown lookup table format of hosts.txt"},
+		{"Empty", "hosts.csv", "", "Table must have a header row"},
+		{"KeyOnly", "hosts.csv", "hostname\nnode-1\n", "at least one label column"},
+		{"EmptyColumn", "hosts.csv", "hostname,,room\n", "Column 2 has no label key"},
+		{"Duplicate", "hosts.csv", "hostname,rack\nnode-1,r1\nnode-1,r2\n", "line 3: Duplicate key \"node-1\""},
+		{"WrongFieldCount", "hosts.csv", "hostname,rack\nnode-1,r1,extra\n", "wrong number of fields"},
+		{"InvalidYAML", "hosts.yaml", "node-1: [r1]\n", "Invalid lookup table hosts.yaml"},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			table := &LookupTable{name: "test"}
+			err := table.Load(testItem.fileName, []byte(testItem.data))
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
+
+func TestRegisterLookupTable(t *testing.T) {
+	table := RegisterLookupTable("test-register")
+	assert.Same(t, table, RegisterLookupTable("test-register"))
+	assert.Same(t, table, findLookupTable("test-register"))
+	assert.Equal(t, "test-register", table.Name())
+	assert.Nil(t, findLookupTable("test-missing"))
+}
+
+func TestApplyLookup(t *testing.T) {
+	hosts := RegisterLookupTable("test-hosts")
+	require.NoError(t, hosts.Load("hosts.csv", []byte(sampleCSVTable)))
+	serials := RegisterLookupTable("test-serials")
+	require.NoError(t, serials.Load("serials.yaml", []byte(sampleYAMLTable)))
+	RegisterLookupTable("test-unloaded")
+
+	specs, err := ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: hosts
+  lookup:
+    table: test-hosts
+    key: .metadata.name
+    default: {owner: unknown}
+- name: serials
+  selector: "!skip"
+  lookup:
+    table: test-serials
+    key: serial
+- name: unloaded
+  lookup:
+    table: test-unloaded
+    key: .metadata.name
+    default: {unloaded: "true"}
+`))
+	require.NoError(t, err)
+	require.Len(t, specs, 3)
+	assert.Equal(t, ".metadata.name@lookup(test-hosts)", specs[0].stringSpec)
+	assert.Equal(t, "!skip;serial@lookup(test-serials)", specs[1].stringSpec)
+
+	testData := []struct {
+		name      string
+		labels    map[string]string
+		expected  map[string]string
+		unmatched []string
+	}{
+		{
+			"node-1",
+			map[string]string{"serial": "SN123"},
+			map[string]string{"rack": "r1", "room": "a", "owner": "ml"},
+			nil,
+		},
+		{
+			"node-2",
+			nil,
+			map[string]string{"rack": "r2", "room": "b"},
+			nil,
+		},
+		{
+			"node-3",
+			map[string]string{"serial": "SN456"},
+			map[string]string{"rack": "r2", "owner": "unknown"},
+			[]string{"hosts"},
+		},
+		{
+			"node-4",
+			map[string]string{"serial": "SN789"},
+			map[string]string{"owner": "unknown"},
+			[]string{"hosts", "serials"},
+		},
+		{
+			"node-5",
+			map[string]string{"serial": "SN789", "skip": ""},
+			map[string]string{"owner": "unknown"},
+			[]string{"hosts"},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+				Name:   testItem.name,
+				Labels: testItem.labels,
+			}}
+			result := specs.ApplyToNode(node)
+			assert.Equal(t, testItem.expected, result.Labels)
+			assert.Equal(t, testItem.unmatched, result.Unmatched)
+			for key := range testItem.expected {
+				assert.NotEmpty(t, result.Rules[key])
+			}
+		})
+	}
+}
+
+func TestParseLookupFailures(t *testing.T) {
+	RegisterLookupTable("test-failures")
+	testData := []struct {
+		name    string
+		rule    string
+		message string
+	}{
+		{
+			"UnknownTable",
+			`lookup: {table: test-nosuchtable, key: .metadata.name}`,
+			"line 6: Invalid rule \"hosts\". Unknown lookup table \"test-nosuchtable\"",
+		},
+		{
+			"MissingTable",
+			`lookup: {key: .metadata.name}`,
+			"Lookup must have a table",
+		},
+		{
+			"MissingKey",
+			`lookup: {table: test-failures}`,
+			"Lookup must have a key",
+		},
+		{
+			"UnknownField",
+			`lookup: {table: test-failures, key: .metadata.uid}`,
+			"Unknown node field .metadata.uid",
+		},
+		{
+			"WithSet",
+			`lookup: {table: test-failures, key: .metadata.name}
+  set: {key: rack}`,
+			"line 7: Invalid rule \"hosts\". Rule with lookup must not have set",
+		},
+		{
+			"WithMatch",
+			`lookup: {table: test-failures, key: .metadata.name}
+  match: {key: rack, value: "*"}`,
+			"Rule must not have both match and lookup",
+		},
+		{
+			"WithCIDR",
+			`lookup: {table: test-failures, key: .metadata.name}
+  cidr: {ranges: [{cidr: 10.0.0.0/8}]}`,
+			"Rule must not have both cidr and lookup",
+		},
+		{
+			"Move",
+			`action: move
+  lookup: {table: test-failures, key: .metadata.name}`,
+			"Rule with lookup must have action set",
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(makeRuleConfig("hosts", testItem.rule)))
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package specs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/vladlosev/node-relabeler/pkg/apis/noderelabeler/v1alpha1"
+)
+
+// DefaultPluginTimeout is the default time a plugin has to respond.
+const DefaultPluginTimeout = 5 * time.Second
+
+const (
+	// pluginFailureBackoff is how long a failure is returned from the cache
+	// before the plugin is called again for the same version of a node. It
+	// doubles with each consecutive failure, up to pluginMaxFailureBackoff.
+	pluginFailureBackoff    = time.Second
+	pluginMaxFailureBackoff = 5 * time.Minute
+)
+
+// PluginRequest is the JSON document sent to a plugin for each node.
+type PluginRequest struct {
+	// Rule is the name of the rule calling the plugin.
+	Rule string `json:"rule"`
+	// Node is the metadata of the node.
+	Node PluginNode `json:"node"`
+}
+
+// PluginNode is the node metadata sent to a plugin.
+type PluginNode struct {
+	Name            string            `json:"name"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	// Fields are the node fields rules can match, by path, e.g.
+	// .spec.providerID.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// PluginResponse is the JSON document a plugin returns for a node.
+type PluginResponse struct {
+	// Labels are the labels to set on the node. They are owned by the rule
+	// and removed once the plugin stops returning them.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Remove are the keys of the labels to remove from the node.
+	Remove []string `json:"remove,omitempty"`
+}
+
+// Plugin is an external labeller, either a command receiving a
+// PluginRequest on its standard input and writing a PluginResponse to its
+// standard output, or an HTTP endpoint receiving the request in a POST and
+// returning the response in the body. Plugins are registered by name with
+// RegisterPlugin, so that rules can only call the plugins set up by the
+// operator of the controller.
+type Plugin struct {
+	name string
+	// command is the command line of an exec plugin.
+	command []string
+	// url is the endpoint of an HTTP plugin.
+	url     string
+	timeout time.Duration
+	client  *http.Client
+
+	// failureBackoff is the time the first failure for a version of a node
+	// is cached for.
+	failureBackoff time.Duration
+
+	// cacheLock guards cache.
+	cacheLock sync.Mutex
+	// cache keeps the last response or failure for each rule and node.
+	// Entries are evicted when their node is deleted or their rule removed.
+	cache map[pluginCacheKey]pluginCacheEntry
+}
+
+// pluginCacheKey identifies the rule and node a plugin was called for.
+type pluginCacheKey struct {
+	rule string
+	node string
+}
+
+// pluginCacheEntry is a plugin response or failure for a version of a node.
+type pluginCacheEntry struct {
+	resourceVersion string
+	response        *PluginResponse
+	// err is set if the plugin failed. It is returned until retryAfter,
+	// after which the plugin is called again.
+	err        error
+	failures   int
+	retryAfter time.Time
+}
+
+var (
+	// pluginsLock guards plugins.
+	pluginsLock sync.Mutex
+	// plugins are the registered plugins by name.
+	plugins = map[string]*Plugin{}
+)
+
+// RegisterPlugin registers a plugin rules can refer to by name. An endpoint
+// starting with http:// or https:// is called over HTTP, otherwise it is a
+// command line, split on white space. The plugin has to respond within the
+// timeout, or DefaultPluginTimeout if it is zero. Registering the same name
+// again replaces the plugin for the rules compiled afterwards.
+func RegisterPlugin(name string, endpoint string, timeout time.Duration) (*Plugin, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Plugin must have a name")
+	}
+	if timeout <= 0 {
+		timeout = DefaultPluginTimeout
+	}
+	plugin := &Plugin{
+		name:           name,
+		timeout:        timeout,
+		failureBackoff: pluginFailureBackoff,
+		cache:          map[pluginCacheKey]pluginCacheEntry{},
+	}
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		plugin.url = endpoint
+		plugin.client = &http.Client{}
+	} else {
+		plugin.command = strings.Fields(endpoint)
+		if len(plugin.command) == 0 {
+			return nil, fmt.Errorf("Plugin %s must have a command or a URL", name)
+		}
+	}
+
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	plugins[name] = plugin
+	return plugin, nil
+}
+
+// findPlugin returns the registered plugin with the name, or nil.
+func findPlugin(name string) *Plugin {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	return plugins[name]
+}
+
+// ForgetNode evicts the cached plugin responses for the node, once it has
+// been deleted.
+func ForgetNode(name string) {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	for _, plugin := range plugins {
+		plugin.forget(func(key pluginCacheKey) bool { return key.node == name })
+	}
+}
+
+// ForgetRemovedRules evicts the cached plugin responses for the rules not in
+// the specs, once the specs have replaced the ones in use.
+func (s Specs) ForgetRemovedRules() {
+	rules := map[string]bool{}
+	for _, spec := range s {
+		if spec.plugin != nil {
+			rules[spec.name] = true
+		}
+	}
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	for _, plugin := range plugins {
+		plugin.forget(func(key pluginCacheKey) bool { return !rules[key.rule] })
+	}
+}
+
+// Name returns the name of the plugin.
+func (p *Plugin) Name() string {
+	return p.name
+}
+
+// forget evicts the cache entries with the keys matching the predicate.
+func (p *Plugin) forget(matches func(key pluginCacheKey) bool) {
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+	for key := range p.cache {
+		if matches(key) {
+			delete(p.cache, key)
+		}
+	}
+}
+
+// call returns the plugin's response to the request. Responses are cached
+// until the node's resource version changes. If cacheFailures is set,
+// failures are cached as well, with a backoff doubling on each consecutive
+// failure for the same version of the node. Otherwise the caller backs off
+// by itself, e.g. by retrying the node with the rate limiter of the node
+// queue, and every call reaches the plugin.
+func (p *Plugin) call(request PluginRequest, cacheFailures bool) (*PluginResponse, error) {
+	cacheKey := pluginCacheKey{rule: request.Rule, node: request.Node.Name}
+	version := request.Node.ResourceVersion
+	if version == "" {
+		return p.callUncached(request)
+	}
+
+	p.cacheLock.Lock()
+	entry, ok := p.cache[cacheKey]
+	p.cacheLock.Unlock()
+	if ok && entry.resourceVersion == version {
+		if entry.err == nil {
+			return entry.response, nil
+		}
+		if cacheFailures && time.Now().Before(entry.retryAfter) {
+			return nil, entry.err
+		}
+	}
+
+	response, err := p.callUncached(request)
+	if err != nil && !cacheFailures {
+		return nil, err
+	}
+	newEntry := pluginCacheEntry{resourceVersion: version, response: response}
+	if err != nil {
+		newEntry.err = err
+		newEntry.failures = 1
+		if ok && entry.resourceVersion == version {
+			newEntry.failures = entry.failures + 1
+		}
+		newEntry.retryAfter = time.Now().Add(p.backoff(newEntry.failures))
+	}
+	p.cacheLock.Lock()
+	p.cache[cacheKey] = newEntry
+	p.cacheLock.Unlock()
+	return response, err
+}
+
+// backoff returns the time the given number of consecutive failures is
+// cached for.
+func (p *Plugin) backoff(failures int) time.Duration {
+	backoff := p.failureBackoff
+	for i := 1; i < failures && backoff < pluginMaxFailureBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > pluginMaxFailureBackoff {
+		return pluginMaxFailureBackoff
+	}
+	return backoff
+}
+
+// callUncached calls the plugin and returns its validated response.
+func (p *Plugin) callUncached(request PluginRequest) (*PluginResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	var output []byte
+	if p.url != "" {
+		output, err = p.post(ctx, body)
+	} else {
+		output, err = p.exec(ctx, body)
+	}
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("Plugin %s timed out after %s", p.name, p.timeout)
+		}
+		return nil, fmt.Errorf("Plugin %s failed: %w", p.name, err)
+	}
+	response := &PluginResponse{}
+	if err := json.Unmarshal(output, response); err != nil {
+		return nil, fmt.Errorf("Invalid response from plugin %s: %w", p.name, err)
+	}
+	if err := response.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid response from plugin %s: %w", p.name, err)
+	}
+	return response, nil
+}
+
+// exec runs the plugin's command with the request on its standard input and
+// returns its standard output.
+func (p *Plugin) exec(ctx context.Context, body []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%w: %s", err, message)
+		}
+		return nil, err
+	}
+	return output, nil
+}
+
+// post sends the request to the plugin's URL and returns the response body.
+func (p *Plugin) post(ctx context.Context, body []byte) ([]byte, error) {
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpResponse, err := p.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	output, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	if httpResponse.StatusCode/100 != 2 {
+		return nil, fmt.Errorf(
+			"Unexpected status %s: %s", httpResponse.Status, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// validate returns an error if the response has invalid label keys or
+// values, which would make the whole node update fail.
+func (r *PluginResponse) validate() error {
+	for key, value := range r.Labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("Invalid label key %q: %s", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("Invalid value of label %s: %s", key, strings.Join(errs, "; "))
+		}
+	}
+	for _, key := range r.Remove {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("Invalid label key %q: %s", key, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// pluginMatch sets and removes the labels returned by a plugin.
+type pluginMatch struct {
+	plugin *Plugin
+	// retry is set if the node should be processed again when the plugin
+	// fails, rather than skipping the rule until the node changes.
+	retry bool
+}
+
+// compilePlugin validates the plugin of a rule.
+func compilePlugin(plugin *v1alpha1.PluginMatch) (*pluginMatch, error) {
+	if plugin.Name == "" {
+		return nil, fmt.Errorf("Plugin must have a name")
+	}
+	compiled := &pluginMatch{plugin: findPlugin(plugin.Name)}
+	if compiled.plugin == nil {
+		return nil, fmt.Errorf("Unknown plugin %q", plugin.Name)
+	}
+	switch plugin.FailurePolicy {
+	case "", v1alpha1.FailurePolicySkip:
+	case v1alpha1.FailurePolicyRetry:
+		compiled.retry = true
+	default:
+		return nil, fmt.Errorf(
+			"Unknown failure policy %q, must be %s or %s",
+			plugin.FailurePolicy, v1alpha1.FailurePolicySkip, v1alpha1.FailurePolicyRetry)
+	}
+	return compiled, nil
+}
+
+// find calls the plugin for the node. Failures of plugins with the skip
+// failure policy are logged and cached here, while those with the retry
+// failure policy are retried with the backoff of the node queue.
+func (m *pluginMatch) find(rule string, in input) (*PluginResponse, error) {
+	response, err := m.plugin.call(PluginRequest{
+		Rule: rule,
+		Node: PluginNode{
+			Name:            in.node.Name,
+			UID:             string(in.node.UID),
+			ResourceVersion: in.node.ResourceVersion,
+			Labels:          in.labels,
+			Annotations:     in.annotations,
+			Fields:          in.fields,
+		},
+	}, !m.retry)
+	if err != nil && !m.retry {
+		logrus.WithFields(logrus.Fields{
+			"rule": rule,
+			"node": in.node.Name,
+		}).WithError(err).Warn("Plugin failed, skipping rule")
+	}
+	return response, err
+}
+
+// String returns the plugin as shown in the spec.
+func (m *pluginMatch) String() string {
+	return fmt.Sprintf("@plugin(%s)", m.plugin.name)
+}
@@ -0,0 +1,311 @@
+package specs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newPluginServer returns a server responding to plugin requests with the
+// response, and the number of requests it has received.
+func newPluginServer(t *testing.T, status int, response string) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestPluginExec(t *testing.T) {
+	dir := t.TempDir()
+	requestFile := filepath.Join(dir, "request.json")
+	script := filepath.Join(dir, "plugin.sh")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+cat > "$1"
+echo '{"labels": {"rack": "r1"}, "remove": ["legacy"]}'
+`), 0755)
+	require.NoError(t, err)
+	_, err = RegisterPlugin("test-exec", script+" "+requestFile, time.Second)
+	require.NoError(t, err)
+
+	specs, err := ParseConfig([]byte(makeRuleConfig("cmdb", "plugin: {name: test-exec}")))
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, "@plugin(test-exec)", specs[0].stringSpec)
+
+	node := &core_v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:            "node-1",
+			UID:             "1234",
+			ResourceVersion: "1",
+			Labels:          map[string]string{"role": "gpu", "legacy": "true"},
+		},
+		Spec: core_v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123"},
+	}
+	result := specs.ApplyToNode(node)
+	assert.Equal(t, map[string]string{"rack": "r1"}, result.Labels)
+	assert.Equal(t, map[string]string{"rack": "cmdb"}, result.Rules)
+	assert.Equal(t, map[string]string{"legacy": "cmdb"}, result.Removed)
+	assert.Empty(t, result.Failed)
+	assert.NoError(t, result.Err)
+
+	data, err := os.ReadFile(requestFile)
+	require.NoError(t, err)
+	var request PluginRequest
+	require.NoError(t, json.Unmarshal(data, &request))
+	assert.Equal(t, "cmdb", request.Rule)
+	assert.Equal(t, "node-1", request.Node.Name)
+	assert.Equal(t, "1234", request.Node.UID)
+	assert.Equal(t, "1", request.Node.ResourceVersion)
+	assert.Equal(t, map[string]string{"role": "gpu", "legacy": "true"}, request.Node.Labels)
+	assert.Equal(t, "us-east-1a", request.Node.Fields[".spec.providerID.zone"])
+
+	// Plugin rules do not apply to labels alone.
+	assert.Empty(t, specs.ApplyTo(map[string]string{"role": "gpu"}))
+}
+
+func TestPluginHTTPCachesByResourceVersion(t *testing.T) {
+	server, calls := newPluginServer(t, http.StatusOK, `{"labels": {"rack": "r1"}}`)
+	_, err := RegisterPlugin("test-cache", server.URL, time.Second)
+	require.NoError(t, err)
+	specs, err := ParseConfig([]byte(makeRuleConfig("cmdb", "plugin: {name: test-cache}")))
+	require.NoError(t, err)
+
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: "node-1", ResourceVersion: "1"}}
+	for i := 0; i < 2; i++ {
+		result := specs.ApplyToNode(node)
+		assert.Equal(t, map[string]string{"rack": "r1"}, result.Labels)
+	}
+	assert.Equal(t, int32(1), calls.Load())
+
+	node.ResourceVersion = "2"
+	specs.ApplyToNode(node)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Nodes without a resource version are never cached.
+	node.ResourceVersion = ""
+	specs.ApplyToNode(node)
+	specs.ApplyToNode(node)
+	assert.Equal(t, int32(4), calls.Load())
+}
+
+func TestPluginHTTPCachesFailuresWithBackoff(t *testing.T) {
+	server, calls := newPluginServer(t, http.StatusInternalServerError, "database is down")
+	plugin, err := RegisterPlugin("test-failure-cache", server.URL, time.Second)
+	require.NoError(t, err)
+	plugin.failureBackoff = time.Hour
+	specs, err := ParseConfig([]byte(makeRuleConfig("cmdb", "plugin: {name: test-failure-cache}")))
+	require.NoError(t, err)
+
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: "node-1", ResourceVersion: "1"}}
+	for i := 0; i < 2; i++ {
+		result := specs.ApplyToNode(node)
+		assert.Equal(t, []string{"cmdb"}, result.Failed)
+		assert.Contains(t, result.Errors["cmdb"].Error(), "database is down")
+	}
+	assert.Equal(t, int32(1), calls.Load())
+
+	// A new version of the node is not held back by the failure of the
+	// previous one, and the plugin is called again for the same version
+	// once the backoff expires.
+	plugin.failureBackoff = 0
+	node.ResourceVersion = "2"
+	specs.ApplyToNode(node)
+	assert.Equal(t, int32(2), calls.Load())
+	specs.ApplyToNode(node)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestPluginRetryDoesNotCacheFailures(t *testing.T) {
+	server, calls := newPluginServer(t, http.StatusInternalServerError, "database is down")
+	plugin, err := RegisterPlugin("test-retry-uncached", server.URL, time.Second)
+	require.NoError(t, err)
+	plugin.failureBackoff = time.Hour
+	specs, err := ParseConfig([]byte(makeRuleConfig(
+		"cmdb", "plugin: {name: test-retry-uncached, failurePolicy: retry}")))
+	require.NoError(t, err)
+
+	// The node queue backs off retrying the node, so every retry has to
+	// reach the plugin.
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: "node-1", ResourceVersion: "1"}}
+	for i := 0; i < 3; i++ {
+		result := specs.ApplyToNode(node)
+		assert.Equal(t, []string{"cmdb"}, result.Failed)
+		require.Error(t, result.Err)
+	}
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestPluginBackoff(t *testing.T) {
+	plugin := &Plugin{failureBackoff: time.Second}
+	testData := []struct {
+		failures int
+		backoff  time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{20, pluginMaxFailureBackoff},
+	}
+	for _, testItem := range testData {
+		assert.Equal(t, testItem.backoff, plugin.backoff(testItem.failures))
+	}
+}
+
+func TestPluginCacheEviction(t *testing.T) {
+	server, calls := newPluginServer(t, http.StatusOK, `{"labels": {"rack": "r1"}}`)
+	_, err := RegisterPlugin("test-eviction", server.URL, time.Second)
+	require.NoError(t, err)
+	cmdbSpecs, err := ParseConfig([]byte(makeRuleConfig("cmdb", "plugin: {name: test-eviction}")))
+	require.NoError(t, err)
+	inventorySpecs, err := ParseConfig([]byte(makeRuleConfig(
+		"inventory", "plugin: {name: test-eviction}")))
+	require.NoError(t, err)
+	allSpecs := append(append(Specs{}, cmdbSpecs...), inventorySpecs...)
+
+	node1 := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: "node-1", ResourceVersion: "1"}}
+	node2 := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: "node-2", ResourceVersion: "1"}}
+	allSpecs.ApplyToNode(node1)
+	allSpecs.ApplyToNode(node2)
+	assert.Equal(t, int32(4), calls.Load())
+
+	ForgetNode("node-1")
+	allSpecs.ApplyToNode(node1)
+	allSpecs.ApplyToNode(node2)
+	assert.Equal(t, int32(6), calls.Load())
+
+	// Only the rules removed from the specs are evicted.
+	cmdbSpecs.ForgetRemovedRules()
+	allSpecs.ApplyToNode(node1)
+	assert.Equal(t, int32(7), calls.Load())
+	cmdbSpecs.ApplyToNode(node2)
+	assert.Equal(t, int32(7), calls.Load())
+}
+
+func TestPluginFailures(t *testing.T) {
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	t.Cleanup(slowServer.Close)
+	errorServer, _ := newPluginServer(t, http.StatusInternalServerError, "database is down")
+	invalidServer, _ := newPluginServer(t, http.StatusOK, `{"labels": ["rack"]}`)
+	invalidKeyServer, _ := newPluginServer(t, http.StatusOK, `{"labels": {"rack/": "r1"}}`)
+	invalidValueServer, _ := newPluginServer(t, http.StatusOK, `{"labels": {"rack": "r 1"}}`)
+	failingScript := filepath.Join(t.TempDir(), "plugin.sh")
+	err := os.WriteFile(failingScript, []byte("#!/bin/sh\necho broken >&2\nexit 1\n"), 0755)
+	require.NoError(t, err)
+
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: "node-1", ResourceVersion: "1"}}
+	testData := []struct {
+		name     string
+		endpoint string
+		message  string
+	}{
+		{"Timeout", slowServer.URL, "Plugin test-timeout timed out after 50ms"},
+		{"Status", errorServer.URL, "Unexpected status 500 Internal Server Error: database is down"},
+		{"InvalidResponse", invalidServer.URL, "Invalid response from plugin test-invalidresponse"},
+		{"InvalidKey", invalidKeyServer.URL, "Invalid label key \"rack/\""},
+		{"InvalidValue", invalidValueServer.URL, "Invalid value of label rack"},
+		{"ExecFailure", failingScript, "exit status 1: broken"},
+		{"MissingCommand", "/nonexistent/plugin", "Plugin test-missingcommand failed"},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			name := "test-" + strings.ToLower(testItem.name)
+			_, err := RegisterPlugin(name, testItem.endpoint, 50*time.Millisecond)
+			require.NoError(t, err)
+
+			specs, err := ParseConfig([]byte(makeRuleConfig(
+				"cmdb",
+				fmt.Sprintf("plugin: {name: %s, failurePolicy: skip}", name),
+			)))
+			require.NoError(t, err)
+			result := specs.ApplyToNode(node)
+			assert.Empty(t, result.Labels)
+			assert.Equal(t, []string{"cmdb"}, result.Failed)
+			require.Contains(t, result.Errors, "cmdb")
+			assert.Contains(t, result.Errors["cmdb"].Error(), testItem.message)
+			assert.NoError(t, result.Err)
+
+			specs, err = ParseConfig([]byte(makeRuleConfig(
+				"cmdb",
+				fmt.Sprintf("plugin: {name: %s, failurePolicy: retry}", name),
+			)))
+			require.NoError(t, err)
+			result = specs.ApplyToNode(node)
+			assert.Equal(t, []string{"cmdb"}, result.Failed)
+			require.Error(t, result.Err)
+			assert.Regexp(t, "Rule cmdb: ", result.Err.Error())
+			assert.Contains(t, result.Err.Error(), testItem.message)
+		})
+	}
+}
+
+func TestParsePluginConfigFailures(t *testing.T) {
+	_, err := RegisterPlugin("test-config", "/bin/true", 0)
+	require.NoError(t, err)
+
+	testData := []struct {
+		name    string
+		rule    string
+		message string
+	}{
+		{
+			"MissingName",
+			"plugin: {failurePolicy: skip}",
+			"line 6: Invalid rule \"cmdb\". Plugin must have a name",
+		},
+		{
+			"UnknownPlugin",
+			"plugin: {name: nosuchplugin}",
+			"line 6: Invalid rule \"cmdb\". Unknown plugin \"nosuchplugin\"",
+		},
+		{
+			"UnknownFailurePolicy",
+			"plugin: {name: test-config, failurePolicy: ignore}",
+			"line 6: Invalid rule \"cmdb\". Unknown failure policy \"ignore\", must be skip or retry",
+		},
+		{
+			"WithSet",
+			"plugin: {name: test-config}\n  set: {key: rack}",
+			"line 7: Invalid rule \"cmdb\". Rule with plugin must not have set",
+		},
+		{
+			"WithLookup",
+			"plugin: {name: test-config}\n  lookup: {table: hosts, key: .metadata.name}",
+			"line 6: Invalid rule \"cmdb\". Rule must not have both lookup and plugin",
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(makeRuleConfig("cmdb", testItem.rule)))
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+
+	_, err = RegisterPlugin("test-empty", " ", 0)
+	require.Error(t, err)
+	assert.Regexp(t, "Plugin test-empty must have a command or a URL", err.Error())
+}
@@ -0,0 +1,117 @@
+package specs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// providerIDPathPrefix is the prefix of the paths of the node fields parsed
+// from the provider ID, followed by the field name.
+const providerIDPathPrefix = ".spec.providerID."
+
+// providerIDParser extracts named fields from the provider IDs of one
+// format. The fields are the named capture groups of the expression.
+type providerIDParser struct {
+	// provider is the value of the provider field, or empty if the
+	// expression captures it itself.
+	provider string
+	re       *regexp.Regexp
+}
+
+// builtinProviderIDParsers parse the provider IDs set by the cloud
+// providers.
+var builtinProviderIDParsers = []providerIDParser{
+	{
+		// aws:///us-east-1a/i-0123456789abcdef0
+		provider: "aws",
+		re: regexp.MustCompile(
+			`^aws://[^/]*/(?P<zone>(?P<region>[a-z]+(?:-[a-z]+)+-\d+)[-a-z0-9]*)/(?P<instanceID>[^/]+)$`),
+	},
+	{
+		// gce://my-project/us-central1-a/my-instance
+		provider: "gce",
+		re: regexp.MustCompile(
+			`^gce://(?P<project>[^/]+)/(?P<zone>(?P<region>[a-z]+-[a-z]+\d+)-[a-z])/(?P<instanceID>[^/]+)$`),
+	},
+	{
+		// azure:///subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Compute/virtualMachineScaleSets/<set>/virtualMachines/<index>
+		provider: "azure",
+		re: regexp.MustCompile(
+			`^azure:///subscriptions/(?P<subscriptionID>[^/]+)/(?i:resourceGroups)/(?P<resourceGroup>[^/]+)` +
+				`/providers/(?i:Microsoft\.Compute)/(?i:virtualMachineScaleSets)/(?P<scaleSet>[^/]+)` +
+				`/(?i:virtualMachines)/(?P<instanceID>[^/]+)$`),
+	},
+	{
+		// azure:///subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Compute/virtualMachines/<name>
+		provider: "azure",
+		re: regexp.MustCompile(
+			`^azure:///subscriptions/(?P<subscriptionID>[^/]+)/(?i:resourceGroups)/(?P<resourceGroup>[^/]+)` +
+				`/providers/(?i:Microsoft\.Compute)/(?i:virtualMachines)/(?P<instanceID>[^/]+)$`),
+	},
+}
+
+// customProviderIDParsers are tried when none of the built-in parsers
+// match.
+var customProviderIDParsers []providerIDParser
+
+// AddProviderIDPattern adds a regular expression parsing provider IDs not
+// recognized by the built-in parsers. Its named capture groups become the
+// fields of the provider ID. Patterns are tried in the order they are
+// added. Must be called before any specs are applied.
+func AddProviderIDPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("Invalid provider ID pattern %q: %w", pattern, err)
+	}
+	named := false
+	for _, name := range re.SubexpNames() {
+		named = named || name != ""
+	}
+	if !named {
+		return fmt.Errorf("Provider ID pattern %q must have named capture groups", pattern)
+	}
+	customProviderIDParsers = append(customProviderIDParsers, providerIDParser{re: re})
+	return nil
+}
+
+// ParseProviderID returns the fields of the provider ID recognized by the
+// first matching parser, such as provider, zone, region, project, or
+// instanceID. Returns an empty map if no parser recognizes it.
+func ParseProviderID(providerID string) map[string]string {
+	fields := map[string]string{}
+	if providerID == "" {
+		return fields
+	}
+	parsers := make([]providerIDParser, 0, len(builtinProviderIDParsers)+len(customProviderIDParsers))
+	parsers = append(parsers, builtinProviderIDParsers...)
+	parsers = append(parsers, customProviderIDParsers...)
+	for _, parser := range parsers {
+		match := parser.re.FindStringSubmatch(providerID)
+		if match == nil {
+			continue
+		}
+		if parser.provider != "" {
+			fields["provider"] = parser.provider
+		}
+		for i, name := range parser.re.SubexpNames() {
+			if name != "" && match[i] != "" {
+				fields[name] = match[i]
+			}
+		}
+		return fields
+	}
+	return fields
+}
+
+// providerIDFields returns the provider ID fields among the node fields,
+// by field name.
+func providerIDFields(nodeFields map[string]string) map[string]string {
+	fields := map[string]string{}
+	for path, value := range nodeFields {
+		if strings.HasPrefix(path, providerIDPathPrefix) {
+			fields[path[len(providerIDPathPrefix):]] = value
+		}
+	}
+	return fields
+}
@@ -0,0 +1,123 @@
+package specs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseProviderID(t *testing.T) {
+	testData := []struct {
+		name       string
+		providerID string
+		expected   map[string]string
+	}{
+		{
+			"AWS",
+			"aws:///us-east-1a/i-0abc",
+			map[string]string{
+				"provider":   "aws",
+				"zone":       "us-east-1a",
+				"region":     "us-east-1",
+				"instanceID": "i-0abc",
+			},
+		},
+		{
+			"AWSLocalZone",
+			"aws:///us-gov-west-1-lax-1a/i-0abc",
+			map[string]string{
+				"provider":   "aws",
+				"zone":       "us-gov-west-1-lax-1a",
+				"region":     "us-gov-west-1",
+				"instanceID": "i-0abc",
+			},
+		},
+		{
+			"GCE",
+			"gce://my-project/us-central1-a/gke-pool-1234",
+			map[string]string{
+				"provider":   "gce",
+				"project":    "my-project",
+				"zone":       "us-central1-a",
+				"region":     "us-central1",
+				"instanceID": "gke-pool-1234",
+			},
+		},
+		{
+			"AzureVM",
+			"azure:///subscriptions/1234/resourceGroups/my-group/providers/" +
+				"Microsoft.Compute/virtualMachines/my-vm",
+			map[string]string{
+				"provider":       "azure",
+				"subscriptionID": "1234",
+				"resourceGroup":  "my-group",
+				"instanceID":     "my-vm",
+			},
+		},
+		{
+			"AzureScaleSet",
+			"azure:///subscriptions/1234/resourcegroups/my-group/providers/" +
+				"Microsoft.Compute/virtualMachineScaleSets/my-set/virtualMachines/3",
+			map[string]string{
+				"provider":       "azure",
+				"subscriptionID": "1234",
+				"resourceGroup":  "my-group",
+				"scaleSet":       "my-set",
+				"instanceID":     "3",
+			},
+		},
+		{"Unknown", "kind://docker/kind/kind-worker", map[string]string{}},
+		{"Empty", "", map[string]string{}},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			assert.Equal(t, testItem.expected, ParseProviderID(testItem.providerID))
+		})
+	}
+}
+
+func TestAddProviderIDPattern(t *testing.T) {
+	t.Cleanup(func() { customProviderIDParsers = nil })
+
+	err := AddProviderIDPattern(`^(?P<provider>kind)://(?P<runtime>[^/]+)/(?P<cluster>[^/]+)/(?P<instanceID>[^/]+)$`)
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		map[string]string{
+			"provider":   "kind",
+			"runtime":    "docker",
+			"cluster":    "kind",
+			"instanceID": "kind-worker",
+		},
+		ParseProviderID("kind://docker/kind/kind-worker"),
+	)
+	// Built-in parsers take precedence.
+	assert.Equal(t, "aws", ParseProviderID("aws:///us-east-1a/i-0abc")["provider"])
+
+	err = AddProviderIDPattern(`^kind://(.*)$`)
+	require.Error(t, err)
+	assert.Regexp(t, "must have named capture groups", err.Error())
+	err = AddProviderIDPattern(`^kind://(?P<x>.*$`)
+	require.Error(t, err)
+	assert.Regexp(t, "Invalid provider ID pattern", err.Error())
+}
+
+func TestApplyProviderIDFields(t *testing.T) {
+	specs, err := Parse([]string{
+		".spec.providerID.instanceID=*:instance-id=*",
+		".spec.providerID.provider=gce:project={{.ProviderID.project}}",
+	})
+	require.NoError(t, err)
+	node := &core_v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "test-node"},
+		Spec:       core_v1.NodeSpec{ProviderID: "gce://my-project/us-central1-a/gke-pool-1234"},
+	}
+	assert.Equal(
+		t,
+		map[string]string{"instance-id": "gke-pool-1234", "project": "my-project"},
+		specs.ApplyToNode(node).Labels,
+	)
+}
@@ -0,0 +1,108 @@
+package specs
+
+import (
+	"fmt"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/vladlosev/node-relabeler/pkg/apis/noderelabeler/v1alpha1"
+)
+
+// resourceMatch sorts nodes into buckets by the quantity of a resource.
+type resourceMatch struct {
+	// path is the path of the node field with the quantity.
+	path    string
+	buckets []resourceBucket
+}
+
+// resourceBucket is a range of quantities, with unbounded ends when nil.
+type resourceBucket struct {
+	min           *resource.Quantity
+	max           *resource.Quantity
+	value         string
+	valueTemplate *template.Template
+}
+
+// compileResource validates the resource match of a rule.
+func compileResource(match *v1alpha1.ResourceMatch) (*resourceMatch, error) {
+	if match.Name == "" {
+		return nil, fmt.Errorf("Resource must have a name")
+	}
+	source := match.Source
+	switch source {
+	case "":
+		source = v1alpha1.ResourceSourceCapacity
+	case v1alpha1.ResourceSourceCapacity, v1alpha1.ResourceSourceAllocatable:
+	default:
+		return nil, fmt.Errorf(
+			"Unknown resource source %q, must be %s or %s",
+			source, v1alpha1.ResourceSourceCapacity, v1alpha1.ResourceSourceAllocatable)
+	}
+	if len(match.Buckets) == 0 {
+		return nil, fmt.Errorf("Resource must have at least one bucket")
+	}
+	compiled := &resourceMatch{path: fmt.Sprintf(".status.%s.%s", source, match.Name)}
+	for i, bucket := range match.Buckets {
+		min, err := parseBound(bucket.Min)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid min in bucket %d: %w", i+1, err)
+		}
+		max, err := parseBound(bucket.Max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid max in bucket %d: %w", i+1, err)
+		}
+		if min != nil && max != nil && min.Cmp(*max) >= 0 {
+			return nil, fmt.Errorf("Bucket %d is empty, min must be less than max", i+1)
+		}
+		valueTemplate, err := parseTemplate(bucket.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value in bucket %d: %w", i+1, err)
+		}
+		compiled.buckets = append(compiled.buckets, resourceBucket{
+			min:           min,
+			max:           max,
+			value:         bucket.Value,
+			valueTemplate: valueTemplate,
+		})
+	}
+	return compiled, nil
+}
+
+// parseBound parses a bucket bound. Returns nil for an empty bound.
+func parseBound(bound string) (*resource.Quantity, error) {
+	if bound == "" {
+		return nil, nil
+	}
+	quantity, err := resource.ParseQuantity(bound)
+	if err != nil {
+		return nil, err
+	}
+	return &quantity, nil
+}
+
+// find returns the first bucket containing the quantity in the fields, or
+// nil if there is none. A missing quantity is zero.
+func (m *resourceMatch) find(fields map[string]string) (*resourceBucket, string, error) {
+	value, ok := fields[m.path]
+	quantity := resource.Quantity{}
+	if ok {
+		var err error
+		if quantity, err = resource.ParseQuantity(value); err != nil {
+			return nil, "", fmt.Errorf("Invalid quantity in %s: %w", m.path, err)
+		}
+	} else {
+		value = quantity.String()
+	}
+	for i := range m.buckets {
+		bucket := &m.buckets[i]
+		if bucket.min != nil && quantity.Cmp(*bucket.min) < 0 {
+			continue
+		}
+		if bucket.max != nil && quantity.Cmp(*bucket.max) >= 0 {
+			continue
+		}
+		return bucket, value, nil
+	}
+	return nil, value, nil
+}
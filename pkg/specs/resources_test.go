@@ -0,0 +1,160 @@
+package specs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const sampleResourceConfig = `
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: size
+  resource:
+    name: memory
+    buckets:
+    - max: 8Gi
+      value: small
+    - min: 8Gi
+      max: 64Gi
+      value: medium
+    - min: 64Gi
+      value: large
+  set: {key: size}
+- name: gpu
+  resource:
+    name: nvidia.com/gpu
+    source: allocatable
+    buckets:
+    - min: "1"
+  set: {key: gpu, value: "true"}
+- name: cores
+  resource:
+    name: cpu
+    buckets:
+    - value: "{{.Value}}"
+  set: {key: cores}
+`
+
+func TestApplyResourceBuckets(t *testing.T) {
+	specs, err := ParseConfig([]byte(sampleResourceConfig))
+	require.NoError(t, err)
+	require.Len(t, specs, 3)
+
+	testData := []struct {
+		name     string
+		capacity core_v1.ResourceList
+		expected map[string]string
+	}{
+		{
+			"Small",
+			core_v1.ResourceList{
+				core_v1.ResourceMemory: resource.MustParse("7Gi"),
+				core_v1.ResourceCPU:    resource.MustParse("2"),
+			},
+			map[string]string{"size": "small", "cores": "2"},
+		},
+		{
+			"BucketBoundary",
+			core_v1.ResourceList{core_v1.ResourceMemory: resource.MustParse("8Gi")},
+			map[string]string{"size": "medium", "cores": "0"},
+		},
+		{
+			"DifferentUnits",
+			core_v1.ResourceList{core_v1.ResourceMemory: resource.MustParse("100G")},
+			map[string]string{"size": "large", "cores": "0"},
+		},
+		{
+			"GPU",
+			core_v1.ResourceList{
+				core_v1.ResourceMemory: resource.MustParse("256Gi"),
+				"nvidia.com/gpu":       resource.MustParse("4"),
+				core_v1.ResourceCPU:    resource.MustParse("3500m"),
+			},
+			map[string]string{"size": "large", "gpu": "true", "cores": "3500m"},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			node := &core_v1.Node{
+				ObjectMeta: meta_v1.ObjectMeta{Name: "test-node"},
+				Status: core_v1.NodeStatus{
+					Capacity:    testItem.capacity,
+					Allocatable: testItem.capacity,
+				},
+			}
+			result := specs.ApplyToNode(node)
+			assert.Equal(t, testItem.expected, result.Labels)
+		})
+	}
+	// Resource rules only apply to nodes.
+	assert.False(t, specs.Matches(map[string]string{}))
+}
+
+func TestApplyResourceField(t *testing.T) {
+	specs, err := Parse([]string{".status.capacity.nvidia.com/gpu=*:gpu-count=*"})
+	require.NoError(t, err)
+	node := &core_v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "test-node"},
+		Status: core_v1.NodeStatus{Capacity: core_v1.ResourceList{
+			"nvidia.com/gpu": resource.MustParse("4"),
+		}},
+	}
+	assert.Equal(t, map[string]string{"gpu-count": "4"}, specs.ApplyToNode(node).Labels)
+}
+
+func TestParseResourceFailures(t *testing.T) {
+	testData := []struct {
+		name    string
+		rule    string
+		message string
+	}{
+		{
+			"NoName",
+			"resource: {buckets: [{min: 1}]}\n  set: {key: abc}",
+			"line 6: Invalid rule \"test\". Resource must have a name",
+		},
+		{
+			"UnknownSource",
+			"resource: {name: cpu, source: requests, buckets: [{min: 1}]}\n  set: {key: abc}",
+			"Unknown resource source \"requests\"",
+		},
+		{
+			"NoBuckets",
+			"resource: {name: cpu, buckets: []}\n  set: {key: abc}",
+			"Resource must have at least one bucket",
+		},
+		{
+			"InvalidQuantity",
+			"resource: {name: cpu, buckets: [{min: abc}]}\n  set: {key: abc}",
+			"Invalid min in bucket 1",
+		},
+		{
+			"EmptyBucket",
+			"resource: {name: cpu, buckets: [{min: 2, max: 1}]}\n  set: {key: abc}",
+			"Bucket 1 is empty",
+		},
+		{
+			"WithMatch",
+			"resource: {name: cpu, buckets: [{min: 1}]}\n  match: {key: abc}\n  set: {key: abc}",
+			"Rule must not have both match and resource",
+		},
+		{
+			"Delete",
+			"action: delete\n  resource: {name: cpu, buckets: [{min: 1}]}",
+			"Rule with resource must have action set",
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(makeRuleConfig("test", testItem.rule)))
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
@@ -1,22 +1,86 @@
 package specs
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"unicode"
 
+	"github.com/google/cel-go/cel"
 	"github.com/sirupsen/logrus"
+	core_v1 "k8s.io/api/core/v1"
+	k8s_labels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// operation is what a spec does to the labels it matches.
+type operation int
+
+const (
+	// opSet sets a new label, keeping the matched one.
+	opSet operation = iota
+	// opMove sets a new label and removes the matched one.
+	opMove
+	// opDelete removes the matched label.
+	opDelete
 )
 
 // Spec contains a parsed relabel spec, ready to apply to node labels.
 type spec struct {
 	oldKeyRegexp   *regexp.Regexp
 	oldValueRegexp *regexp.Regexp
-	oldKey         string
-	oldValue       string
-	newKey         string
-	newValue       string
-	stringSpec     string
+	// captureRegexp is set for regular expression specs. It combines the
+	// capture groups of the key and value expressions.
+	captureRegexp *regexp.Regexp
+	// fieldSource is set if the old label refers to a node field rather
+	// than a label.
+	fieldSource bool
+	// resource is set for specs matching resource quantities instead of an
+	// old label. Such specs have no oldKeyRegexp.
+	resource *resourceMatch
+	// cidr is set for specs matching node addresses instead of an old
+	// label. Such specs have no oldKeyRegexp.
+	cidr *cidrMatch
+	// lookup is set for specs setting the labels found in a lookup table.
+	// Such specs have no oldKeyRegexp and no new label.
+	lookup *lookupMatch
+	// plugin is set for specs setting and removing the labels returned by
+	// a plugin. Such specs have no oldKeyRegexp and no new label.
+	plugin *pluginMatch
+	// oldTarget and newTarget are what the old and new labels refer to.
+	// For taints, oldEffect is the effect to match (any if empty) and
+	// newEffect is the effect of the new taint.
+	oldTarget target
+	oldEffect string
+	newTarget target
+	newEffect string
+	// selector is the label selector the node has to match for the spec to
+	// apply. Specs with a selector may have no old label, in which case
+	// oldKeyRegexp is nil and the new label is set on all selected nodes.
+	selector k8s_labels.Selector
+	// condition is the CEL expression the node has to satisfy for the spec
+	// to apply, if any.
+	condition  cel.Program
+	oldKey     string
+	oldValue   string
+	newKey     string
+	newValue   string
+	op         operation
+	stringSpec string
+	// newKeyTemplate and newValueTemplate are set if the new key or value
+	// are templates.
+	newKeyTemplate   *template.Template
+	newValueTemplate *template.Template
+	// newValueProgram is set if the new value is computed by a CEL
+	// expression.
+	newValueProgram cel.Program
+	// name identifies the rule the spec came from. For specs given on the
+	// command line it is the same as stringSpec.
+	name string
 }
 
 // Specs keeps compiled relabeling specs and applies them.
@@ -25,19 +89,70 @@ type Specs []spec
 // Parse parses specs from the command line into format useful to apply
 // them.
 func Parse(specs []string) (Specs, error) {
-	parsedSpecs := make([]spec, 0, len(specs))
 	if len(specs) == 0 {
 		return nil, fmt.Errorf("At least one --relabel spec must be specified")
 	}
+	return parseSpecs(specs, false)
+}
+
+// ParseRegex parses specs from the command line where the old label is given
+// by regular expressions and the new label can refer to their capture
+// groups.
+func ParseRegex(specs []string) (Specs, error) {
+	return parseSpecs(specs, true)
+}
+
+func parseSpecs(specs []string, regex bool) (Specs, error) {
+	split := func(s string, separator string) []string {
+		return splitSpec(s, separator, regex)
+	}
+	parsedSpecs := make([]spec, 0, len(specs))
 	for _, stringSpec := range specs {
-		oldNew := strings.Split(stringSpec, ":")
-		if len(oldNew) != 2 {
-			return nil, newSpecParseError(stringSpec, "")
+		body := stringSpec
+		// An optional label selector is separated from the rest of the spec
+		// by a semicolon.
+		var selector k8s_labels.Selector
+		if index := strings.Index(body, ";"); index >= 0 {
+			var err error
+			selector, err = parseSelector(body[:index])
+			if err != nil {
+				return nil, newSpecParseError(regex, stringSpec, err.Error())
+			}
+			body = body[index+1:]
+		}
+		// A leading - marks the matched label for removal. Without a new
+		// label, the spec deletes the matched label, otherwise it moves it.
+		op := opSet
+		removeOld := strings.HasPrefix(body, "-")
+		if removeOld {
+			body = body[1:]
+		}
+		oldNew := split(body, ":")
+		if len(oldNew) > 2 || (len(oldNew) == 1 && !removeOld) {
+			return nil, newSpecParseError(regex, stringSpec, "")
 		}
-		old := strings.Split(oldNew[0], "=")
-		new := strings.Split(oldNew[1], "=")
+		if removeOld {
+			op = opDelete
+			if len(oldNew) == 2 {
+				op = opMove
+			}
+		}
+		// Either side can refer to a taint, with the effect following @.
+		oldSide, oldTarget, oldEffect, err := splitTarget(oldNew[0], regex)
+		if err != nil {
+			return nil, newSpecParseError(regex, stringSpec, "")
+		}
+		newSide, newTarget, newEffect := "", targetLabel, ""
+		if len(oldNew) == 2 {
+			newSide, newTarget, newEffect, err = splitTarget(oldNew[1], regex)
+			if err != nil {
+				return nil, newSpecParseError(regex, stringSpec, "")
+			}
+		}
+		old := split(oldSide, "=")
+		new := split(newSide, "=")
 		if len(old) > 2 || len(new) > 2 {
-			return nil, newSpecParseError(stringSpec, "")
+			return nil, newSpecParseError(regex, stringSpec, "")
 		}
 		oldKey := old[0]
 		oldValue := ""
@@ -49,92 +164,785 @@ func Parse(specs []string) (Specs, error) {
 		if len(new) == 2 {
 			newValue = new[1]
 		}
-		if strings.Contains(oldKey, "*") && strings.Contains(oldValue, "*") {
-			return nil, newSpecParseError(
-				stringSpec,
-				"oldkey=oldvalue pair should contain no more than a single *")
-		}
-		if (strings.Contains(newKey, "*") || strings.Contains(newValue, "*")) &&
-			!(strings.Contains(oldKey, "*") || strings.Contains(oldValue, "*")) {
-			return nil, newSpecParseError(
-				stringSpec,
-				"Wildcard pattern cannot appear in new label without appearing in the old one")
-		}
-
-		newSpec := spec{
-			oldKeyRegexp: regexp.MustCompile(fmt.Sprintf(
-				"^%s$",
-				strings.Replace(oldKey, "*", "(.*)", 1),
-			)),
-			oldValueRegexp: regexp.MustCompile(fmt.Sprintf(
-				"^%s$",
-				strings.Replace(oldValue, "*", "(.*)", 1),
-			)),
-			oldKey:     oldKey,
-			oldValue:   oldValue,
-			newKey:     newKey,
-			newValue:   newValue,
-			stringSpec: stringSpec,
-		}
-		if strings.Contains(newSpec.oldKey, "*") &&
-			strings.Contains(newSpec.newKey, "*") &&
-			newSpec.oldKey != newSpec.newKey &&
-			newSpec.oldKeyRegexp.MatchString(newSpec.newKey) {
-			return nil, newSpecParseError(
-				stringSpec,
-				"newkey=newvalue pair must not match pattern in oldkey=oldvalue")
-		}
-		if strings.Contains(newSpec.oldValue, "*") &&
-			strings.Contains(newSpec.newValue, "*") &&
-			newSpec.oldValue != newSpec.newValue &&
-			newSpec.oldKeyRegexp.MatchString(newSpec.newKey) &&
-			newSpec.oldValueRegexp.MatchString(newSpec.newValue) {
-			return nil, newSpecParseError(
-				stringSpec,
-				"newkey=newvalue pair must not match pattern in oldkey=oldvalue")
+		if op != opSet && (oldKey == "" || (op == opMove && newKey == "")) {
+			return nil, newSpecParseError(regex, stringSpec, "")
+		}
+		compile := compileSpec
+		if regex {
+			compile = compileRegexSpec
+		}
+		if selector != nil && oldKey == "" && oldValue == "" {
+			compile = compileSelectorSpec
 		}
+		newSpec, err := compile(oldKey, oldValue, newKey, newValue)
+		if err != nil {
+			return nil, newSpecParseError(regex, stringSpec, err.Error())
+		}
+		if err := newSpec.compileTemplates(); err != nil {
+			return nil, newSpecParseError(regex, stringSpec, err.Error())
+		}
+		newSpec.selector = selector
+		newSpec.op = op
+		if err := newSpec.compileTargets(oldTarget, oldEffect, newTarget, newEffect); err != nil {
+			return nil, newSpecParseError(regex, stringSpec, err.Error())
+		}
+		if err := newSpec.compileSource(); err != nil {
+			return nil, newSpecParseError(regex, stringSpec, err.Error())
+		}
+		newSpec.stringSpec = stringSpec
+		newSpec.name = stringSpec
 		parsedSpecs = append(parsedSpecs, newSpec)
 	}
 	logrus.WithField("specs", parsedSpecs).Debug("Parsed specs from command line")
 	return parsedSpecs, nil
 }
 
+// splitSpec splits a part of a spec around the separator, ignoring the
+// separators inside template actions. In regular expression specs, the
+// separators inside groups, character classes, and escaped ones are ignored
+// as well.
+func splitSpec(s string, separator string, regex bool) []string {
+	var parts []string
+	depth := 0
+	inClass := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			if end := strings.Index(s[i:], "}}"); end >= 0 {
+				i += end + 1
+			}
+		case !regex:
+			if strings.HasPrefix(s[i:], separator) {
+				parts = append(parts, s[start:i])
+				start = i + len(separator)
+			}
+		case s[i] == '\\':
+			i++
+		case inClass:
+			inClass = s[i] != ']'
+		case s[i] == '[':
+			inClass = true
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+		case depth == 0 && strings.HasPrefix(s[i:], separator):
+			parts = append(parts, s[start:i])
+			start = i + len(separator)
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// compileSpec validates the old and new label patterns and compiles them into
+// a spec.
+func compileSpec(oldKey, oldValue, newKey, newValue string) (spec, error) {
+	if strings.Contains(oldKey, "*") && strings.Contains(oldValue, "*") {
+		return spec{}, &ruleError{
+			field:   "match",
+			message: "oldkey=oldvalue pair should contain no more than a single *",
+		}
+	}
+	// Templates in the new label are rendered rather than substituted, so
+	// they are exempt from the wildcard checks.
+	literalKey, literalValue := literal(newKey), literal(newValue)
+	if (strings.Contains(literalKey, "*") || strings.Contains(literalValue, "*")) &&
+		!(strings.Contains(oldKey, "*") || strings.Contains(oldValue, "*")) {
+		return spec{}, &ruleError{
+			field:   "set",
+			message: "Wildcard pattern cannot appear in new label without appearing in the old one",
+		}
+	}
+
+	keyRegexp, err := wildcardRegexp(oldKey)
+	if err != nil {
+		return spec{}, patternError("key", err)
+	}
+	valueRegexp, err := wildcardRegexp(oldValue)
+	if err != nil {
+		return spec{}, patternError("value", err)
+	}
+	newSpec := spec{
+		oldKeyRegexp:   keyRegexp,
+		oldValueRegexp: valueRegexp,
+		oldKey:         oldKey,
+		oldValue:       oldValue,
+		newKey:         newKey,
+		newValue:       newValue,
+	}
+	if strings.Contains(newSpec.oldKey, "*") &&
+		strings.Contains(literalKey, "*") &&
+		newSpec.oldKey != literalKey &&
+		newSpec.oldKeyRegexp.MatchString(literalKey) {
+		return spec{}, &ruleError{
+			field:   "set",
+			message: "newkey=newvalue pair must not match pattern in oldkey=oldvalue",
+		}
+	}
+	if strings.Contains(newSpec.oldValue, "*") &&
+		strings.Contains(literalValue, "*") &&
+		newSpec.oldValue != literalValue &&
+		newSpec.oldKeyRegexp.MatchString(literalKey) &&
+		newSpec.oldValueRegexp.MatchString(literalValue) {
+		return spec{}, &ruleError{
+			field:   "set",
+			message: "newkey=newvalue pair must not match pattern in oldkey=oldvalue",
+		}
+	}
+	return newSpec, nil
+}
+
+// patternError returns the error of an invalid key or value pattern of the
+// old label.
+func patternError(part string, err error) error {
+	return &ruleError{field: "match", message: fmt.Sprintf("Invalid %s pattern: %s", part, err)}
+}
+
+// wildcardRegexp compiles a label pattern into a regular expression
+// matching it literally, except for the first * matching any string in a
+// capture group.
+func wildcardRegexp(pattern string) (*regexp.Regexp, error) {
+	parts := strings.SplitN(pattern, "*", 2)
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.Compile(fmt.Sprintf("^%s$", strings.Join(parts, "(.*)")))
+}
+
+// compileRegexSpec compiles the old label regular expressions into a spec
+// and validates that the new label only refers to their capture groups.
+func compileRegexSpec(oldKey, oldValue, newKey, newValue string) (spec, error) {
+	keyRegexp, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", oldKey))
+	if err != nil {
+		return spec{}, patternError("key", err)
+	}
+	valueRegexp, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", oldValue))
+	if err != nil {
+		return spec{}, patternError("value", err)
+	}
+	// The capture groups of the key and the value patterns are numbered and
+	// named as in this combined expression. It is only used for expanding
+	// the references in the new label and never for matching.
+	captureRegexp, err := regexp.Compile(fmt.Sprintf("(?:%s)=(?:%s)", oldKey, oldValue))
+	if err != nil {
+		return spec{}, &ruleError{field: "match", message: err.Error()}
+	}
+	for _, output := range []string{literal(newKey), literal(newValue)} {
+		if err := checkReferences(output, captureRegexp); err != nil {
+			return spec{}, &ruleError{field: "set", message: err.Error()}
+		}
+	}
+	return spec{
+		oldKeyRegexp:   keyRegexp,
+		oldValueRegexp: valueRegexp,
+		captureRegexp:  captureRegexp,
+		oldKey:         oldKey,
+		oldValue:       oldValue,
+		newKey:         newKey,
+		newValue:       newValue,
+	}, nil
+}
+
+// checkReferences returns an error if the output refers to a capture group
+// missing in the regular expression.
+func checkReferences(output string, re *regexp.Regexp) error {
+	for i := 0; i < len(output); i++ {
+		if output[i] != '$' || i+1 == len(output) {
+			continue
+		}
+		var name string
+		rest := output[i+1:]
+		switch {
+		case rest[0] == '$':
+			i++
+			continue
+		case rest[0] == '{':
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return fmt.Errorf("Unterminated reference in %q", output)
+			}
+			name = rest[1:end]
+		default:
+			end := strings.IndexFunc(rest, func(r rune) bool {
+				return !(r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+			})
+			if end < 0 {
+				end = len(rest)
+			}
+			name = rest[:end]
+		}
+		if name == "" {
+			continue
+		}
+		if number, err := strconv.Atoi(name); err == nil {
+			if number > re.NumSubexp() {
+				return fmt.Errorf("New label %q refers to missing capture group $%d", output, number)
+			}
+		} else if re.SubexpIndex(name) < 0 {
+			return fmt.Errorf("New label %q refers to missing capture group %q", output, name)
+		}
+	}
+	return nil
+}
+
+// newLabel computes the new label for a matched label. The key, value and
+// matches are empty for specs without an old label.
+func (s *spec) newLabel(
+	in input,
+	key string,
+	value string,
+	keyMatch []int,
+	valueMatch []int,
+) (string, string, error) {
+	var data *templateData
+	if s.newKeyTemplate != nil || s.newValueTemplate != nil {
+		data = &templateData{
+			Labels:      in.labels,
+			Annotations: in.annotations,
+			Fields:      in.fields,
+			ProviderID:  providerIDFields(in.fields),
+			Key:         key,
+			Value:       value,
+			Captures:    s.captures(key, value, keyMatch, valueMatch),
+		}
+	}
+	newKey, err := s.newOutput(s.newKey, s.newKeyTemplate, data, key, value, keyMatch, valueMatch)
+	if err != nil {
+		return "", "", err
+	}
+	if s.newValueProgram != nil {
+		newValue, err := evalExpression[string](s.newValueProgram, in.expressionNode)
+		return newKey, newValue, err
+	}
+	newValue, err := s.newOutput(s.newValue, s.newValueTemplate, data, key, value, keyMatch, valueMatch)
+	if err != nil {
+		return "", "", err
+	}
+	return newKey, newValue, nil
+}
+
+// newOutput renders the new label key or value.
+func (s *spec) newOutput(
+	output string,
+	tmpl *template.Template,
+	data *templateData,
+	key string,
+	value string,
+	keyMatch []int,
+	valueMatch []int,
+) (string, error) {
+	switch {
+	case tmpl != nil:
+		return renderTemplate(tmpl, data)
+	case s.oldKeyRegexp == nil:
+		return output, nil
+	case s.captureRegexp != nil:
+		src, match := combineMatches(key, value, keyMatch, valueMatch)
+		return string(s.captureRegexp.ExpandString(nil, output, src, match)), nil
+	case s.oldKeyRegexp.NumSubexp() > 0:
+		return strings.Replace(output, "*", key[keyMatch[2]:keyMatch[3]], 1), nil
+	case s.oldValueRegexp.NumSubexp() > 0:
+		return strings.Replace(output, "*", value[valueMatch[2]:valueMatch[3]], 1), nil
+	default:
+		return output, nil
+	}
+}
+
+// captures returns the text matched by the wildcard as capture 1, or the
+// text matched by the capture groups of regular expression specs by number
+// and by name.
+func (s *spec) captures(key, value string, keyMatch, valueMatch []int) map[string]string {
+	captures := map[string]string{}
+	switch {
+	case s.oldKeyRegexp == nil:
+	case s.captureRegexp != nil:
+		src, match := combineMatches(key, value, keyMatch, valueMatch)
+		for i, name := range s.captureRegexp.SubexpNames() {
+			if i == 0 || match[2*i] < 0 {
+				continue
+			}
+			captured := src[match[2*i]:match[2*i+1]]
+			captures[strconv.Itoa(i)] = captured
+			if _, ok := captures[name]; name != "" && !ok {
+				captures[name] = captured
+			}
+		}
+	case s.oldKeyRegexp.NumSubexp() > 0:
+		captures["1"] = key[keyMatch[2]:keyMatch[3]]
+	case s.oldValueRegexp.NumSubexp() > 0:
+		captures["1"] = value[valueMatch[2]:valueMatch[3]]
+	}
+	return captures
+}
+
+// combineMatches lays out the key and value matches as if the combined
+// capture expression of a regular expression spec matched key=value.
+func combineMatches(key, value string, keyMatch, valueMatch []int) (string, []int) {
+	src := key + "=" + value
+	match := append([]int{0, len(src)}, keyMatch[2:]...)
+	offset := len(key) + 1
+	for _, index := range valueMatch[2:] {
+		if index >= 0 {
+			index += offset
+		}
+		match = append(match, index)
+	}
+	return src, match
+}
+
+// compileSelectorSpec compiles a spec with no old label, which sets the new
+// label on all nodes matching its selector.
+func compileSelectorSpec(oldKey, oldValue, newKey, newValue string) (spec, error) {
+	if newKey == "" {
+		return spec{}, &ruleError{field: "set", message: "New label must have a key"}
+	}
+	literalKey, literalValue := literal(newKey), literal(newValue)
+	if strings.Contains(literalKey, "*") || strings.Contains(literalValue, "*") {
+		return spec{}, &ruleError{
+			field:   "set",
+			message: "Wildcard pattern cannot appear in new label without appearing in the old one",
+		}
+	}
+	empty := regexp.MustCompile("")
+	for _, output := range []string{literalKey, literalValue} {
+		if err := checkReferences(output, empty); err != nil {
+			return spec{}, &ruleError{field: "set", message: err.Error()}
+		}
+	}
+	return spec{newKey: newKey, newValue: newValue}, nil
+}
+
+// parseSelector parses a label selector. Returns nil for an empty selector.
+func parseSelector(selector string) (k8s_labels.Selector, error) {
+	if strings.TrimSpace(selector) == "" {
+		return nil, nil
+	}
+	parsed, err := k8s_labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid selector %q: %w", selector, err)
+	}
+	return parsed, nil
+}
+
+// Result is the outcome of applying relabeling specs to a set of labels.
+type Result struct {
+	// Labels are the labels to set.
+	Labels map[string]string
+	// Rules maps each of the keys in Labels to the name of the rule that
+	// produced it.
+	Rules map[string]string
+	// Moved contains the keys in Labels that are set by move rules. Such
+	// labels replace the moved ones and are not owned by the rules.
+	Moved map[string]bool
+	// Removed maps the keys of the labels to remove to the name of the rule
+	// that removes them. Labels that are also set by a rule are kept.
+	Removed map[string]string
+	// Taints are the changes to the node's taints, identified by TaintID.
+	Taints Changes
+	// Annotations are the changes to the node's annotations.
+	Annotations Changes
+	// Unmatched are the names of the lookup rules whose tables have no row
+	// for the node.
+	Unmatched []string
+	// Failed are the names of the rules that failed for the node, e.g.
+	// because their plugins failed or their new labels are invalid. The
+	// labels these rules have set earlier should be kept.
+	Failed []string
+	// Errors maps the names of the failed rules to their errors.
+	Errors map[string]error
+	// Err is set if a plugin rule with the retry failure policy failed, in
+	// which case processing the node should be retried.
+	Err error
+}
+
+// Changes are the changes to a set of keyed values of a node, with the same
+// meaning as the label fields of Result.
+type Changes struct {
+	Set     map[string]string
+	Rules   map[string]string
+	Moved   map[string]bool
+	Removed map[string]string
+}
+
+func newChanges() Changes {
+	return Changes{
+		Set:     map[string]string{},
+		Rules:   map[string]string{},
+		Moved:   map[string]bool{},
+		Removed: map[string]string{},
+	}
+}
+
+// LabelChanges returns the changes to the node's labels.
+func (r *Result) LabelChanges() Changes {
+	return Changes{Set: r.Labels, Rules: r.Rules, Moved: r.Moved, Removed: r.Removed}
+}
+
+// changes returns the changes to the target.
+func (r *Result) changes(t target) Changes {
+	switch t {
+	case targetTaint:
+		return r.Taints
+	case targetAnnotation:
+		return r.Annotations
+	default:
+		return r.LabelChanges()
+	}
+}
+
+// allChanges returns the changes to the labels, taints, and annotations.
+func (r *Result) allChanges() []Changes {
+	return []Changes{r.LabelChanges(), r.Taints, r.Annotations}
+}
+
 // ApplyTo applies relabeling operations to a set of labels. Returns a map with
 // changes to apply to the labels.
 func (s Specs) ApplyTo(labels map[string]string) map[string]string {
-	replacements := map[string]string{}
+	return s.Apply(labels).Labels
+}
 
-	for key, value := range labels {
-		for _, spec := range s {
-			keyMatch := spec.oldKeyRegexp.FindStringSubmatch(key)
+// Apply applies relabeling operations to a set of labels. Returns the changes
+// to apply to the labels along with the rules that produced them. Rules
+// matching node fields, resources, addresses, taints, or annotations, and
+// plugin rules never match.
+func (s Specs) Apply(labels map[string]string) Result {
+	return s.apply(input{labels: labels})
+}
+
+// ApplyToNode applies relabeling operations to the labels, fields, taints,
+// and annotations of a node.
+func (s Specs) ApplyToNode(node *core_v1.Node) Result {
+	return s.apply(input{
+		node:        node,
+		labels:      node.Labels,
+		fields:      NodeFields(node),
+		taints:      node.Spec.Taints,
+		annotations: node.Annotations,
+		addresses:   node.Status.Addresses,
+	})
+}
+
+// input is what the specs are applied to.
+type input struct {
+	// node is the node the specs are applied to, or nil if they are
+	// applied to labels only.
+	node   *core_v1.Node
+	labels map[string]string
+	// fields are the node fields, or nil if the specs are applied to labels
+	// only.
+	fields      map[string]string
+	taints      []core_v1.Taint
+	annotations map[string]string
+	addresses   []core_v1.NodeAddress
+	// expressionNode is the node variable of CEL expressions. Only set if
+	// any of the specs have expressions.
+	expressionNode *expressionNode
+}
+
+// entry is a label, node field, taint, or annotation a spec can match.
+type entry struct {
+	key    string
+	value  string
+	effect string
+}
+
+// entries returns the entries the spec can match.
+func (in input) entries(spec spec) []entry {
+	var entries []entry
+	switch {
+	case spec.oldTarget == targetTaint:
+		for _, taint := range in.taints {
+			if spec.oldEffect == "" || string(taint.Effect) == spec.oldEffect {
+				entries = append(entries, entry{taint.Key, taint.Value, string(taint.Effect)})
+			}
+		}
+	case spec.oldTarget == targetAnnotation:
+		for key, value := range in.annotations {
+			entries = append(entries, entry{key: key, value: value})
+		}
+	case spec.fieldSource:
+		for key, value := range in.fields {
+			entries = append(entries, entry{key: key, value: value})
+		}
+	default:
+		for key, value := range in.labels {
+			entries = append(entries, entry{key: key, value: value})
+		}
+	}
+	return entries
+}
+
+func (s Specs) apply(in input) Result {
+	result := Result{
+		Labels:      map[string]string{},
+		Rules:       map[string]string{},
+		Moved:       map[string]bool{},
+		Removed:     map[string]string{},
+		Taints:      newChanges(),
+		Annotations: newChanges(),
+	}
+
+	if s.hasExpressions() {
+		in.expressionNode = newExpressionNode(in)
+	}
+	labelSet := k8s_labels.Set(in.labels)
+	for _, spec := range s {
+		if spec.selector != nil && !spec.selector.Matches(labelSet) {
+			continue
+		}
+		matches, err := spec.matchesCondition(in)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"rule": spec.name,
+				"node": in.expressionNode.Name,
+			}).WithError(err).Warn("Failed to evaluate condition")
+			result.fail(spec, err)
+			continue
+		}
+		if !matches {
+			continue
+		}
+		if spec.resource != nil {
+			if in.fields != nil {
+				result.setResourceLabel(spec, in)
+			}
+			continue
+		}
+		if spec.lookup != nil {
+			result.setLookupLabels(spec, in)
+			continue
+		}
+		if spec.cidr != nil {
+			if in.fields != nil {
+				result.setCIDRLabel(spec, in)
+			}
+			continue
+		}
+		if spec.plugin != nil {
+			if in.node != nil {
+				result.setPluginLabels(spec, in)
+			}
+			continue
+		}
+		if spec.oldKeyRegexp == nil {
+			// The spec is only gated by the selector.
+			result.setNewLabel(spec, in, "", "", nil, nil)
+			continue
+		}
+		for _, entry := range in.entries(spec) {
+			keyMatch := spec.oldKeyRegexp.FindStringSubmatchIndex(entry.key)
 			if keyMatch == nil {
 				continue
 			}
-			valueMatch := spec.oldValueRegexp.FindStringSubmatch(value)
+			valueMatch := spec.oldValueRegexp.FindStringSubmatchIndex(entry.value)
 			if valueMatch == nil {
 				continue
 			}
-			var newKey, newValue string
-			if spec.oldKeyRegexp.NumSubexp() > 0 {
-				newKey = strings.Replace(spec.newKey, "*", keyMatch[1], 1)
-				newValue = strings.Replace(spec.newValue, "*", keyMatch[1], 1)
-			} else if spec.oldValueRegexp.NumSubexp() > 0 {
-				newKey = strings.Replace(spec.newKey, "*", valueMatch[1], 1)
-				newValue = strings.Replace(spec.newValue, "*", valueMatch[1], 1)
-
-			} else {
-				newKey = spec.newKey
-				newValue = spec.newValue
+			if spec.op != opSet {
+				id := entry.key
+				if spec.oldTarget == targetTaint {
+					id = TaintID(entry.key, entry.effect)
+				}
+				result.changes(spec.oldTarget).Removed[id] = spec.name
 			}
-			replacements[newKey] = newValue
+			if spec.op == opDelete {
+				continue
+			}
+			result.setNewLabel(spec, in, entry.key, entry.value, keyMatch, valueMatch)
+		}
+	}
+	for _, changes := range result.allChanges() {
+		for key := range changes.Set {
+			delete(changes.Removed, key)
+		}
+	}
+	return result
+}
+
+// setNewLabel records the new label produced by the spec for a matched
+// label. If the new label cannot be rendered or is invalid, the spec's rule
+// fails for the node.
+func (r *Result) setNewLabel(
+	spec spec,
+	in input,
+	key string,
+	value string,
+	keyMatch []int,
+	valueMatch []int,
+) {
+	newKey, newValue, err := spec.newLabel(in, key, value, keyMatch, valueMatch)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"rule": spec.name,
+			"key":  key,
+		}).WithError(err).Warn("Failed to render new label")
+		r.fail(spec, err)
+		return
+	}
+	if err := validateOutput(spec.newTarget, newKey, newValue); err != nil {
+		r.fail(spec, err)
+		return
+	}
+	if spec.newTarget == targetTaint {
+		newKey = TaintID(newKey, spec.newEffect)
+	}
+	r.changes(spec.newTarget).set(spec, newKey, newValue)
+}
+
+// validateOutput returns an error if the new key or value produced for the
+// target would be rejected by the API server, failing the whole node update.
+// Annotation values are not limited.
+func validateOutput(t target, key, value string) error {
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return fmt.Errorf("Invalid %s key %q: %s", t, key, strings.Join(errs, "; "))
+	}
+	if t == targetAnnotation {
+		return nil
+	}
+	if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+		return fmt.Errorf("Invalid value of %s %s: %s", t, key, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// fail records that the spec's rule has failed for the node with the error.
+// Only the first error of each rule is kept.
+func (r *Result) fail(spec spec, err error) {
+	if r.Errors == nil {
+		r.Errors = map[string]error{}
+	}
+	if _, ok := r.Errors[spec.name]; ok {
+		return
+	}
+	r.Failed = append(r.Failed, spec.name)
+	r.Errors[spec.name] = err
+}
+
+// setResourceLabel records the new label produced by a resource spec, if the
+// quantity of the resource is in one of its buckets.
+func (r *Result) setResourceLabel(spec spec, in input) {
+	bucket, quantity, err := spec.resource.find(in.fields)
+	if err != nil {
+		logrus.WithField("rule", spec.name).WithError(err).Warn("Failed to match resource")
+		return
+	}
+	if bucket == nil {
+		return
+	}
+	if bucket.value != "" {
+		spec.newValue = bucket.value
+		spec.newValueTemplate = bucket.valueTemplate
+		spec.newValueProgram = nil
+	}
+	r.setNewLabel(spec, in, spec.resource.path, quantity, nil, nil)
+}
+
+// setCIDRLabel records the new label produced by a CIDR spec, if one of the
+// node's addresses is in one of its ranges.
+func (r *Result) setCIDRLabel(spec spec, in input) {
+	cidrRange, address := spec.cidr.find(in.addresses)
+	if cidrRange == nil {
+		return
+	}
+	if cidrRange.value != "" {
+		spec.newValue = cidrRange.value
+		spec.newValueTemplate = cidrRange.valueTemplate
+		spec.newValueProgram = nil
+	}
+	r.setNewLabel(spec, in, spec.cidr.path, address, nil, nil)
+}
+
+// setLookupLabels records the labels the spec finds in its lookup table.
+func (r *Result) setLookupLabels(spec spec, in input) {
+	labels, unmatched := spec.lookup.find(in)
+	if unmatched {
+		r.Unmatched = append(r.Unmatched, spec.name)
+	}
+	for key, value := range labels {
+		r.changes(targetLabel).set(spec, key, value)
+	}
+}
+
+// setPluginLabels records the labels the spec's plugin sets and removes. If
+// the plugin fails, the rule is recorded as failed.
+func (r *Result) setPluginLabels(spec spec, in input) {
+	response, err := spec.plugin.find(spec.name, in)
+	if err != nil {
+		r.fail(spec, err)
+		if spec.plugin.retry {
+			r.Err = errors.Join(r.Err, fmt.Errorf("Rule %s: %w", spec.name, err))
 		}
+		return
+	}
+	for key, value := range response.Labels {
+		r.changes(targetLabel).set(spec, key, value)
+	}
+	for _, key := range response.Remove {
+		r.Removed[key] = spec.name
 	}
-	return replacements
 }
 
-func newSpecParseError(spec string, message string) error {
+// set records a value produced by the spec.
+func (c Changes) set(spec spec, key, value string) {
+	c.Set[key] = value
+	c.Rules[key] = spec.name
+	if spec.op == opMove {
+		c.Moved[key] = true
+	} else {
+		delete(c.Moved, key)
+	}
+}
+
+// Matches returns true if any of the specs match the labels.
+func (s Specs) Matches(labels map[string]string) bool {
+	return s.apply(input{labels: labels}).matched()
+}
+
+// MatchesNode returns true if any of the specs match the labels, fields,
+// taints, or annotations of the node.
+func (s Specs) MatchesNode(node *core_v1.Node) bool {
+	return s.ApplyToNode(node).matched()
+}
+
+// MatchedRules returns the sorted names of the rules that set or remove
+// labels, taints, or annotations in the result.
+func (r *Result) MatchedRules() []string {
+	names := map[string]bool{}
+	for _, changes := range r.allChanges() {
+		for _, name := range changes.Rules {
+			names[name] = true
+		}
+		for _, name := range changes.Removed {
+			names[name] = true
+		}
+	}
+	rules := make([]string, 0, len(names))
+	for name := range names {
+		rules = append(rules, name)
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+func (r Result) matched() bool {
+	for _, changes := range r.allChanges() {
+		if len(changes.Set) > 0 || len(changes.Removed) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func newSpecParseError(regex bool, spec string, message string) error {
+	flag := "--relabel"
+	if regex {
+		flag = "--relabel-regex"
+	}
 	if message == "" {
-		message = "Specs must be in the form old/label=value:new/label=newvalue."
+		message = "Specs must be in the form old/label=value:new/label=newvalue, " +
+			"-old/label=value:new/label=newvalue, or -old/label=value, " +
+			"optionally preceded by selector;."
 	}
-	return fmt.Errorf("Invalid --relabel spec %s. %s", spec, message)
+	return fmt.Errorf("Invalid %s spec %s. %s", flag, spec, message)
 }
@@ -5,6 +5,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestParseSimple(t *testing.T) {
@@ -85,6 +87,27 @@ func TestParseOldValueOnlyWildcard(t *testing.T) {
 	assert.Equal(t, "xyz", specs[0].newValue)
 }
 
+func TestParseDelete(t *testing.T) {
+	specs, err := Parse([]string{"-abc*=def"})
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, opDelete, specs[0].op)
+	assert.Equal(t, "^abc(.*)$", specs[0].oldKeyRegexp.String())
+	assert.Equal(t, "^def$", specs[0].oldValueRegexp.String())
+	assert.Equal(t, "", specs[0].newKey)
+}
+
+func TestParseMove(t *testing.T) {
+	specs, err := Parse([]string{"-abc=*:uvw=*"})
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, opMove, specs[0].op)
+	assert.Equal(t, "^abc$", specs[0].oldKeyRegexp.String())
+	assert.Equal(t, "^(.*)$", specs[0].oldValueRegexp.String())
+	assert.Equal(t, "uvw", specs[0].newKey)
+	assert.Equal(t, "*", specs[0].newValue)
+}
+
 func TestParseLabelSpecFailures(t *testing.T) {
 	testData := []struct {
 		name    string
@@ -116,6 +139,26 @@ func TestParseLabelSpecFailures(t *testing.T) {
 			[]string{"abc=def:uvw=xyz=123"},
 			"Specs must be in the form",
 		},
+		{
+			"DeleteWithoutKey",
+			[]string{"-=abc"},
+			"Specs must be in the form",
+		},
+		{
+			"MoveWithoutNewKey",
+			[]string{"-abc=def:=xyz"},
+			"Specs must be in the form",
+		},
+		{
+			"MoveTooManyLabelSpecs",
+			[]string{"-abc=def:ghi=jkl:uvw=xyz"},
+			"Specs must be in the form",
+		},
+		{
+			"MoveNewValueWildcardOnly",
+			[]string{"-abc=def:uvw=xyz*"},
+			"cannot appear in new label without appearing in the old one",
+		},
 		{
 			"NewKeyWildcardOnly",
 			[]string{"abc=def:uvw*=xyz"},
@@ -218,3 +261,301 @@ func TestApplyToWildcardValueReplaceKeyValue(t *testing.T) {
 	results := specs.ApplyTo(map[string]string{"abc": "def123"})
 	assert.Equal(t, results, map[string]string{"pqr123": "def123"})
 }
+
+func TestApplyReportsRules(t *testing.T) {
+	specs, err := Parse([]string{"abc=*:def=*", "uvw=xyz:uvw=ABC"})
+	require.NoError(t, err)
+	result := specs.Apply(map[string]string{"abc": "123", "uvw": "xyz"})
+	assert.Equal(t, map[string]string{"def": "123", "uvw": "ABC"}, result.Labels)
+	assert.Equal(
+		t,
+		map[string]string{"def": "abc=*:def=*", "uvw": "uvw=xyz:uvw=ABC"},
+		result.Rules,
+	)
+}
+
+func TestApplyDelete(t *testing.T) {
+	specs, err := Parse([]string{"-abc*=def"})
+	require.NoError(t, err)
+	result := specs.Apply(map[string]string{"abc1": "def", "abc2": "xyz", "uvw": "def"})
+	assert.Empty(t, result.Labels)
+	assert.Equal(t, map[string]string{"abc1": "-abc*=def"}, result.Removed)
+	assert.True(t, specs.Matches(map[string]string{"abc1": "def"}))
+	assert.False(t, specs.Matches(map[string]string{"abc1": "xyz"}))
+}
+
+func TestResultMatchedRules(t *testing.T) {
+	specs, err := Parse([]string{"-abc*=def", "uvw=*:xyz=*", "ghi=jkl:mno=pqr"})
+	require.NoError(t, err)
+	result := specs.Apply(map[string]string{"abc1": "def", "uvw": "123"})
+	assert.Equal(t, []string{"-abc*=def", "uvw=*:xyz=*"}, result.MatchedRules())
+}
+
+func TestApplyMove(t *testing.T) {
+	specs, err := Parse([]string{"-old.example.com/*=true:new.example.com/*=true"})
+	require.NoError(t, err)
+	result := specs.Apply(map[string]string{"old.example.com/gpu": "true", "abc": "def"})
+	assert.Equal(t, map[string]string{"new.example.com/gpu": "true"}, result.Labels)
+	assert.Equal(t, map[string]bool{"new.example.com/gpu": true}, result.Moved)
+	assert.Equal(
+		t,
+		map[string]string{"old.example.com/gpu": "-old.example.com/*=true:new.example.com/*=true"},
+		result.Removed,
+	)
+}
+
+func TestApplyKeepsRemovedLabelsSetByOtherRules(t *testing.T) {
+	specs, err := Parse([]string{"-abc=*", "uvw=xyz:abc=def"})
+	require.NoError(t, err)
+	result := specs.Apply(map[string]string{"abc": "123", "uvw": "xyz"})
+	assert.Equal(t, map[string]string{"abc": "def"}, result.Labels)
+	assert.Empty(t, result.Removed)
+}
+
+func TestParseRegex(t *testing.T) {
+	specs, err := ParseRegex([]string{`pool-(\d+)=(?P<size>[a-z]+):pool=${size}-$1`})
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, opSet, specs[0].op)
+	assert.Equal(t, `^(?:pool-(\d+))$`, specs[0].oldKeyRegexp.String())
+	assert.Equal(t, `^(?:(?P<size>[a-z]+))$`, specs[0].oldValueRegexp.String())
+	assert.Equal(t, "pool", specs[0].newKey)
+	assert.Equal(t, "${size}-$1", specs[0].newValue)
+}
+
+func TestParseRegexSeparatorsInPatterns(t *testing.T) {
+	specs, err := ParseRegex([]string{`-(?:a|b)[:=]x=(?:c|d):new=ok`})
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, opMove, specs[0].op)
+	assert.Equal(t, `^(?:(?:a|b)[:=]x)$`, specs[0].oldKeyRegexp.String())
+	assert.Equal(t, `^(?:(?:c|d))$`, specs[0].oldValueRegexp.String())
+	assert.Equal(t, "new", specs[0].newKey)
+}
+
+func TestParseRegexFailures(t *testing.T) {
+	testData := []struct {
+		name    string
+		spec    string
+		message string
+	}{
+		{"NotEnoughLabelSpecs", "uvw=xyz", "Invalid --relabel-regex spec"},
+		{"InvalidKeyPattern", "abc(?z)=def:uvw=xyz", "Invalid key pattern"},
+		{"InvalidValuePattern", "abc=de**:uvw=xyz", "Invalid value pattern"},
+		{"MissingNumberedGroup", "abc(.*)=def:uvw=$2", "missing capture group \\$2"},
+		{"MissingNamedGroup", "abc=(?P<x>.*):uvw=${y}", "missing capture group \"y\""},
+		{"UnterminatedReference", "abc=(.*):uvw=${1", "Unterminated reference"},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := ParseRegex([]string{testItem.spec})
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
+
+func TestApplyRegex(t *testing.T) {
+	testData := []struct {
+		name     string
+		spec     string
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{
+			"KeyAndValueCaptures",
+			`pool-(\d+)=(?P<size>[a-z]+):pool=${size}-$1`,
+			map[string]string{"pool-3": "large", "pool-x": "small"},
+			map[string]string{"pool": "large-3"},
+		},
+		{
+			"NamedKeyCapture",
+			`(?P<team>[a-z]+)\.example\.com/owner=.*:owner=${team}`,
+			map[string]string{"infra.example.com/owner": "yes"},
+			map[string]string{"owner": "infra"},
+		},
+		{
+			"UnmatchedOptionalGroup",
+			`size=(small|(large))?:large=x${2}x`,
+			map[string]string{"size": "small"},
+			map[string]string{"large": "xx"},
+		},
+		{
+			"PatternIsAnchored",
+			`abc=de:uvw=xyz`,
+			map[string]string{"abc": "def", "xabc": "de"},
+			map[string]string{},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			specs, err := ParseRegex([]string{testItem.spec})
+			require.NoError(t, err)
+			assert.Equal(t, testItem.expected, specs.ApplyTo(testItem.labels))
+		})
+	}
+}
+
+func TestApplyRegexLiteralDollar(t *testing.T) {
+	// Label values cannot contain a dollar sign, so use an annotation.
+	specs, err := ParseRegex([]string{`abc=(.*):example.com/uvw=$$1@annotation`})
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		map[string]string{"example.com/uvw": "$1"},
+		specs.Apply(map[string]string{"abc": "def"}).Annotations.Set,
+	)
+}
+
+func TestParseSelector(t *testing.T) {
+	specs, err := Parse([]string{"env=prod,!spot;:node-role.kubernetes.io/ingress="})
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	require.NotNil(t, specs[0].selector)
+	assert.Equal(t, "env=prod,!spot", specs[0].selector.String())
+	assert.Nil(t, specs[0].oldKeyRegexp)
+	assert.Equal(t, "node-role.kubernetes.io/ingress", specs[0].newKey)
+}
+
+func TestParseSelectorFailures(t *testing.T) {
+	testData := []struct {
+		name    string
+		spec    string
+		message string
+	}{
+		{"InvalidSelector", "env in prod;:abc=def", "Invalid selector"},
+		{"WildcardWithoutOldLabel", "env=prod;:abc=*", "Wildcard pattern cannot appear"},
+		{"DeleteWithoutOldLabel", "env=prod;-=abc", "Specs must be in the form"},
+		{"NoNewKey", "env=prod;:=abc", "New label must have a key"},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := Parse([]string{testItem.spec})
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
+
+func TestApplySelector(t *testing.T) {
+	testData := []struct {
+		name     string
+		spec     string
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{
+			"SelectorOnlyMatches",
+			"env=prod,zone in (a,b),!spot;:node-role.kubernetes.io/ingress=",
+			map[string]string{"env": "prod", "zone": "a"},
+			map[string]string{"node-role.kubernetes.io/ingress": ""},
+		},
+		{
+			"SelectorOnlyExcluded",
+			"env=prod,zone in (a,b),!spot;:node-role.kubernetes.io/ingress=",
+			map[string]string{"env": "prod", "zone": "a", "spot": "true"},
+			map[string]string{},
+		},
+		{
+			"SelectorWithLabelMatches",
+			"env=prod;role=*:node-role.kubernetes.io/*=",
+			map[string]string{"env": "prod", "role": "gpu"},
+			map[string]string{"node-role.kubernetes.io/gpu": ""},
+		},
+		{
+			"SelectorWithLabelExcluded",
+			"env=prod;role=*:node-role.kubernetes.io/*=",
+			map[string]string{"env": "dev", "role": "gpu"},
+			map[string]string{},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			specs, err := Parse([]string{testItem.spec})
+			require.NoError(t, err)
+			assert.Equal(t, testItem.expected, specs.ApplyTo(testItem.labels))
+		})
+	}
+}
+
+func TestApplyRegexSelector(t *testing.T) {
+	specs, err := ParseRegex([]string{"tier in (web);(.*)=(x|y):out=$1-$2"})
+	require.NoError(t, err)
+	result := specs.ApplyTo(map[string]string{"tier": "web", "abc": "x"})
+	assert.Equal(t, map[string]string{"out": "abc-x"}, result)
+}
+
+func TestApplyAnnotations(t *testing.T) {
+	testData := []struct {
+		name        string
+		spec        string
+		labels      map[string]string
+		annotations map[string]string
+		setLabels   map[string]string
+		set         map[string]string
+		removed     map[string]string
+	}{
+		{
+			"AnnotationToLabel",
+			"cluster.x-k8s.io/machine=*@annotation:machine=*",
+			nil,
+			map[string]string{"cluster.x-k8s.io/machine": "worker-1"},
+			map[string]string{"machine": "worker-1"},
+			map[string]string{},
+			map[string]string{},
+		},
+		{
+			"LabelToAnnotation",
+			"role=*:example.com/role=node role {{.Value}}@annotation",
+			map[string]string{"role": "gpu"},
+			nil,
+			map[string]string{},
+			map[string]string{"example.com/role": "node role gpu"},
+			map[string]string{},
+		},
+		{
+			"LabelsDoNotMatchAnnotations",
+			"role=*@annotation:role=*",
+			map[string]string{"role": "gpu"},
+			nil,
+			map[string]string{},
+			map[string]string{},
+			map[string]string{},
+		},
+		{
+			"DeleteAnnotation",
+			"-legacy/*=true@annotation",
+			nil,
+			map[string]string{"legacy/a": "true", "legacy/b": "false"},
+			map[string]string{},
+			map[string]string{},
+			map[string]string{"legacy/a": "-legacy/*=true@annotation"},
+		},
+		{
+			"TemplateUsesAnnotations",
+			"role=*:owner={{index .Annotations \"example.com/owner\"}}",
+			map[string]string{"role": "gpu"},
+			map[string]string{"example.com/owner": "ml"},
+			map[string]string{"owner": "ml"},
+			map[string]string{},
+			map[string]string{},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			specs, err := Parse([]string{testItem.spec})
+			require.NoError(t, err)
+			node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+				Name:        "test-node",
+				Labels:      testItem.labels,
+				Annotations: testItem.annotations,
+			}}
+			result := specs.ApplyToNode(node)
+			assert.Equal(t, testItem.setLabels, result.Labels)
+			assert.Equal(t, testItem.set, result.Annotations.Set)
+			assert.Equal(t, testItem.removed, result.Annotations.Removed)
+			// Without a node, annotations are never matched.
+			assert.Empty(t, specs.Apply(testItem.labels).Annotations.Removed)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package specs
+
+import (
+	"fmt"
+	"strings"
+
+	core_v1 "k8s.io/api/core/v1"
+)
+
+// target is what the old or new label of a spec refers to.
+type target int
+
+const (
+	// targetLabel is a node label.
+	targetLabel target = iota
+	// targetTaint is a node taint.
+	targetTaint
+	// targetAnnotation is a node annotation.
+	targetAnnotation
+)
+
+// String returns the name of the target as used in error messages.
+func (t target) String() string {
+	switch t {
+	case targetTaint:
+		return "taint"
+	case targetAnnotation:
+		return "annotation"
+	default:
+		return "label"
+	}
+}
+
+// annotationSuffix follows a side of a spec referring to an annotation,
+// in place of a taint effect.
+const annotationSuffix = "annotation"
+
+// taintEffects are the valid taint effects.
+var taintEffects = []string{
+	string(core_v1.TaintEffectNoSchedule),
+	string(core_v1.TaintEffectPreferNoSchedule),
+	string(core_v1.TaintEffectNoExecute),
+}
+
+// TaintID identifies a taint in Result. A node can have only one taint with
+// the same key and effect.
+func TaintID(key, effect string) string {
+	return key + ":" + effect
+}
+
+// ParseTaintID returns the key and the effect of the taint identified by id.
+func ParseTaintID(id string) (string, string) {
+	index := strings.LastIndex(id, ":")
+	if index < 0 {
+		return id, ""
+	}
+	return id[:index], id[index+1:]
+}
+
+// splitTarget splits a side of a spec into the label and, if it refers to a
+// taint in the form key=value@effect, the effect. A side in the form
+// key=value@annotation refers to an annotation.
+func splitTarget(side string, regex bool) (string, target, string, error) {
+	parts := splitSpec(side, "@", regex)
+	switch len(parts) {
+	case 1:
+		return side, targetLabel, "", nil
+	case 2:
+		if parts[1] == annotationSuffix {
+			return parts[0], targetAnnotation, "", nil
+		}
+		return parts[0], targetTaint, parts[1], nil
+	default:
+		return "", targetLabel, "", fmt.Errorf("Too many @ in %q", side)
+	}
+}
+
+// compileTargets validates and records what the old and new labels of the
+// spec refer to.
+func (s *spec) compileTargets(
+	oldTarget target,
+	oldEffect string,
+	newTarget target,
+	newEffect string,
+) error {
+	if oldTarget == targetTaint {
+		if oldEffect == "*" {
+			oldEffect = ""
+		}
+		if oldEffect != "" && !isTaintEffect(oldEffect) {
+			return fmt.Errorf(
+				"Invalid taint effect %q, must be * or one of %s",
+				oldEffect, strings.Join(taintEffects, ", "))
+		}
+	}
+	if newTarget == targetTaint && !isTaintEffect(newEffect) {
+		return fmt.Errorf(
+			"Invalid taint effect %q, must be one of %s",
+			newEffect, strings.Join(taintEffects, ", "))
+	}
+	s.oldTarget = oldTarget
+	s.oldEffect = oldEffect
+	s.newTarget = newTarget
+	s.newEffect = newEffect
+	return nil
+}
+
+func isTaintEffect(effect string) bool {
+	for _, valid := range taintEffects {
+		if effect == valid {
+			return true
+		}
+	}
+	return false
+}
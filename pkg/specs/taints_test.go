@@ -0,0 +1,174 @@
+package specs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTaintID(t *testing.T) {
+	id := TaintID("example.com/dedicated", "NoSchedule")
+	assert.Equal(t, "example.com/dedicated:NoSchedule", id)
+	key, effect := ParseTaintID(id)
+	assert.Equal(t, "example.com/dedicated", key)
+	assert.Equal(t, "NoSchedule", effect)
+}
+
+func TestApplyTaints(t *testing.T) {
+	testData := []struct {
+		name       string
+		spec       string
+		nodeLabels map[string]string
+		nodeTaints []core_v1.Taint
+		labels     map[string]string
+		taints     map[string]string
+		removed    map[string]string
+	}{
+		{
+			"LabelToTaint",
+			"dedicated=*:dedicated=*@NoSchedule",
+			map[string]string{"dedicated": "gpu"},
+			nil,
+			map[string]string{},
+			map[string]string{"dedicated:NoSchedule": "gpu"},
+			map[string]string{},
+		},
+		{
+			"TaintToLabel",
+			"dedicated=*@NoSchedule:dedicated=*",
+			nil,
+			[]core_v1.Taint{{Key: "dedicated", Value: "gpu", Effect: "NoSchedule"}},
+			map[string]string{"dedicated": "gpu"},
+			map[string]string{},
+			map[string]string{},
+		},
+		{
+			"TaintEffectMismatch",
+			"dedicated=*@NoExecute:dedicated=*",
+			nil,
+			[]core_v1.Taint{{Key: "dedicated", Value: "gpu", Effect: "NoSchedule"}},
+			map[string]string{},
+			map[string]string{},
+			map[string]string{},
+		},
+		{
+			"TaintAnyEffect",
+			"dedicated=*@*:dedicated=*",
+			nil,
+			[]core_v1.Taint{{Key: "dedicated", Value: "gpu", Effect: "NoExecute"}},
+			map[string]string{"dedicated": "gpu"},
+			map[string]string{},
+			map[string]string{},
+		},
+		{
+			"DeleteTaint",
+			"-legacy/a=*@*",
+			nil,
+			[]core_v1.Taint{
+				{Key: "legacy/a", Effect: "NoSchedule"},
+				{Key: "other", Effect: "NoSchedule"},
+			},
+			map[string]string{},
+			map[string]string{},
+			map[string]string{"legacy/a:NoSchedule": "-legacy/a=*@*"},
+		},
+		{
+			"MoveTaint",
+			"-old=*@NoSchedule:new=*@NoExecute",
+			nil,
+			[]core_v1.Taint{{Key: "old", Value: "x", Effect: "NoSchedule"}},
+			map[string]string{},
+			map[string]string{"new:NoExecute": "x"},
+			map[string]string{"old:NoSchedule": "-old=*@NoSchedule:new=*@NoExecute"},
+		},
+		{
+			"SelectorToTaint",
+			"spot=true;:spot=@PreferNoSchedule",
+			map[string]string{"spot": "true"},
+			nil,
+			map[string]string{},
+			map[string]string{"spot:PreferNoSchedule": ""},
+			map[string]string{},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			specs, err := Parse([]string{testItem.spec})
+			require.NoError(t, err)
+			node := &core_v1.Node{
+				ObjectMeta: meta_v1.ObjectMeta{Name: "test-node", Labels: testItem.nodeLabels},
+				Spec:       core_v1.NodeSpec{Taints: testItem.nodeTaints},
+			}
+			result := specs.ApplyToNode(node)
+			assert.Equal(t, testItem.labels, result.Labels)
+			assert.Equal(t, testItem.taints, result.Taints.Set)
+			assert.Equal(t, testItem.removed, result.Taints.Removed)
+		})
+	}
+}
+
+func TestParseTaintFailures(t *testing.T) {
+	testData := []struct {
+		name    string
+		spec    string
+		message string
+	}{
+		{"InvalidNewEffect", "abc=*:abc=*@Sometimes", "Invalid taint effect \"Sometimes\""},
+		{"MissingNewEffect", "abc=*:abc=*@", "Invalid taint effect \"\""},
+		{"InvalidOldEffect", "abc=*@Never:abc=*", "Invalid taint effect \"Never\""},
+		{"TooManyEffects", "abc=*@NoSchedule@NoExecute:abc=*", "Specs must be in the form"},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			_, err := Parse([]string{testItem.spec})
+			require.Error(t, err)
+			assert.Regexp(t, testItem.message, err.Error())
+		})
+	}
+}
+
+func TestParseConfigTaints(t *testing.T) {
+	specs, err := ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: dedicated
+  match: {key: dedicated, value: "*"}
+  set: {type: taint, key: dedicated, value: "*", effect: NoSchedule}
+`))
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, "dedicated=*:dedicated=*@NoSchedule", specs[0].stringSpec)
+	node := &core_v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{"dedicated": "gpu"},
+	}}
+	result := specs.ApplyToNode(node)
+	assert.Equal(t, map[string]string{"dedicated:NoSchedule": "gpu"}, result.Taints.Set)
+	assert.Equal(t, map[string]string{"dedicated:NoSchedule": "dedicated"}, result.Taints.Rules)
+
+	_, err = ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: dedicated
+  match: {key: dedicated, value: "*"}
+  set: {type: taint, key: dedicated, value: "*", effect: Sometimes}
+`))
+	require.Error(t, err)
+	assert.Regexp(t, "line 7: Invalid rule \"dedicated\". Invalid taint effect", err.Error())
+
+	_, err = ParseConfig([]byte(`
+apiVersion: node-relabeler.vladlosev.github.io/v1alpha1
+kind: RelabelConfig
+rules:
+- name: dedicated
+  match: {type: widget, key: dedicated, value: "*"}
+  set: {key: dedicated, value: "*"}
+`))
+	require.Error(t, err)
+	assert.Regexp(t, "line 6: Invalid rule \"dedicated\". Unknown type \"widget\"", err.Error())
+}
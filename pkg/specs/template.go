@@ -0,0 +1,114 @@
+package specs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// templateFuncs are the functions available in new label templates, in
+// addition to the text/template builtins. The functions taking extra
+// arguments take the string last, so that they can be used in pipelines.
+var templateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"truncate": func(length int, s string) (string, error) {
+		if length < 0 {
+			return "", fmt.Errorf("Invalid truncate length %d", length)
+		}
+		if runes := []rune(s); len(runes) > length {
+			return string(runes[:length]), nil
+		}
+		return s, nil
+	},
+	"default": func(defaultValue, s string) string {
+		if s == "" {
+			return defaultValue
+		}
+		return s
+	},
+	// sha256 returns the hex SHA-256 digest cut to 63 characters, the
+	// longest label value.
+	"sha256": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:validation.LabelValueMaxLength]
+	},
+}
+
+// templateData is the data new label templates are rendered with.
+type templateData struct {
+	// Labels are all the labels of the node.
+	Labels map[string]string
+	// Annotations are all the annotations of the node.
+	Annotations map[string]string
+	// Fields are the node fields rules can match, by path.
+	Fields map[string]string
+	// ProviderID are the fields parsed from the node's provider ID, by name.
+	ProviderID map[string]string
+	// Key and Value are the key and value of the matched label.
+	Key   string
+	Value string
+	// Captures are the texts matched by the wildcard (as "1") or by the
+	// capture groups of a regular expression, by number and by name.
+	Captures map[string]string
+}
+
+// isTemplate returns true if the new label key or value is a template.
+func isTemplate(output string) bool {
+	return strings.Contains(output, "{{")
+}
+
+// literal returns the new label key or value, or an empty string if it is a
+// template.
+func literal(output string) string {
+	if isTemplate(output) {
+		return ""
+	}
+	return output
+}
+
+// compileTemplates parses the new label key and value if they are templates.
+func (s *spec) compileTemplates() error {
+	var err error
+	if s.newKeyTemplate, err = parseTemplate(s.newKey); err != nil {
+		return err
+	}
+	if s.newValueTemplate, err = parseTemplate(s.newValue); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseTemplate parses the output as a template. Returns nil if the output
+// is not a template.
+func parseTemplate(output string) (*template.Template, error) {
+	if !isTemplate(output) {
+		return nil, nil
+	}
+	// Missing labels render as empty strings, to be handled with default.
+	tmpl, err := template.New("label").
+		Option("missingkey=zero").
+		Funcs(templateFuncs).
+		Parse(output)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template %q: %w", output, err)
+	}
+	return tmpl, nil
+}
+
+// renderTemplate executes the template with the data.
+func renderTemplate(tmpl *template.Template, data *templateData) (string, error) {
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,185 @@
+package specs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyTemplates(t *testing.T) {
+	testData := []struct {
+		name     string
+		spec     string
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{
+			"Lower",
+			"owner=*:team={{.Value | lower}}",
+			map[string]string{"owner": "Platform"},
+			map[string]string{"team": "platform"},
+		},
+		{
+			"Upper",
+			"owner=*:team={{upper .Value}}",
+			map[string]string{"owner": "platform"},
+			map[string]string{"team": "PLATFORM"},
+		},
+		{
+			"WildcardCapture",
+			"size.example.com/*=true:size={{index .Captures \"1\" | trimPrefix \"x\"}}",
+			map[string]string{"size.example.com/x2large": "true"},
+			map[string]string{"size": "2large"},
+		},
+		{
+			"Replace",
+			"instance-type=*:size={{.Value | replace \".\" \"-\"}}",
+			map[string]string{"instance-type": "m5.xlarge"},
+			map[string]string{"size": "m5-xlarge"},
+		},
+		{
+			"TemplateKey",
+			"role=*:{{.Value}}.example.com/role=true",
+			map[string]string{"role": "gpu"},
+			map[string]string{"gpu.example.com/role": "true"},
+		},
+		{
+			"OtherLabels",
+			"role=*:role-zone={{.Value}}-{{.Labels.zone}}",
+			map[string]string{"role": "gpu", "zone": "a"},
+			map[string]string{"role-zone": "gpu-a"},
+		},
+		{
+			"DefaultForMissingLabel",
+			"role=*:team={{.Labels.owner | default \"none\"}}",
+			map[string]string{"role": "gpu"},
+			map[string]string{"team": "none"},
+		},
+		{
+			"Truncate",
+			"owner=*:short={{.Value | truncate 4}}",
+			map[string]string{"owner": "platform"},
+			map[string]string{"short": "plat"},
+		},
+		{
+			"Sha256",
+			"owner=*:hash={{.Value | sha256 | truncate 8}}",
+			map[string]string{"owner": "platform"},
+			map[string]string{"hash": "d294fcce"},
+		},
+		{
+			"SeparatorsInTemplate",
+			"owner=*:team={{$owner := .Value}}{{$owner | lower}}",
+			map[string]string{"owner": "Platform"},
+			map[string]string{"team": "platform"},
+		},
+		{
+			"SelectorOnly",
+			"env=prod;:team={{.Labels.owner | lower}}",
+			map[string]string{"env": "prod", "owner": "Platform"},
+			map[string]string{"team": "platform"},
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			specs, err := Parse([]string{testItem.spec})
+			require.NoError(t, err)
+			assert.Equal(t, testItem.expected, specs.ApplyTo(testItem.labels))
+		})
+	}
+}
+
+func TestApplyRegexTemplate(t *testing.T) {
+	specs, err := ParseRegex([]string{
+		`pool-(\d+)=(?P<size>[a-z]+):pool={{.Captures.size | upper}}-{{index .Captures "1"}}`,
+	})
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		map[string]string{"pool": "LARGE-3"},
+		specs.ApplyTo(map[string]string{"pool-3": "large"}),
+	)
+}
+
+func TestApplyTemplateFailure(t *testing.T) {
+	specs, err := Parse([]string{"owner=*:team={{.Value | truncate -1}}", "abc=*:def=*"})
+	require.NoError(t, err)
+	// The failing rule fails for the node and the others still apply.
+	result := specs.Apply(map[string]string{"owner": "platform", "abc": "x"})
+	assert.Equal(t, map[string]string{"def": "x"}, result.Labels)
+	rule := "owner=*:team={{.Value | truncate -1}}"
+	assert.Equal(t, []string{rule}, result.Failed)
+	require.Contains(t, result.Errors, rule)
+	assert.Contains(t, result.Errors[rule].Error(), "Invalid truncate length -1")
+}
+
+func TestParseInvalidTemplate(t *testing.T) {
+	_, err := Parse([]string{"owner=*:team={{.Value | nosuchfunc}}"})
+	require.Error(t, err)
+	assert.Regexp(t, "Invalid template", err.Error())
+}
+
+func TestApplyInvalidOutput(t *testing.T) {
+	testData := []struct {
+		name    string
+		spec    string
+		labels  map[string]string
+		message string
+	}{
+		{
+			"ValueTooLong",
+			"owner=*:team={{.Value}}-{{.Value}}",
+			map[string]string{"owner": strings.Repeat("a", 40)},
+			"Invalid value of label team",
+		},
+		{
+			"InvalidValueCharacters",
+			"owner=*:team={{.Value | upper}} team",
+			map[string]string{"owner": "platform"},
+			"Invalid value of label team",
+		},
+		{
+			"InvalidTemplateKey",
+			"owner=*:{{.Value}}.example.com/owner=true",
+			map[string]string{"owner": "Platform Team"},
+			`Invalid label key "Platform Team.example.com/owner"`,
+		},
+		{
+			"InvalidWildcardKey",
+			"owner=*:team/*=true",
+			map[string]string{"owner": "a/b"},
+			`Invalid label key "team/a/b"`,
+		},
+	}
+	for _, testItem := range testData {
+		t.Run(testItem.name, func(t *testing.T) {
+			specs, err := Parse([]string{testItem.spec, "owner=*:managed=true"})
+			require.NoError(t, err)
+			result := specs.Apply(testItem.labels)
+			// The invalid rule fails and the others still apply.
+			assert.Equal(t, map[string]string{"managed": "true"}, result.Labels)
+			assert.Equal(t, []string{testItem.spec}, result.Failed)
+			require.Contains(t, result.Errors, testItem.spec)
+			assert.Contains(t, result.Errors[testItem.spec].Error(), testItem.message)
+		})
+	}
+}
+
+func TestApplyLongAnnotationValue(t *testing.T) {
+	specs, err := Parse([]string{"owner=*:example.com/owner={{.Value}}@annotation"})
+	require.NoError(t, err)
+	value := strings.Repeat("a", 100)
+	result := specs.Apply(map[string]string{"owner": value})
+	assert.Empty(t, result.Failed)
+	assert.Equal(t, map[string]string{"example.com/owner": value}, result.Annotations.Set)
+}
+
+func TestApplySha256FitsLabelValue(t *testing.T) {
+	specs, err := Parse([]string{"owner=*:owner-hash={{.Value | sha256}}"})
+	require.NoError(t, err)
+	result := specs.Apply(map[string]string{"owner": "platform"})
+	assert.Empty(t, result.Failed)
+	assert.Len(t, result.Labels["owner-hash"], 63)
+}